@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Administrators, users with role=admin among their settings in
+// id_passwd.txt, can list the sessions logged in to the server and close a
+// session or every session of a user. A closed session gets a notice if it
+// is waiting for an operation; one in the middle of an operation is cut
+// off, which discards a partial upload like any dropped connection.
+const (
+	opListSessions  byte = 28
+	opCloseSessions byte = 29
+)
+
+// Targets of opCloseSessions.
+const (
+	closeByAddress byte = 0
+	closeByUser    byte = 1
+)
+
+const adminOnlyMessage = "Permission denied: administrators only"
+
+// operationNames names operation types for session listings.
+var operationNames = map[byte]string{
+	1: "upload", 2: "download", 3: "view", 4: "delete", 5: "list",
+	6: "search", 7: "follow", 8: "preview", 9: "quota", 10: "status",
+	11: "list versions", 12: "download version", 13: "restore version",
+	14: "list trash", 15: "restore trash", 16: "empty trash",
+	17: "dedup upload", 18: "delta upload", 19: "capabilities",
+	20: "compressed upload", 21: "compressed download", 22: "details",
+	23: "begin ranged upload", 24: "ranged upload part",
+	25: "finish ranged upload", 26: "ranged download", opPing: "ping",
+	opListSessions: "list sessions", opCloseSessions: "close sessions",
+}
+
+func isAdmin(username string) bool {
+	return lookupAccount(username).option("role") == "admin"
+}
+
+// sessionInfo is a snapshot of a session for a listing.
+type sessionInfo struct {
+	id        string
+	username  string
+	addr      string
+	started   time.Time
+	operation string
+	idle      time.Duration
+	bytesIn   int64
+	bytesOut  int64
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := sessionInfo{
+		id:        s.id,
+		username:  s.username,
+		addr:      s.addr,
+		started:   s.started,
+		operation: "idle",
+		idle:      time.Since(s.lastActive),
+		bytesIn:   s.bytesIn.Load(),
+		bytesOut:  s.bytesOut.Load(),
+	}
+	if s.busy {
+		info.operation = operationNames[s.opType]
+		if info.operation == "" {
+			info.operation = fmt.Sprintf("operation %d", s.opType)
+		}
+	}
+	return info
+}
+
+// listSessions returns every session, oldest first.
+func listSessions() []sessionInfo {
+	mu.Lock()
+	sessions := make([]*session, 0, len(authenticatedSessions))
+	for _, s := range authenticatedSessions {
+		sessions = append(sessions, s)
+	}
+	mu.Unlock()
+
+	infos := make([]sessionInfo, len(sessions))
+	for i, s := range sessions {
+		infos[i] = s.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].started.Before(infos[j].started) })
+	return infos
+}
+
+// close ends the session, with a notice if it is waiting for an operation.
+func (s *session) close(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed.CompareAndSwap(false, true) {
+		return
+	}
+	if !s.busy {
+		sendNotice(s, reason)
+	}
+	s.conn.Close()
+}
+
+// closeSessions closes the sessions at addr or of a user, except the
+// session asking, and returns how many it closed.
+func closeSessions(target byte, value string, except *session, reason string) int {
+	mu.Lock()
+	var matched []*session
+	for _, s := range authenticatedSessions {
+		if s == except {
+			continue
+		}
+		if (target == closeByAddress && s.addr == value) || (target == closeByUser && s.username == value) {
+			matched = append(matched, s)
+		}
+	}
+	mu.Unlock()
+
+	for _, s := range matched {
+		s.close(reason)
+	}
+	return len(matched)
+}
+
+// handleListSessions sends statusOK and the number of sessions (int32),
+// then for each its user, address (int32 length + text each), login time
+// (Unix seconds), current operation ("idle" between operations), seconds
+// since its last operation and bytes received and sent (int64 each).
+func handleListSessions(conn net.Conn, username string) error {
+	if !isAdmin(username) {
+		logFor(conn).Warn("Refused session list: not an administrator")
+		return sendStatus(conn, statusError, adminOnlyMessage)
+	}
+	sessions := listSessions()
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(sessions))); err != nil {
+		return fmt.Errorf("error sending session count: %v", err)
+	}
+	for _, s := range sessions {
+		for _, text := range []string{s.username, s.addr} {
+			if err := writeString(conn, text); err != nil {
+				return fmt.Errorf("error sending session: %v", err)
+			}
+		}
+		if err := binary.Write(conn, binary.LittleEndian, s.started.Unix()); err != nil {
+			return fmt.Errorf("error sending session: %v", err)
+		}
+		if err := writeString(conn, s.operation); err != nil {
+			return fmt.Errorf("error sending session: %v", err)
+		}
+		for _, v := range []int64{int64(s.idle / time.Second), s.bytesIn, s.bytesOut} {
+			if err := binary.Write(conn, binary.LittleEndian, v); err != nil {
+				return fmt.Errorf("error sending session: %v", err)
+			}
+		}
+	}
+	logFor(conn).Info("Listed sessions", "sessions", len(sessions))
+	return nil
+}
+
+// handleCloseSessions reads a target (byte: 0 for an address, 1 for a user)
+// and the address or username, closes the matching sessions other than the
+// asking one and sends statusOK and how many were closed (int32).
+func handleCloseSessions(reader *bufio.Reader, conn net.Conn, s *session) error {
+	target, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("error reading target: %v", err)
+	}
+	value, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading target: %v", err)
+	}
+	if !isAdmin(s.username) {
+		s.log.Warn("Refused to close sessions: not an administrator")
+		return sendStatus(conn, statusError, adminOnlyMessage)
+	}
+	if target != closeByAddress && target != closeByUser {
+		return sendStatus(conn, statusError, "Invalid target")
+	}
+
+	closed := closeSessions(target, value, s, "Session closed by an administrator")
+	s.log.Info("Closed sessions", "match", value, "sessions", closed)
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	return binary.Write(conn, binary.LittleEndian, int32(closed))
+}
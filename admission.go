@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admission control keeps runaway clients from exhausting the server.
+// Connections are counted as they are accepted, in total and per address,
+// and refused with a "Server busy" line past the limits; sessions are
+// counted per user once they log in. Heavy operations, which move or scan
+// file content, run on a bounded pool of workers. A request waits in a
+// queue for a free worker and is answered with statusBusy if the queue is
+// full or no worker frees up in time.
+
+// authTimeout is how long a new connection has to send its credentials.
+const authTimeout = 30 * time.Second
+
+const busyMessage = "Server busy, try again later"
+
+// session is a logged-in connection.
+type session struct {
+	id       string
+	username string
+	addr     string
+	conn     net.Conn
+	started  time.Time
+
+	// busy is set while the session runs an operation of type opType;
+	// lastActive is when it last ran one other than a ping
+	mu         sync.Mutex
+	busy       bool
+	opType     byte
+	lastActive time.Time
+
+	// bytes received and sent since login, and whether an administrator
+	// closed the session
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	closed   atomic.Bool
+
+	// The operation running: its request ID, audit record and logger. Only
+	// the session's own goroutine uses them.
+	requests   int64
+	request    string
+	audit      *auditRecord
+	sessionLog *slog.Logger
+	log        *slog.Logger
+}
+
+var (
+	admissionMu        sync.Mutex
+	openConnections    int64
+	connectionsByIP    = make(map[string]int64)
+	refusedConnections atomic.Int64
+
+	workerSlots chan struct{}
+	queuedWork  atomic.Int64
+)
+
+func connectionIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// admitConnection counts a newly accepted connection, or returns why it is
+// refused.
+func admitConnection(conn net.Conn) string {
+	cfg := currentConfig()
+	ip := connectionIP(conn)
+	admissionMu.Lock()
+	defer admissionMu.Unlock()
+	if cfg.MaxConnections > 0 && openConnections >= cfg.MaxConnections {
+		return "too many connections"
+	}
+	if cfg.MaxConnectionsPerIP > 0 && connectionsByIP[ip] >= cfg.MaxConnectionsPerIP {
+		return "too many connections from your address"
+	}
+	openConnections++
+	connectionsByIP[ip]++
+	return ""
+}
+
+// releaseConnection uncounts an admitted connection once it closes.
+func releaseConnection(conn net.Conn) {
+	ip := connectionIP(conn)
+	admissionMu.Lock()
+	defer admissionMu.Unlock()
+	openConnections--
+	if connectionsByIP[ip]--; connectionsByIP[ip] <= 0 {
+		delete(connectionsByIP, ip)
+	}
+}
+
+// refuseConnection tells a client why it was not admitted and hangs up.
+func refuseConnection(conn net.Conn, reason string) {
+	defer conn.Close()
+	refusedConnections.Add(1)
+	slog.Warn("Refused connection", "addr", conn.RemoteAddr().String(), "reason", reason)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(fmt.Sprintf("Server busy: %s. Try again later.\n", reason)))
+}
+
+// registerSession adds a logged-in connection to authenticatedSessions,
+// unless its user already has as many sessions as allowed.
+func registerSession(username string, conn net.Conn) (*session, bool) {
+	limit := currentConfig().MaxSessionsPerUser
+	mu.Lock()
+	defer mu.Unlock()
+	if limit > 0 {
+		count := int64(0)
+		for _, s := range authenticatedSessions {
+			if s.username == username {
+				count++
+			}
+		}
+		if count >= limit {
+			return nil, false
+		}
+	}
+	now := time.Now()
+	s := &session{id: newSessionID(), username: username, addr: conn.RemoteAddr().String(), conn: conn, started: now, lastActive: now}
+	s.sessionLog = slog.With("session", s.id, "user", username)
+	s.log = s.sessionLog
+	authenticatedSessions[s.addr] = s
+	return s, true
+}
+
+func unregisterSession(s *session) {
+	mu.Lock()
+	delete(authenticatedSessions, s.addr)
+	mu.Unlock()
+}
+
+func startWorkerPool(size int) {
+	workerSlots = make(chan struct{}, size)
+}
+
+// acquireWorker waits for a free worker for a heavy operation and returns
+// the func that frees it again. ok is false if the queue is full or no
+// worker frees up in time.
+func acquireWorker() (release func(), ok bool) {
+	release = func() { <-workerSlots }
+	select {
+	case workerSlots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	cfg := currentConfig()
+	if queuedWork.Add(1) > int64(cfg.WorkerQueueSize) {
+		queuedWork.Add(-1)
+		return nil, false
+	}
+	defer queuedWork.Add(-1)
+	timer := time.NewTimer(cfg.WorkerQueueTimeout)
+	defer timer.Stop()
+	select {
+	case workerSlots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// sendBusy answers a request that found no free worker.
+func sendBusy(conn net.Conn, username, operation string) error {
+	logFor(conn).Warn("Server busy: turned away operation", "op", operation)
+	return sendStatus(conn, statusBusy, busyMessage)
+}
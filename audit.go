@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The audit log holds one JSON record per line for every operation a
+// session runs, pings aside, and for every login and logout. Bytes and
+// durations come from the session's counters; handlers note the file an
+// operation concerns, and the checksum of what an upload stored. A request
+// answered with a status other than statusOK is recorded with that status
+// as its result. An operation that ends the session with an error, for
+// example on a dropped connection, is recorded as "error"; the server log
+// has the details. Records go to a rotating file and, if enabled, syslog.
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session,omitempty"`
+	Request    string    `json:"request,omitempty"`
+	User       string    `json:"user"`
+	IP         string    `json:"ip"`
+	Op         string    `json:"op"`
+	Opcode     int       `json:"opcode,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	DurationMs float64   `json:"duration_ms"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	Checksum   string    `json:"checksum,omitempty"`
+
+	// counters of the session when the operation started
+	bytesIn, bytesOut int64
+}
+
+// Results recorded for statuses other than statusOK.
+var statusResults = map[byte]string{
+	statusError:         "error",
+	statusQuotaExceeded: "quota_exceeded",
+	statusDiskFull:      "disk_full",
+	statusReadOnly:      "read_only",
+	statusUnsupported:   "unsupported",
+	statusBusy:          "busy",
+}
+
+var (
+	auditFile   *rotatingFile
+	auditSyslog io.Writer
+	// sessionSeq numbers sessions; IDs also carry the server's start time,
+	// so they stay unique across restarts
+	sessionSeq atomic.Int64
+)
+
+// openAuditLog opens the audit destinations configured in server.conf.
+func openAuditLog(cfg *serverConfig) error {
+	if cfg.AuditLog != "" {
+		f, err := openRotatingFile(cfg.AuditLog, cfg.AuditLogMaxSize, 0, cfg.AuditLogKeep)
+		if err != nil {
+			return err
+		}
+		auditFile = f
+		slog.Info("Writing audit records", "file", cfg.AuditLog)
+	}
+	if cfg.AuditSyslog {
+		w, err := openAuditSyslog()
+		if err != nil {
+			return fmt.Errorf("error opening syslog: %v", err)
+		}
+		auditSyslog = w
+		slog.Info("Sending audit records to syslog")
+	}
+	return nil
+}
+
+func newSessionID() string {
+	return fmt.Sprintf("%x-%d", serverStart.Unix(), sessionSeq.Add(1))
+}
+
+// writeAudit stamps rec with the time and writes it out.
+func writeAudit(rec *auditRecord) {
+	if auditFile == nil && auditSyslog == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Time = rec.Time.UTC()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("Error encoding audit record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+	if auditFile != nil {
+		if _, err := auditFile.Write(line); err != nil {
+			slog.Error("Error writing audit record", "error", err)
+		}
+	}
+	if auditSyslog != nil {
+		if _, err := auditSyslog.Write(line); err != nil {
+			slog.Error("Error sending audit record to syslog", "error", err)
+		}
+	}
+}
+
+// auditEvent records an event outside any operation, such as a login.
+func auditEvent(s *session, username, ip, op, result, msg string) {
+	rec := &auditRecord{User: username, IP: ip, Op: op, Result: result, Error: msg}
+	if s != nil {
+		rec.Session = s.id
+		rec.BytesIn, rec.BytesOut = s.bytesIn.Load(), s.bytesOut.Load()
+		rec.DurationMs = milliseconds(time.Since(s.started))
+	}
+	writeAudit(rec)
+}
+
+// startAudit opens the record of an operation the session is about to run.
+func (s *session) startAudit(opType byte) {
+	if opType == opPing {
+		s.audit = nil
+		return
+	}
+	name := operationNames[opType]
+	if name == "" {
+		name = fmt.Sprintf("operation %d", opType)
+	}
+	s.audit = &auditRecord{
+		Time:     time.Now(),
+		Session:  s.id,
+		Request:  s.request,
+		User:     s.username,
+		IP:       connectionIP(s.conn),
+		Op:       name,
+		Opcode:   int(opType),
+		bytesIn:  s.bytesIn.Load(),
+		bytesOut: s.bytesOut.Load(),
+	}
+}
+
+// finishAudit writes the record of the operation that just ran. If the
+// operation failed without a status saying why, it is recorded as an error.
+func (s *session) finishAudit(failed bool) {
+	rec := s.audit
+	if rec == nil {
+		return
+	}
+	s.audit = nil
+	rec.BytesIn = s.bytesIn.Load() - rec.bytesIn
+	rec.BytesOut = s.bytesOut.Load() - rec.bytesOut
+	rec.DurationMs = milliseconds(time.Since(rec.Time))
+	if rec.Result == "" {
+		rec.Result = "ok"
+		if failed {
+			rec.Result, rec.Error = "error", "operation failed"
+		}
+	}
+	writeAudit(rec)
+}
+
+// auditFor returns the record of the operation running on conn, or a
+// throwaway record for connections without one.
+func auditFor(conn net.Conn) *auditRecord {
+	if c, ok := conn.(*throttledConn); ok && c.s.audit != nil {
+		return c.s.audit
+	}
+	return &auditRecord{}
+}
+
+// setPath notes the file an operation concerns.
+func (rec *auditRecord) setPath(name string) {
+	rec.Path = name
+}
+
+// setChecksum notes the SHA-256 of the content an upload stored.
+func (rec *auditRecord) setChecksum(sum []byte) {
+	rec.Checksum = hex.EncodeToString(sum)
+}
+
+// fail notes that the request was answered with status and msg.
+func (rec *auditRecord) fail(status byte, msg string) {
+	if status == statusOK {
+		return
+	}
+	rec.Result, rec.Error = statusResults[status], msg
+	if rec.Result == "" {
+		rec.Result = "error"
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openAuditSyslog() (io.Writer, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openAuditSyslog connects to the local syslog daemon, which on systemd
+// hosts forwards to the journal.
+func openAuditSyslog() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "dftp-audit")
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const chunksDirName = ".chunks"
+
+// manifestMagic starts every manifest. Files without it are plain files, so
+// both kinds can live side by side and deduplication can be switched on or
+// off at any time.
+const manifestMagic = "DFTP-MANIFEST 1\n"
+
+// manifest lists the chunks of a deduplicated file, in order.
+type manifest struct {
+	Size   int64
+	Chunks []chunkRef
+}
+
+type chunkRef struct {
+	Hash   string
+	Size   int64
+	offset int64
+}
+
+var (
+	chunkMu sync.Mutex
+	// chunkRefs counts the manifest entries pointing at each stored chunk.
+	// A chunk is deleted when its count drops to zero.
+	chunkRefs = make(map[string]int)
+)
+
+func chunkKey(hash string) string {
+	return path.Join(chunksDirName, hash[:2], hash)
+}
+
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func validChunkHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// storeChunk saves data under its hash unless it is already stored, and
+// takes refs references to it.
+func storeChunk(hash string, data []byte, refs int) error {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+
+	if chunkRefs[hash] > 0 {
+		chunkRefs[hash] += refs
+		return nil
+	}
+	if err := writeObject(chunkKey(hash), data); err != nil {
+		return err
+	}
+	chunkRefs[hash] = refs
+	return nil
+}
+
+// refChunk takes refs references to a stored chunk. It reports false, and
+// takes nothing, if the chunk is not stored.
+func refChunk(hash string, refs int) bool {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	if chunkRefs[hash] == 0 {
+		return false
+	}
+	chunkRefs[hash] += refs
+	return true
+}
+
+// releaseChunks drops one reference per hash and deletes chunks nothing
+// refers to any more.
+func releaseChunks(hashes []string) {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	for _, hash := range hashes {
+		if chunkRefs[hash]--; chunkRefs[hash] > 0 {
+			continue
+		}
+		delete(chunkRefs, hash)
+		if overlapping.Load() {
+			// Another server process may refer to it; it is removed when
+			// references are counted again
+			continue
+		}
+		if err := store.Remove(chunkKey(hash)); err != nil && !os.IsNotExist(err) {
+			slog.Error("Error removing chunk", "chunk", hash, "error", err)
+		}
+	}
+}
+
+func (m *manifest) hashes() []string {
+	hashes := make([]string, len(m.Chunks))
+	for i, c := range m.Chunks {
+		hashes[i] = c.Hash
+	}
+	return hashes
+}
+
+func (m *manifest) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%ssize %d\n", manifestMagic, m.Size)
+	for _, c := range m.Chunks {
+		fmt.Fprintf(bw, "%s %d\n", c.Hash, c.Size)
+	}
+	return bw.Flush()
+}
+
+// readManifest parses a manifest. The caller has already checked the magic.
+func readManifest(r io.Reader) (*manifest, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // magic
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("manifest has no size")
+	}
+	var m manifest
+	if _, err := fmt.Sscanf(scanner.Text(), "size %d", &m.Size); err != nil {
+		return nil, fmt.Errorf("invalid manifest size: %v", err)
+	}
+	var offset int64
+	for scanner.Scan() {
+		hash, sizeText, ok := strings.Cut(scanner.Text(), " ")
+		size, err := strconv.ParseInt(sizeText, 10, 64)
+		if !ok || err != nil || !validChunkHash(hash) {
+			return nil, fmt.Errorf("invalid manifest entry %q", scanner.Text())
+		}
+		m.Chunks = append(m.Chunks, chunkRef{Hash: hash, Size: size, offset: offset})
+		offset += size
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if offset != m.Size {
+		return nil, fmt.Errorf("manifest chunks add up to %d bytes, not %d", offset, m.Size)
+	}
+	return &m, nil
+}
+
+func hasManifestMagic(file io.ReaderAt) bool {
+	head := make([]byte, len(manifestMagic))
+	n, _ := file.ReadAt(head, 0)
+	return n == len(head) && string(head) == manifestMagic
+}
+
+// loadManifest returns the manifest stored as name, or nil if name is a
+// plain file.
+func loadManifest(name string) (*manifest, error) {
+	file, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if !hasManifestMagic(file) {
+		return nil, nil
+	}
+	return readManifest(file)
+}
+
+// storedFile is an open file from the store. Through openStoredFile it
+// reads the content whether the file is kept whole or as a manifest of
+// chunks, and Stat reports the size of the content.
+type storedFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// openStoredFile opens name for reading its content.
+func openStoredFile(name string) (storedFile, error) {
+	file, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !hasManifestMagic(file) {
+		return file, nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m, err := readManifest(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %v", name, err)
+	}
+	return &manifestFile{manifest: m, info: info, current: -1}, nil
+}
+
+// statStoredFile is Stat with the content size for manifests.
+func statStoredFile(name string) (os.FileInfo, error) {
+	info, err := store.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	m, err := loadManifest(name)
+	if err != nil || m == nil {
+		return info, err
+	}
+	return sizedInfo{info, m.Size}, nil
+}
+
+// fileIdentity returns the FileInfo of the stored object behind f, for
+// sameObject checks.
+func fileIdentity(f storedFile) (os.FileInfo, error) {
+	if mf, ok := f.(*manifestFile); ok {
+		return mf.info, nil
+	}
+	return f.Stat()
+}
+
+// manifestFile reads the content of a manifest by opening its chunks as
+// needed. The most recently used chunk is kept open.
+type manifestFile struct {
+	*manifest
+	info os.FileInfo
+	pos  int64
+
+	mu      sync.Mutex
+	current int
+	chunk   storedFile
+}
+
+func (f *manifestFile) Stat() (os.FileInfo, error) {
+	return sizedInfo{f.info, f.Size}, nil
+}
+
+func (f *manifestFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= f.Size {
+			return read, io.EOF
+		}
+		i := sort.Search(len(f.Chunks), func(i int) bool {
+			return f.Chunks[i].offset+f.Chunks[i].Size > pos
+		})
+		if i != f.current {
+			chunk, err := store.Open(chunkKey(f.Chunks[i].Hash))
+			if err != nil {
+				return read, fmt.Errorf("missing chunk %s: %v", f.Chunks[i].Hash, err)
+			}
+			if f.chunk != nil {
+				f.chunk.Close()
+			}
+			f.chunk, f.current = chunk, i
+		}
+		ref := f.Chunks[i]
+		end := len(p)
+		if remaining := ref.offset + ref.Size - pos; int64(end-read) > remaining {
+			end = read + int(remaining)
+		}
+		n, err := f.chunk.ReadAt(p[read:end], pos-ref.offset)
+		read += n
+		if err != nil && !(err == io.EOF && read == end) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (f *manifestFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *manifestFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.Size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative seek position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *manifestFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.chunk != nil {
+		f.chunk.Close()
+		f.chunk = nil
+	}
+	return nil
+}
+
+// dedupFile replaces the plain file name with a manifest, storing its
+// chunks.
+func dedupFile(name string) error {
+	file, err := store.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var m manifest
+	c := newChunker(file)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			hash := chunkHash(data)
+			if err = storeChunk(hash, data, 1); err == nil {
+				m.Chunks = append(m.Chunks, chunkRef{Hash: hash, Size: int64(len(data))})
+				m.Size += int64(len(data))
+				continue
+			}
+		}
+		releaseChunks(m.hashes())
+		return err
+	}
+
+	if err := writeManifestFile(name, &m); err != nil {
+		releaseChunks(m.hashes())
+		return err
+	}
+	return nil
+}
+
+// writeManifestFile writes m over name.
+func writeManifestFile(name string, m *manifest) error {
+	w, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := m.write(w); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// removeStoredFile deletes a file for good, releasing its chunks if it is a
+// manifest.
+func removeStoredFile(name string) error {
+	m, err := loadManifest(name)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("Removing unreadable manifest", "file", name, "error", err)
+	}
+	if err := store.Remove(name); err != nil {
+		return err
+	}
+	if m != nil {
+		releaseChunks(m.hashes())
+	}
+	return nil
+}
+
+// copyStoredFile copies the stored file src to dst as stored: a manifest is
+// copied as a manifest, taking new references to its chunks.
+func copyStoredFile(dst io.Writer, src string) error {
+	data, err := readObject(src)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte(manifestMagic)) {
+		m, err := readManifest(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		for i, hash := range m.hashes() {
+			if !refChunk(hash, 1) {
+				releaseChunks(m.hashes()[:i])
+				return fmt.Errorf("missing chunk %s", hash)
+			}
+		}
+		if _, err := dst.Write(data); err != nil {
+			releaseChunks(m.hashes())
+			return err
+		}
+		return nil
+	}
+	_, err = dst.Write(data)
+	return err
+}
+
+// loadChunkRefs counts chunk references in every manifest in the store and,
+// with removeOrphans, removes chunks nothing refers to, such as those left
+// by an upload that was interrupted. References held by uploads in progress
+// to chunks no manifest refers to yet are kept, so it can run again while
+// the server is up.
+func loadChunkRefs(removeOrphans bool) {
+	start := time.Now()
+	refs := make(map[string]int)
+	manifests := 0
+	err := walkStore("", func(name string, info os.FileInfo) error {
+		if info.IsDir() {
+			if name == chunksDirName || name == indexDirName {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		m, err := loadManifest(name)
+		if err != nil {
+			slog.Error("Error reading manifest", "file", name, "error", err)
+			return nil
+		}
+		if m != nil {
+			manifests++
+			for _, hash := range m.hashes() {
+				refs[hash]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error reading store for chunk references", "error", err)
+	}
+
+	for hash := range refs {
+		if _, err := store.Stat(chunkKey(hash)); err != nil {
+			slog.Error("Referenced chunk is missing", "chunk", hash, "manifests", refs[hash])
+			delete(refs, hash)
+		}
+	}
+
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	for hash, n := range chunkRefs {
+		if refs[hash] == 0 {
+			refs[hash] = n
+		}
+	}
+	chunkRefs = refs
+
+	orphans := 0
+	if removeOrphans {
+		orphans = removeUnreferencedChunks()
+	}
+	slog.Info("Loaded chunk references", "chunks", len(chunkRefs), "manifests", manifests,
+		"duration", time.Since(start).Round(time.Millisecond), "removed", orphans)
+}
+
+// sweepChunks removes stored chunks nothing refers to, which a crash may
+// leave behind, and returns how many it removed. It does nothing while
+// another server process shares the store.
+func sweepChunks() int {
+	if overlapping.Load() {
+		return 0
+	}
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	return removeUnreferencedChunks()
+}
+
+// removeUnreferencedChunks does the work of sweepChunks. Callers must hold
+// chunkMu.
+func removeUnreferencedChunks() int {
+	removed := 0
+	walkStore(chunksDirName, func(name string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+		if chunkRefs[info.Name()] == 0 {
+			if store.Remove(name) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed
+}
+
+// storeStagedContent converts a received upload to a manifest when
+// deduplication is on. Uploads that happen to start with the manifest magic
+// are always converted, so a plain file can never pass for a manifest.
+func storeStagedContent(stagingName string) error {
+	file, err := store.Open(stagingName)
+	if err != nil {
+		return err
+	}
+	looksLikeManifest := hasManifestMagic(file)
+	file.Close()
+	if !dedupActive() && !looksLikeManifest {
+		return nil
+	}
+	return dedupFile(stagingName)
+}
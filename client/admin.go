@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sessionEntry struct {
+	username  string
+	addr      string
+	started   int64
+	operation string
+	idle      int64
+	bytesIn   int64
+	bytesOut  int64
+}
+
+// manageSessions lists the sessions on the server and lets an administrator
+// close one, or every session of a user.
+func (f *FileOperation) manageSessions(stdin *bufio.Reader) {
+	sessions, err := f.listSessions()
+	if err != nil {
+		fmt.Printf("Error listing sessions: %v\n", err)
+		return
+	}
+
+	fmt.Println("\nSessions:")
+	fmt.Printf("%-4s %-12s %-22s %-20s %-20s %8s %10s %10s\n", "#", "User", "Address", "Logged in", "Operation", "Idle", "Received", "Sent")
+	fmt.Println(strings.Repeat("-", 113))
+	for i, s := range sessions {
+		fmt.Printf("%-4d %-12s %-22s %-20s %-20s %8s %10s %10s\n", i+1, s.username, s.addr,
+			time.Unix(s.started, 0).Format("2006-01-02 15:04:05"), s.operation,
+			(time.Duration(s.idle) * time.Second).String(), formatSize(s.bytesIn), formatSize(s.bytesOut))
+	}
+
+	fmt.Print("\nEnter k<#> to close a session, u<username> to close all of a user's sessions, or press Enter to return: ")
+	input, _ := stdin.ReadString('\n')
+	input = strings.TrimSpace(input)
+	var target byte
+	var value string
+	switch {
+	case input == "":
+		return
+	case input[0] == 'k':
+		n, err := strconv.Atoi(input[1:])
+		if err != nil || n < 1 || n > len(sessions) {
+			fmt.Println("Invalid session number.")
+			return
+		}
+		target, value = 0, sessions[n-1].addr
+	case input[0] == 'u' && len(input) > 1:
+		target, value = 1, input[1:]
+	default:
+		fmt.Println("Invalid choice.")
+		return
+	}
+
+	closed, err := f.closeSessions(target, value)
+	if err != nil {
+		fmt.Printf("Closing sessions failed: %v\n", err)
+		return
+	}
+	fmt.Printf("Closed %d sessions.\n", closed)
+}
+
+func (f *FileOperation) listSessions() ([]sessionEntry, error) {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (28 for list sessions)
+	if _, err := f.conn.Write([]byte{28}); err != nil {
+		return nil, fmt.Errorf("error sending operation type: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return nil, fmt.Errorf("server error: %s", msg)
+	}
+
+	var count int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("error reading session count: %v", err)
+	}
+	sessions := make([]sessionEntry, count)
+	for i := range sessions {
+		s := &sessions[i]
+		if s.username, err = readString(f.conn); err != nil {
+			return nil, fmt.Errorf("error reading session: %v", err)
+		}
+		if s.addr, err = readString(f.conn); err != nil {
+			return nil, fmt.Errorf("error reading session: %v", err)
+		}
+		if err := binary.Read(f.conn, binary.LittleEndian, &s.started); err != nil {
+			return nil, fmt.Errorf("error reading session: %v", err)
+		}
+		if s.operation, err = readString(f.conn); err != nil {
+			return nil, fmt.Errorf("error reading session: %v", err)
+		}
+		for _, v := range []*int64{&s.idle, &s.bytesIn, &s.bytesOut} {
+			if err := binary.Read(f.conn, binary.LittleEndian, v); err != nil {
+				return nil, fmt.Errorf("error reading session: %v", err)
+			}
+		}
+	}
+	return sessions, nil
+}
+
+// closeSessions asks the server to close the session at an address (target
+// 0) or every session of a user (target 1).
+func (f *FileOperation) closeSessions(target byte, value string) (int32, error) {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (29 for close sessions)
+	if _, err := f.conn.Write([]byte{29, target}); err != nil {
+		return 0, fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, value); err != nil {
+		return 0, fmt.Errorf("error sending target: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return 0, fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return 0, fmt.Errorf("server error: %s", msg)
+	}
+	var closed int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &closed); err != nil {
+		return 0, fmt.Errorf("error reading count: %v", err)
+	}
+	return closed, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import "io"
+
+// Content-defined chunking parameters. Client and server must agree on
+// these and on the gear table, or re-uploads will not find existing chunks.
+const (
+	minChunkSize = 16 << 10
+	maxChunkSize = 256 << 10
+	// The top 16 bits of the rolling hash must be zero for a cut, giving
+	// chunks of about 64K past the minimum.
+	chunkCutMask = 0xFFFF << 48
+)
+
+var gearTable = func() [256]uint64 {
+	// splitmix64 from a fixed seed, so the table never changes
+	var table [256]uint64
+	state := uint64(0x6466747063686e6b)
+	for i := range table {
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks, so an insertion
+// only changes the chunks around it.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunkSize)}
+}
+
+// next returns the next chunk, or io.EOF after the last one.
+func (c *chunker) next() ([]byte, error) {
+	for !c.eof && c.n < len(c.buf) {
+		m, err := c.r.Read(c.buf[c.n:])
+		c.n += m
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := chunkCutPoint(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	copy(c.buf, c.buf[cut:c.n])
+	c.n -= cut
+	return chunk, nil
+}
+
+func chunkCutPoint(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	var hash uint64
+	for i := minChunkSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkCutMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
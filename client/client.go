@@ -3,13 +3,16 @@ package main
 import (
 	"bufio"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,10 +21,41 @@ import (
 
 var (
 	serverAddress string
-	bufferSize    = 1024
+	bufferSize    int
+	streams       int
+	keyFile       string
+	compress      bool
 )
 
 func init() {
+	flag.StringVar(&keyFile, "key-file", "", "encrypt file contents and names end to end with the key in this file")
+	flag.BoolVar(&compress, "compress", true, "agree on compression with the server (turn off for servers without the capability handshake)")
+	flag.IntVar(&bufferSize, "buffer-size", 256<<10, "bytes copied at a time in uploads and downloads")
+	flag.IntVar(&streams, "streams", 1, "connections to move large files over in parallel")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", 30*time.Second, "ping the server this often while idle at the menu (0 turns heartbeats off)")
+	rate := flag.String("limit-rate", "", "limit transfers to this many bytes per second, as in 500K or 2M")
+	genKey := flag.String("gen-key", "", "write a new end-to-end encryption key to this file and exit")
+	flag.Parse()
+	if bufferSize < 4<<10 {
+		log.Fatalf("-buffer-size must be at least 4096")
+	}
+	if streams < 1 || streams > 32 {
+		log.Fatalf("-streams must be between 1 and 32")
+	}
+	if *rate != "" {
+		var err error
+		if limitRate, err = parseRate(*rate); err != nil {
+			log.Fatalf("-limit-rate: %v", err)
+		}
+	}
+	if *genKey != "" {
+		if err := generateE2EKey(*genKey); err != nil {
+			log.Fatalf("Error writing key file: %v", err)
+		}
+		fmt.Printf("New key written to %s. Keep a copy: files encrypted with it cannot be recovered without it.\n", *genKey)
+		os.Exit(0)
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Print("Enter server address (e.g., IP:8080):")
 	address, _ := reader.ReadString('\n')
@@ -31,6 +65,25 @@ func init() {
 // FileOperation represents different file operations
 type FileOperation struct {
 	conn net.Conn
+	// noDedup is set once the server has refused a deduplicated upload
+	noDedup bool
+	// keys encrypt file names and contents end to end; nil if disabled
+	keys *e2eKeys
+	// capabilities agreed with the server, nil if the handshake was skipped,
+	// and the preferred agreed codec, nil if compression is off
+	capabilities map[string]bool
+	codec        *codec
+	// credentials log in the extra connections of parallel transfers and
+	// new sessions after the server closed one
+	credentials string
+
+	// mu is held by an operation or a heartbeat using conn; lost is set once
+	// the session is known to be closed, and warned once the user has been
+	// warned that it is about to be
+	mu     sync.Mutex
+	held   bool
+	lost   bool
+	warned bool
 }
 
 func main() {
@@ -38,27 +91,61 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to server: %v", err)
 	}
+	conn = limitConnection(conn)
 	defer conn.Close()
 
-	if !authenticate(conn) {
+	credentials, ok := authenticate(conn)
+	if !ok {
 		return
 	}
 
-	fileOp := FileOperation{conn: conn}
+	fileOp := &FileOperation{conn: conn, credentials: credentials}
+	if keyFile != "" {
+		if fileOp.keys, err = loadE2EKey(keyFile); err != nil {
+			log.Fatalf("Error loading key: %v", err)
+		}
+		fmt.Println("End-to-end encryption is on: the server only sees encrypted names and contents.")
+	}
+	if compress {
+		if err := fileOp.negotiateCapabilities(); err != nil {
+			log.Fatalf("Capability handshake failed (use -compress=false with older servers): %v", err)
+		}
+	}
+
+	if heartbeatInterval > 0 && fileOp.capabilities["heartbeat"] {
+		go fileOp.heartbeat()
+	}
 
 	for {
+		fileOp.release()
 		fmt.Println("\nFile Transfer Menu:")
 		fmt.Println("1. Upload File")
 		fmt.Println("2. Download File")
 		fmt.Println("3. View File")
 		fmt.Println("4. Delete File")
 		fmt.Println("5. List Files")
-		fmt.Println("6. Exit")
+		fmt.Println("6. Search File Contents")
+		fmt.Println("7. Follow File")
+		fmt.Println("8. Preview File")
+		fmt.Println("9. Show Quota")
+		fmt.Println("10. Server Status")
+		fmt.Println("11. File Versions")
+		fmt.Println("12. Trash")
+		fmt.Println("13. File Details")
+		fmt.Println("14. Sessions (administrators)")
+		fmt.Println("15. Exit")
 		fmt.Print("\nEnter your choice: ")
 
 		reader := bufio.NewReader(os.Stdin)
 		choice, _ := reader.ReadString('\n')
 		choice = strings.TrimSpace(choice)
+		fileOp.hold()
+		if choice != "15" && fileOp.serverClosed() {
+			if err := fileOp.reconnect(); err != nil {
+				fmt.Printf("Reconnect failed: %v\n", err)
+				return
+			}
+		}
 
 		switch choice {
 		case "1":
@@ -79,15 +166,59 @@ func main() {
 			fmt.Print("Enter file name to view: ")
 			fileName, _ := reader.ReadString('\n')
 			fileName = strings.TrimSpace(fileName)
-			fileOp.viewFile(fileName)
+			mode, offset, length, ok := promptViewOptions(reader)
+			if !ok {
+				fmt.Println("Invalid view options.")
+				continue
+			}
+			fileOp.viewFile(fileName, mode, offset, length)
 		case "4":
 			fmt.Print("Enter file name to delete: ")
 			fileName, _ := reader.ReadString('\n')
 			fileName = strings.TrimSpace(fileName)
+			fmt.Printf("Move '%s' to the trash? (y/N): ", fileName)
+			confirm, _ := reader.ReadString('\n')
+			if !strings.EqualFold(strings.TrimSpace(confirm), "y") {
+				fmt.Println("Delete cancelled.")
+				continue
+			}
 			fileOp.deleteFile(fileName)
 		case "5":
 			fileOp.listFiles()
 		case "6":
+			fmt.Print("Enter text to search for: ")
+			query, _ := reader.ReadString('\n')
+			query = strings.TrimSpace(query)
+			fileOp.searchFiles(query)
+		case "7":
+			fmt.Print("Enter file name to follow: ")
+			fileName, _ := reader.ReadString('\n')
+			fileName = strings.TrimSpace(fileName)
+			fileOp.followFile(fileName, reader)
+		case "8":
+			fmt.Print("Enter file name to preview: ")
+			fileName, _ := reader.ReadString('\n')
+			fileName = strings.TrimSpace(fileName)
+			fileOp.previewFile(fileName)
+		case "9":
+			fileOp.showQuota()
+		case "10":
+			fileOp.showServerStatus()
+		case "11":
+			fmt.Print("Enter file name: ")
+			fileName, _ := reader.ReadString('\n')
+			fileName = strings.TrimSpace(fileName)
+			fileOp.manageVersions(fileName, reader)
+		case "12":
+			fileOp.manageTrash(reader)
+		case "13":
+			fmt.Print("Enter file name: ")
+			fileName, _ := reader.ReadString('\n')
+			fileName = strings.TrimSpace(fileName)
+			fileOp.showFileDetails(fileName)
+		case "14":
+			fileOp.manageSessions(reader)
+		case "15":
 			fmt.Println("Exiting...")
 			return
 		default:
@@ -96,7 +227,9 @@ func main() {
 	}
 }
 
-func authenticate(conn net.Conn) bool {
+// authenticate asks for a username and password and logs in with them. It
+// returns the credentials so further connections can log in too.
+func authenticate(conn net.Conn) (string, bool) {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Print("Enter username: ")
 	username, _ := reader.ReadString('\n')
@@ -106,7 +239,7 @@ func authenticate(conn net.Conn) bool {
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		fmt.Println("\nError reading password:", err)
-		return false
+		return "", false
 	}
 	password := strings.TrimSpace(string(bytePassword))
 	fmt.Println()
@@ -114,30 +247,30 @@ func authenticate(conn net.Conn) bool {
 	credentials := fmt.Sprintf("%s:%s", username, password)
 	if _, err := conn.Write([]byte(credentials + "\n")); err != nil {
 		fmt.Println("Error sending credentials:", err)
-		return false
+		return "", false
 	}
 
 	response := make([]byte, 1024)
 	n, err := conn.Read(response)
 	if err != nil {
 		fmt.Println("Error reading server response:", err)
-		return false
+		return "", false
 
 	}
 
 	serverResponse := string(response[:n])
-	if strings.Contains(serverResponse, "Authentication failed") {
+	if strings.Contains(serverResponse, "Authentication failed") || strings.HasPrefix(serverResponse, "Server busy") {
 		fmt.Println(strings.TrimSpace(serverResponse))
-		return false
+		return "", false
 	}
 
 	if strings.Contains(serverResponse, "Authentication successful") {
 		fmt.Println("Authentication successful")
-		return true
+		return credentials, true
 	}
 
 	fmt.Println("Unexpected server response")
-	return false
+	return "", false
 }
 
 func (f *FileOperation) uploadFile(filePath string) error {
@@ -151,14 +284,30 @@ func (f *FileOperation) uploadFile(filePath string) error {
 	}
 	defer file.Close()
 
-	// Send operation type with explicit write
-	if _, err := f.conn.Write([]byte{1}); err != nil {
-		return fmt.Errorf("error sending operation type: %v", err)
+	// With several streams, large files go up in parts over parallel
+	// connections
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() && f.parallel(info.Size()) {
+		return f.parallelUpload(file, info)
+	}
+
+	// Large files go up as chunk lists, so the server can skip chunks it
+	// already has. Servers without deduplication get a delta against their
+	// current copy instead. Encrypted content never matches, so end-to-end
+	// encrypted uploads always send the whole file.
+	if info, err := file.Stat(); err == nil && f.keys == nil && info.Mode().IsRegular() && info.Size() >= dedupMinSize {
+		if !f.noDedup {
+			sent, err := f.dedupUpload(file, info)
+			if sent || err != nil {
+				return err
+			}
+			f.noDedup = true
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("error reading file: %v", err)
+			}
+		}
+		return f.deltaUpload(file, info)
 	}
 
-	// Small delay to ensure operation type is received
-	time.Sleep(100 * time.Millisecond)
-
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return fmt.Errorf("error getting file info: %v", err)
@@ -169,46 +318,77 @@ func (f *FileOperation) uploadFile(filePath string) error {
 	}
 	// Get the base name of the file
 	fileName := filepath.Base(filePath)
-	fileNameBytes := []byte(fileName)
-	fileNameLen := int32(len(fileNameBytes))
-
-	// Send file name length
-	if err := binary.Write(f.conn, binary.LittleEndian, fileNameLen); err != nil {
-		return fmt.Errorf("error sending filename length: %v", err)
+	uploadSize := fileInfo.Size()
+	if f.keys != nil {
+		uploadSize = sealedSize(uploadSize)
 	}
+	c := f.uploadCodec(filePath, file, fileInfo.Size())
 
-	// Send file name
-	if _, err := f.conn.Write(fileNameBytes); err != nil {
-		return fmt.Errorf("error sending filename: %v", err)
+	if f.capabilities != nil {
+		// Send operation type (20 for compressed upload) with the name,
+		// size and codec
+		if err := f.sendCompressedUploadRequest(f.remoteName(fileName), uploadSize, c); err != nil {
+			return err
+		}
+	} else if err := f.sendUploadRequest(f.remoteName(fileName), uploadSize); err != nil {
+		return err
 	}
 
-	// Send file size
-	if err := binary.Write(f.conn, binary.LittleEndian, fileInfo.Size()); err != nil {
-		return fmt.Errorf("error sending file size: %v", err)
+	// Wait for the server to accept the upload before sending content
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(f.conn, status); err != nil {
+		return fmt.Errorf("error reading upload status: %v", err)
 	}
-
-	// Send file content
-	buf := make([]byte, bufferSize)
-	bytesSent := int64(0)
-	for {
-		n, err := file.Read(buf)
-		if err == io.EOF {
-			break
-		}
+	if status[0] != statusOK {
+		errMsg, err := readString(f.conn)
 		if err != nil {
-			return fmt.Errorf("error reading file: %v", err)
+			return fmt.Errorf("error reading error message: %v", err)
 		}
+		return uploadError(status[0], errMsg)
+	}
 
-		if _, err := f.conn.Write(buf[:n]); err != nil {
-			return fmt.Errorf("error sending file content: %v", err)
+	// Send file content
+	var dst io.Writer = f.conn
+	var wire *countingWriter
+	var frames *frameWriter
+	var encoder io.WriteCloser
+	if c != nil {
+		wire = &countingWriter{w: f.conn}
+		frames = newFrameWriter(wire)
+		if encoder, err = c.newWriter(frames); err != nil {
+			return fmt.Errorf("error compressing file: %v", err)
 		}
-		bytesSent += int64(n)
-
+		dst = encoder
+	}
+	var sealer *e2eWriter
+	if f.keys != nil {
+		if sealer, err = f.keys.newWriter(f.conn); err != nil {
+			return fmt.Errorf("error encrypting file: %v", err)
+		}
+		dst = sealer
+	}
+	bytesSent, err := f.copyContent(dst, file, fileInfo.Size(), func(sent int64) {
 		// Show progress
-		progress := float64(bytesSent) / float64(fileInfo.Size()) * 100
+		progress := float64(sent) / float64(fileInfo.Size()) * 100
 		fmt.Printf("\rProgress: %.1f%%", progress)
-	}
+	})
 	fmt.Println()
+	if err != nil {
+		return fmt.Errorf("error sending file content: %v", err)
+	}
+	if sealer != nil {
+		if err := sealer.Close(); err != nil {
+			return fmt.Errorf("error sending file content: %v", err)
+		}
+	}
+	if encoder != nil {
+		if err := encoder.Close(); err != nil {
+			return fmt.Errorf("error sending file content: %v", err)
+		}
+		if err := frames.Close(); err != nil {
+			return fmt.Errorf("error sending file content: %v", err)
+		}
+	}
 
 	// After sending all file content, flush the connection
 	if flusher, ok := f.conn.(interface{ Flush() error }); ok {
@@ -227,86 +407,304 @@ func (f *FileOperation) uploadFile(filePath string) error {
 		return fmt.Errorf("unexpected server response: %s", response)
 	}
 
-	fmt.Printf("Successfully sent %s (%d bytes)\n", fileName, bytesSent)
+	if c != nil {
+		fmt.Printf("Successfully sent %s (%d bytes, %d on the wire with %s)\n", fileName, bytesSent, wire.n, c.name)
+	} else {
+		fmt.Printf("Successfully sent %s (%d bytes)\n", fileName, bytesSent)
+	}
 	return nil
 }
 
-func (f *FileOperation) downloadFile(fileName string) error {
-	f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
-	defer f.conn.SetDeadline(time.Time{})
-
-	if _, err := f.conn.Write([]byte{2}); err != nil {
+func (f *FileOperation) sendUploadRequest(fileName string, fileSize int64) error {
+	// Send operation type with explicit write
+	if _, err := f.conn.Write([]byte{1}); err != nil {
 		return fmt.Errorf("error sending operation type: %v", err)
 	}
 
+	// Small delay to ensure operation type is received
 	time.Sleep(100 * time.Millisecond)
 
 	fileNameBytes := []byte(fileName)
 	fileNameLen := int32(len(fileNameBytes))
 
+	// Send file name length
 	if err := binary.Write(f.conn, binary.LittleEndian, fileNameLen); err != nil {
 		return fmt.Errorf("error sending filename length: %v", err)
 	}
 
+	// Send file name
 	if _, err := f.conn.Write(fileNameBytes); err != nil {
 		return fmt.Errorf("error sending filename: %v", err)
 	}
 
-	var fileSize int64
-	if err := binary.Read(f.conn, binary.LittleEndian, &fileSize); err != nil {
-		return fmt.Errorf("error reading file size: %v", err)
+	// Send file size
+	if err := binary.Write(f.conn, binary.LittleEndian, fileSize); err != nil {
+		return fmt.Errorf("error sending file size: %v", err)
 	}
+	return nil
+}
 
-	// Check if server reported an error (fileSize == 0)
-	if fileSize == 0 {
-		var errMsgLen int32
-		if err := binary.Read(f.conn, binary.LittleEndian, &errMsgLen); err != nil {
-			return fmt.Errorf("error reading error message length: %v", err)
-		}
+// sendCompressedUploadRequest starts an upload whose content is compressed
+// with c, or sent as it is if c is nil.
+func (f *FileOperation) sendCompressedUploadRequest(fileName string, fileSize int64, c *codec) error {
+	codecName := ""
+	if c != nil {
+		codecName = c.name
+	}
+	if _, err := f.conn.Write([]byte{20}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, fileName); err != nil {
+		return fmt.Errorf("error sending filename: %v", err)
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, fileSize); err != nil {
+		return fmt.Errorf("error sending file size: %v", err)
+	}
+	if err := writeString(f.conn, codecName); err != nil {
+		return fmt.Errorf("error sending codec: %v", err)
+	}
+	return nil
+}
 
-		errMsgBytes := make([]byte, errMsgLen)
-		if _, err := io.ReadFull(f.conn, errMsgBytes); err != nil {
-			return fmt.Errorf("error reading error message: %v", err)
+// uploadError describes an upload the server refused.
+func uploadError(status byte, errMsg string) error {
+	switch status {
+	case statusQuotaExceeded:
+		return fmt.Errorf("QUOTA_EXCEEDED: %s", errMsg)
+	case statusDiskFull, statusReadOnly:
+		return fmt.Errorf("server storage unavailable: %s", errMsg)
+	}
+	return fmt.Errorf("server refused upload: %s", errMsg)
+}
+
+func (f *FileOperation) downloadFile(fileName string) error {
+	f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	if streams > 1 && f.capabilities["ranges"] && f.keys == nil {
+		if d, err := f.requestFileDetails(fileName); err == nil && f.parallel(d.size) {
+			return f.parallelDownload(fileName, d.size)
 		}
+	}
 
-		return fmt.Errorf("server error: %s", string(errMsgBytes))
+	dl, err := f.openDownload(fileName)
+	if err != nil {
+		return err
 	}
 
 	downloadPath := filepath.Join("Downloads", fileName)
 	if err := os.MkdirAll("Downloads", os.ModePerm); err != nil {
+		dl.discard()
 		return fmt.Errorf("error creating Downloads directory: %v", err)
 	}
 	file, err := os.Create(downloadPath)
 	if err != nil {
+		dl.discard()
 		return fmt.Errorf("error creating file: %v", err)
 	}
 	defer file.Close()
 
-	buf := make([]byte, bufferSize)
-	bytesReceived := int64(0)
-	for bytesReceived < fileSize {
-		n, err := f.conn.Read(buf)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("error reading file content: %v", err)
+	bytesReceived, err := f.receiveContent(file, dl.content, dl.size)
+	if finishErr := dl.finish(); err == nil {
+		err = finishErr
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(downloadPath)
+		return fmt.Errorf("error reading file content: %v", err)
+	}
+
+	if dl.codec != nil {
+		fmt.Printf("Successfully received %s (%d bytes, %d on the wire with %s)\n",
+			fileName, bytesReceived, dl.wire.n, dl.codec.name)
+	} else {
+		fmt.Printf("Successfully received %s (%d bytes)\n", fileName, bytesReceived)
+	}
+	return nil
+}
+
+// download is the content of a file being received from the server.
+type download struct {
+	content io.Reader
+	size    int64
+	// Set when the server compressed the content
+	codec   *codec
+	wire    *countingReader
+	frames  *frameReader
+	decoder io.ReadCloser
+}
+
+// finish reads what is left of the download, so the next request starts
+// in the right place.
+func (d *download) finish() error {
+	if d.frames == nil {
+		return nil
+	}
+	d.decoder.Close()
+	_, err := io.Copy(io.Discard, d.frames)
+	return err
+}
+
+// discard skips the content of a download that cannot be saved.
+func (d *download) discard() {
+	io.CopyN(io.Discard, d.content, d.size)
+	d.finish()
+}
+
+// openDownload requests fileName, compressed if the server agreed to
+// compression, and returns its content.
+func (f *FileOperation) openDownload(fileName string) (*download, error) {
+	if f.codec == nil {
+		fileSize, err := f.requestDownload(fileName)
+		if err != nil {
+			return nil, err
 		}
+		return &download{content: f.conn, size: fileSize}, nil
+	}
 
-		if n > 0 {
-			if _, err := file.Write(buf[:n]); err != nil {
-				return fmt.Errorf("error writing to file: %v", err)
-			}
-			bytesReceived += int64(n)
+	// Send operation type (21 for compressed download)
+	if _, err := f.conn.Write([]byte{21}); err != nil {
+		return nil, fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, f.remoteName(fileName)); err != nil {
+		return nil, fmt.Errorf("error sending filename: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return nil, fmt.Errorf("server error: %s", msg)
+	}
+	dl := &download{}
+	if err := binary.Read(f.conn, binary.LittleEndian, &dl.size); err != nil {
+		return nil, fmt.Errorf("error reading file size: %v", err)
+	}
+	codecName, err := readString(f.conn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading codec: %v", err)
+	}
+	if codecName == "" {
+		dl.content = f.conn
+		return dl, nil
+	}
+	if dl.codec = findCodec(codecName); dl.codec == nil {
+		return nil, fmt.Errorf("server used unknown codec %q", codecName)
+	}
+	dl.wire = &countingReader{r: f.conn}
+	dl.frames = &frameReader{r: dl.wire}
+	if dl.decoder, err = dl.codec.newReader(dl.frames); err != nil {
+		return nil, fmt.Errorf("error decompressing file: %v", err)
+	}
+	dl.content = dl.decoder
+	return dl, nil
+}
+
+// requestDownload asks the server for fileName and returns the size of the
+// content that follows.
+func (f *FileOperation) requestDownload(fileName string) (int64, error) {
+	if _, err := f.conn.Write([]byte{2}); err != nil {
+		return 0, fmt.Errorf("error sending operation type: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	fileNameBytes := []byte(f.remoteName(fileName))
+	fileNameLen := int32(len(fileNameBytes))
+
+	if err := binary.Write(f.conn, binary.LittleEndian, fileNameLen); err != nil {
+		return 0, fmt.Errorf("error sending filename length: %v", err)
+	}
+
+	if _, err := f.conn.Write(fileNameBytes); err != nil {
+		return 0, fmt.Errorf("error sending filename: %v", err)
+	}
+
+	var fileSize int64
+	if err := binary.Read(f.conn, binary.LittleEndian, &fileSize); err != nil {
+		return 0, fmt.Errorf("error reading file size: %v", err)
+	}
+
+	// Check if server reported an error (fileSize == 0)
+	if fileSize == 0 {
+		var errMsgLen int32
+		if err := binary.Read(f.conn, binary.LittleEndian, &errMsgLen); err != nil {
+			return 0, fmt.Errorf("error reading error message length: %v", err)
 		}
 
-		if err == io.EOF {
-			break
+		errMsgBytes := make([]byte, errMsgLen)
+		if _, err := io.ReadFull(f.conn, errMsgBytes); err != nil {
+			return 0, fmt.Errorf("error reading error message: %v", err)
+		}
+
+		return 0, fmt.Errorf("server error: %s", string(errMsgBytes))
+	}
+	return fileSize, nil
+}
+
+// View modes understood by the server
+const (
+	viewHead  byte = 0
+	viewTail  byte = 1
+	viewLines byte = 2
+	viewHex   byte = 3
+)
+
+// promptViewOptions asks for the view mode and its range. Empty answers keep
+// the server defaults.
+func promptViewOptions(reader *bufio.Reader) (byte, int64, int64, bool) {
+	fmt.Print("View mode [head/tail/lines/hex] (default head): ")
+	modeStr, _ := reader.ReadString('\n')
+
+	var mode byte
+	offsetPrompt, lengthPrompt := "Start offset in bytes (default 0): ", "Number of bytes (default server limit): "
+	switch strings.ToLower(strings.TrimSpace(modeStr)) {
+	case "", "head":
+		mode = viewHead
+	case "tail":
+		mode, offsetPrompt = viewTail, ""
+	case "lines":
+		mode = viewLines
+		offsetPrompt, lengthPrompt = "First line (default 1): ", "Number of lines (default 20): "
+	case "hex":
+		mode = viewHex
+	default:
+		return 0, 0, 0, false
+	}
+
+	readNumber := func(prompt string) (int64, bool) {
+		if prompt == "" {
+			return 0, true
+		}
+		fmt.Print(prompt)
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if input == "" {
+			return 0, true
 		}
+		n, err := strconv.ParseInt(input, 10, 64)
+		return n, err == nil && n >= 0
 	}
 
-	fmt.Printf("Successfully received %s (%d bytes)\n", fileName, bytesReceived)
-	return nil
+	offset, ok := readNumber(offsetPrompt)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	length, ok := readNumber(lengthPrompt)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return mode, offset, length, true
 }
 
-func (f *FileOperation) viewFile(fileName string) {
+func (f *FileOperation) viewFile(fileName string, mode byte, offset, length int64) {
+	if f.keys != nil {
+		f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		defer f.conn.SetDeadline(time.Time{})
+		f.viewDecrypted(fileName, mode, offset, length)
+		return
+	}
+
 	//Create temp directory
 	tempDir, err := os.MkdirTemp("", "file-view-*")
 	if err != nil {
@@ -324,33 +722,70 @@ func (f *FileOperation) viewFile(fileName string) {
 		return
 	}
 
-	fileNameLen := int32(len(fileName))
-	if err := binary.Write(f.conn, binary.LittleEndian, fileNameLen); err != nil {
-		fmt.Printf("Error sending filename length: %v\n", err)
+	if err := writeString(f.conn, fileName); err != nil {
+		fmt.Printf("Error sending filename: %v\n", err)
 		return
 	}
 
-	if _, err := f.conn.Write([]byte(fileName)); err != nil {
-		fmt.Printf("Error sending filename: %v\n", err)
+	// Send mode, offset and length
+	if _, err := f.conn.Write([]byte{mode}); err != nil {
+		fmt.Printf("Error sending view mode: %v\n", err)
+		return
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, offset); err != nil {
+		fmt.Printf("Error sending view offset: %v\n", err)
+		return
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, length); err != nil {
+		fmt.Printf("Error sending view length: %v\n", err)
 		return
 	}
 
 	status := make([]byte, 1)
-	if _, err := f.conn.Read(status); err != nil {
+	if _, err := io.ReadFull(f.conn, status); err != nil {
 		fmt.Printf("Error reading status: %v\n", err)
 		return
 	}
 
 	if status[0] == 0 {
-		fmt.Println("File not found or error occurred")
+		errMsg, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading error message: %v\n", err)
+			return
+		}
+		fmt.Printf("View failed: %s\n", errMsg)
 		return
 	}
 
-	var fileSize int64
+	var fileSize, rangeStart, rangeLen int64
 	if err := binary.Read(f.conn, binary.LittleEndian, &fileSize); err != nil {
 		fmt.Printf("Error reading file size: %v\n", err)
 		return
 	}
+	if err := binary.Read(f.conn, binary.LittleEndian, &rangeStart); err != nil {
+		fmt.Printf("Error reading range offset: %v\n", err)
+		return
+	}
+	if err := binary.Read(f.conn, binary.LittleEndian, &rangeLen); err != nil {
+		fmt.Printf("Error reading range length: %v\n", err)
+		return
+	}
+	encoding, err := readString(f.conn)
+	if err != nil {
+		fmt.Printf("Error reading encoding: %v\n", err)
+		return
+	}
+
+	var contentLen int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &contentLen); err != nil {
+		fmt.Printf("Error reading content length: %v\n", err)
+		return
+	}
+	content := make([]byte, contentLen)
+	if _, err := io.ReadFull(f.conn, content); err != nil {
+		fmt.Printf("\nError receiving file content: %v\n", err)
+		return
+	}
 
 	// Create temporary file
 	tempFile := filepath.Join(tempDir, fileName)
@@ -361,26 +796,21 @@ func (f *FileOperation) viewFile(fileName string) {
 	}
 	defer file.Close()
 
-	// Read and save file content
-	buf := make([]byte, 1024)
 	fmt.Println("\nFile content:")
 	fmt.Println(strings.Repeat("-", 80))
 
-	n, err := f.conn.Read(buf)
-	if err != nil && err != io.EOF {
-		fmt.Printf("\nError receiving file content: %v\n", err)
-		return
-	}
-
-	fmt.Print(string(buf[:n])) //Writing to console
+	fmt.Print(string(content)) //Writing to console
 	//Writing to temp directory
-	if _, err := file.Write(buf[:n]); err != nil {
+	if _, err := file.Write(content); err != nil {
 		fmt.Printf("\nError writing to temporary file: %v\n", err)
 		return
 	}
 
 	fmt.Println("\n" + strings.Repeat("-", 80))
-	fmt.Printf("\nReceived 1024 bytes\n")
+	if encoding == "binary" {
+		fmt.Println("File looks binary; showing a hex dump.")
+	}
+	fmt.Printf("\nShowing bytes %d-%d of %d (%s)\n", rangeStart, rangeStart+rangeLen, fileSize, encoding)
 }
 
 func (f *FileOperation) deleteFile(fileName string) {
@@ -395,7 +825,7 @@ func (f *FileOperation) deleteFile(fileName string) {
 	}
 
 	// Send filename length and filename
-	fileNameBytes := []byte(fileName)
+	fileNameBytes := []byte(f.remoteName(fileName))
 	fileNameLen := int32(len(fileNameBytes))
 
 	if err := binary.Write(f.conn, binary.LittleEndian, fileNameLen); err != nil {
@@ -416,7 +846,9 @@ func (f *FileOperation) deleteFile(fileName string) {
 	}
 
 	if status[0] == 1 {
-		fmt.Printf("File '%s' deleted successfully.\n", fileName)
+		fmt.Printf("File '%s' moved to the trash.\n", fileName)
+	} else if status[0] == statusReadOnly {
+		fmt.Printf("Failed to delete file '%s': the server is read-only because disk space is critically low.\n", fileName)
 	} else {
 		fmt.Printf("Failed to delete file '%s'. File may not exist or an error occurred.\n", fileName)
 	}
@@ -469,7 +901,7 @@ func (f *FileOperation) listFiles() {
 			fmt.Printf("Error reading filename: %v\n", err)
 			return
 		}
-		fileName := string(fileNameBytes)
+		fileName, encrypted := f.displayName(string(fileNameBytes))
 
 		// Read file size
 		var fileSize int64
@@ -486,14 +918,7 @@ func (f *FileOperation) listFiles() {
 		}
 
 		// Format the size
-		var sizeStr string
-		if fileSize < 1024 {
-			sizeStr = fmt.Sprintf("%d B", fileSize)
-		} else if fileSize < 1024*1024 {
-			sizeStr = fmt.Sprintf("%.1f KB", float64(fileSize)/1024)
-		} else {
-			sizeStr = fmt.Sprintf("%.1f MB", float64(fileSize)/(1024*1024))
-		}
+		sizeStr := formatSize(f.displaySize(fileSize, encrypted))
 
 		// Format the time
 		timeStr := time.Unix(modTime, 0).Format("2006-01-02 15:04:05")
@@ -522,3 +947,16 @@ func (f *FileOperation) listFiles() {
 	}
 	f.conn.SetReadDeadline(time.Time{})
 }
+
+func formatSize(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1024*1024*1024))
+	}
+}
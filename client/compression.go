@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Compressed content travels in frames: a uint32 length followed by that
+// many bytes, ended by an empty frame.
+const (
+	maxFrameSize = 64 << 10
+	// Files smaller than this are sent as they are
+	compressMinSize = 1 << 10
+	// A sample that compresses to more than this fraction of its size is
+	// not worth compressing
+	compressibleRatio = 0.9
+)
+
+// codec is a compression format the client can use.
+type codec struct {
+	name      string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs lists the supported formats, most preferred first.
+var codecs = []codec{
+	{
+		name:      "gzip",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	{
+		name:      "zlib",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) },
+	},
+	{
+		name:      "deflate",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+	},
+}
+
+func findCodec(name string) *codec {
+	for i := range codecs {
+		if codecs[i].name == name {
+			return &codecs[i]
+		}
+	}
+	return nil
+}
+
+// negotiateCapabilities tells the server which optional features the
+// client supports and records those the server agrees to.
+func (f *FileOperation) negotiateCapabilities() error {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	var offered []string
+	for _, c := range codecs {
+		offered = append(offered, "compress:"+c.name)
+	}
+	offered = append(offered, "ranges", "heartbeat")
+
+	// Send operation type (19 for the capability handshake)
+	if _, err := f.conn.Write([]byte{19}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, int32(len(offered))); err != nil {
+		return fmt.Errorf("error sending capabilities: %v", err)
+	}
+	for _, capability := range offered {
+		if err := writeString(f.conn, capability); err != nil {
+			return fmt.Errorf("error sending capabilities: %v", err)
+		}
+	}
+
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return fmt.Errorf("server error: %s", msg)
+	}
+	var count int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &count); err != nil {
+		return fmt.Errorf("error reading capabilities: %v", err)
+	}
+	f.capabilities = make(map[string]bool)
+	for i := int32(0); i < count; i++ {
+		capability, err := readString(f.conn)
+		if err != nil {
+			return fmt.Errorf("error reading capabilities: %v", err)
+		}
+		f.capabilities[capability] = true
+		if name, ok := strings.CutPrefix(capability, "compress:"); ok && f.codec == nil {
+			f.codec = findCodec(name)
+		}
+	}
+	return nil
+}
+
+// compressedExtensions are formats that are already compressed.
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zip": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true,
+	".7z": true, ".rar": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".ogg": true, ".flac": true,
+	".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true, ".jar": true, ".apk": true,
+}
+
+// uploadCodec returns the codec to upload a file with, or nil if it should
+// be sent as it is.
+func (f *FileOperation) uploadCodec(filePath string, file io.ReaderAt, size int64) *codec {
+	// Encrypted content does not compress
+	if f.codec == nil || f.keys != nil || size < compressMinSize {
+		return nil
+	}
+	if compressedExtensions[strings.ToLower(filepath.Ext(filePath))] {
+		return nil
+	}
+	sample := make([]byte, maxFrameSize)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	var out bytes.Buffer
+	w, _ := flate.NewWriter(&out, flate.BestSpeed)
+	w.Write(sample[:n])
+	w.Close()
+	if float64(out.Len()) >= float64(n)*compressibleRatio {
+		return nil
+	}
+	return f.codec
+}
+
+// frameWriter splits what is written to it into frames.
+type frameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{w: w, buf: make([]byte, 0, maxFrameSize)}
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(fw.buf[len(fw.buf):maxFrameSize], p)
+		fw.buf = fw.buf[:len(fw.buf)+n]
+		p = p[n:]
+		written += n
+		if len(fw.buf) == maxFrameSize {
+			if err := fw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (fw *frameWriter) flush() error {
+	if len(fw.buf) == 0 {
+		return nil
+	}
+	if err := binary.Write(fw.w, binary.LittleEndian, uint32(len(fw.buf))); err != nil {
+		return err
+	}
+	_, err := fw.w.Write(fw.buf)
+	fw.buf = fw.buf[:0]
+	return err
+}
+
+// Close sends what is buffered and the empty frame that ends the content.
+func (fw *frameWriter) Close() error {
+	if err := fw.flush(); err != nil {
+		return err
+	}
+	return binary.Write(fw.w, binary.LittleEndian, uint32(0))
+}
+
+// frameReader returns the data of the frames read from r, up to the empty
+// frame that ends them.
+type frameReader struct {
+	r    io.Reader
+	left uint32
+	done bool
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for fr.left == 0 {
+		if fr.done {
+			return 0, io.EOF
+		}
+		if err := binary.Read(fr.r, binary.LittleEndian, &fr.left); err != nil {
+			return 0, err
+		}
+		if fr.left > maxFrameSize {
+			return 0, fmt.Errorf("frame of %d bytes is too large", fr.left)
+		}
+		fr.done = fr.left == 0
+	}
+	if uint32(len(p)) > fr.left {
+		p = p[:fr.left]
+	}
+	n, err := fr.r.Read(p)
+	fr.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// countingReader and countingWriter count the bytes that pass through
+// them, to report how much went over the wire.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dedupMinSize is the smallest file sent as a chunk list; below it the
+// extra round trip costs more than skipping chunks saves.
+const dedupMinSize = 1 << 20
+
+type fileChunk struct {
+	hash   [sha256.Size]byte
+	offset int64
+	size   int32
+}
+
+// dedupUpload offers file to the server as a list of chunk hashes and sends
+// only the chunks the server asks for. It reports false if the server does
+// not accept deduplicated uploads, so the caller can fall back to a plain
+// upload.
+func (f *FileOperation) dedupUpload(file *os.File, info os.FileInfo) (bool, error) {
+	fmt.Println("Computing chunk hashes...")
+	var chunks []fileChunk
+	var offset int64
+	c := newChunker(file)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("error reading file: %v", err)
+		}
+		chunks = append(chunks, fileChunk{hash: sha256.Sum256(data), offset: offset, size: int32(len(data))})
+		offset += int64(len(data))
+	}
+
+	f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (17 for deduplicated upload), the file and its
+	// chunk list
+	if _, err := f.conn.Write([]byte{17}); err != nil {
+		return false, fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, filepath.Base(file.Name())); err != nil {
+		return false, fmt.Errorf("error sending filename: %v", err)
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, info.Size()); err != nil {
+		return false, fmt.Errorf("error sending file size: %v", err)
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, int32(len(chunks))); err != nil {
+		return false, fmt.Errorf("error sending chunk count: %v", err)
+	}
+	for _, chunk := range chunks {
+		if _, err := f.conn.Write(chunk.hash[:]); err != nil {
+			return false, fmt.Errorf("error sending chunk list: %v", err)
+		}
+		if err := binary.Write(f.conn, binary.LittleEndian, chunk.size); err != nil {
+			return false, fmt.Errorf("error sending chunk list: %v", err)
+		}
+	}
+
+	status, errMsg, err := readStatus(f.conn)
+	if err != nil {
+		return false, fmt.Errorf("error reading upload status: %v", err)
+	}
+	if status == statusUnsupported {
+		return false, nil
+	}
+	if status != statusOK {
+		return true, uploadError(status, errMsg)
+	}
+
+	var count int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &count); err != nil {
+		return true, fmt.Errorf("error reading missing chunk count: %v", err)
+	}
+	missing := make([]int32, count)
+	if err := binary.Read(f.conn, binary.LittleEndian, missing); err != nil {
+		return true, fmt.Errorf("error reading missing chunks: %v", err)
+	}
+
+	var bytesSent int64
+	buf := make([]byte, maxChunkSize)
+	for i, index := range missing {
+		if index < 0 || int(index) >= len(chunks) {
+			return true, fmt.Errorf("server asked for unknown chunk %d", index)
+		}
+		chunk := chunks[index]
+		data := buf[:chunk.size]
+		if _, err := file.ReadAt(data, chunk.offset); err != nil {
+			return true, fmt.Errorf("error reading file: %v", err)
+		}
+		f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		if _, err := f.conn.Write(data); err != nil {
+			return true, fmt.Errorf("error sending chunk: %v", err)
+		}
+		bytesSent += int64(chunk.size)
+		fmt.Printf("\rProgress: %.1f%%", float64(i+1)/float64(len(missing))*100)
+	}
+	if len(missing) > 0 {
+		fmt.Println()
+	}
+
+	status, errMsg, err = readStatus(f.conn)
+	if err != nil {
+		return true, fmt.Errorf("error reading server response: %v", err)
+	}
+	if status != statusOK {
+		return true, fmt.Errorf("server error: %s", errMsg)
+	}
+	fmt.Printf("Successfully sent %s (%d bytes, %d of %d chunks; %s already on the server)\n",
+		filepath.Base(file.Name()), bytesSent, len(missing), len(chunks), formatSize(info.Size()-bytesSent))
+	return true, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Instructions in a delta upload stream.
+const (
+	deltaEnd     byte = 0
+	deltaCopy    byte = 1
+	deltaLiteral byte = 2
+	// Literal data compressed with an agreed codec
+	deltaCompressedLiteral byte = 3
+)
+
+const (
+	maxDeltaLiteral = 1 << 20
+	deltaStrongSize = 16
+)
+
+type blockSignature struct {
+	index  int32
+	strong [deltaStrongSize]byte
+}
+
+// deltaWriter buffers delta instructions, merging copies of consecutive
+// blocks and literal data into as few instructions as possible.
+type deltaWriter struct {
+	w          *bufio.Writer
+	codec      *codec
+	literal    []byte
+	compressed bytes.Buffer
+	copyFirst  int32
+	copyCount  int32
+	bytesSent  int64
+	bytesSaved int64
+}
+
+func (d *deltaWriter) addLiteral(b byte) error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.literal = append(d.literal, b)
+	if len(d.literal) >= maxDeltaLiteral {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *deltaWriter) addCopy(index int32, blockSize int) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	d.bytesSaved += int64(blockSize)
+	if d.copyCount > 0 && d.copyFirst+d.copyCount == index {
+		d.copyCount++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.copyFirst, d.copyCount = index, 1
+	return nil
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+	if d.codec != nil && d.compressLiteral() {
+		d.w.WriteByte(deltaCompressedLiteral)
+		writeString(d.w, d.codec.name)
+		binary.Write(d.w, binary.LittleEndian, int32(len(d.literal)))
+		binary.Write(d.w, binary.LittleEndian, int32(d.compressed.Len()))
+		_, err := d.w.Write(d.compressed.Bytes())
+		d.bytesSent += int64(d.compressed.Len())
+		d.literal = d.literal[:0]
+		return err
+	}
+	d.w.WriteByte(deltaLiteral)
+	binary.Write(d.w, binary.LittleEndian, int32(len(d.literal)))
+	_, err := d.w.Write(d.literal)
+	d.bytesSent += int64(len(d.literal))
+	d.literal = d.literal[:0]
+	return err
+}
+
+// compressLiteral compresses the pending literal and reports whether that
+// made it worth sending compressed.
+func (d *deltaWriter) compressLiteral() bool {
+	if len(d.literal) < compressMinSize {
+		return false
+	}
+	d.compressed.Reset()
+	encoder, err := d.codec.newWriter(&d.compressed)
+	if err != nil {
+		return false
+	}
+	encoder.Write(d.literal)
+	if encoder.Close() != nil {
+		return false
+	}
+	return float64(d.compressed.Len()) < float64(len(d.literal))*compressibleRatio
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+	d.w.WriteByte(deltaCopy)
+	binary.Write(d.w, binary.LittleEndian, d.copyFirst)
+	err := binary.Write(d.w, binary.LittleEndian, d.copyCount)
+	d.copyCount = 0
+	return err
+}
+
+// deltaUpload sends file as changes against the server's current copy: the
+// server sends checksums of its blocks, and the client sends copy
+// instructions for blocks it finds in the file and literal data for the rest.
+func (f *FileOperation) deltaUpload(file *os.File, info os.FileInfo) error {
+	f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (18 for delta upload)
+	if _, err := f.conn.Write([]byte{18}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, filepath.Base(file.Name())); err != nil {
+		return fmt.Errorf("error sending filename: %v", err)
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, info.Size()); err != nil {
+		return fmt.Errorf("error sending file size: %v", err)
+	}
+
+	status, errMsg, err := readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading upload status: %v", err)
+	}
+	if status != statusOK {
+		return uploadError(status, errMsg)
+	}
+
+	var blockSize, blockCount int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &blockSize); err != nil {
+		return fmt.Errorf("error reading block size: %v", err)
+	}
+	if err := binary.Read(f.conn, binary.LittleEndian, &blockCount); err != nil {
+		return fmt.Errorf("error reading block count: %v", err)
+	}
+	if blockSize <= 0 || blockCount < 0 {
+		return fmt.Errorf("invalid block signatures from server")
+	}
+	signatures := make(map[uint32][]blockSignature, blockCount)
+	for i := int32(0); i < blockCount; i++ {
+		var weak uint32
+		var sig blockSignature
+		if err := binary.Read(f.conn, binary.LittleEndian, &weak); err != nil {
+			return fmt.Errorf("error reading block signatures: %v", err)
+		}
+		if _, err := io.ReadFull(f.conn, sig.strong[:]); err != nil {
+			return fmt.Errorf("error reading block signatures: %v", err)
+		}
+		sig.index = i
+		signatures[weak] = append(signatures[weak], sig)
+	}
+
+	d := &deltaWriter{w: bufio.NewWriterSize(f.conn, 64<<10), codec: f.codec}
+	fileHash, err := encodeDelta(file, info.Size(), int(blockSize), signatures, d, func() {
+		f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	})
+	if err != nil {
+		return err
+	}
+	d.w.WriteByte(deltaEnd)
+	d.w.Write(fileHash)
+	if err := d.w.Flush(); err != nil {
+		return fmt.Errorf("error sending delta: %v", err)
+	}
+
+	status, errMsg, err = readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading server response: %v", err)
+	}
+	if status != statusOK {
+		return fmt.Errorf("server error: %s", errMsg)
+	}
+	fmt.Printf("Successfully sent %s (%d bytes; %s reused from the server's copy)\n",
+		filepath.Base(file.Name()), d.bytesSent, formatSize(d.bytesSaved))
+	return nil
+}
+
+// encodeDelta scans r with a rolling checksum, writing copy instructions for
+// blocks that match a signature and literals for everything else. It returns
+// the SHA-256 of the whole input. progress is called as the scan advances.
+func encodeDelta(r io.Reader, size int64, blockSize int, signatures map[uint32][]blockSignature, d *deltaWriter, progress func()) ([]byte, error) {
+	hasher := sha256.New()
+	src := io.TeeReader(r, hasher)
+	buf := make([]byte, 0, 8<<20)
+	eof := false
+	// fill keeps at least a full window buffered after pos, shifting out
+	// bytes that have already been encoded
+	fill := func(pos int) (int, error) {
+		if eof || len(buf)-pos >= blockSize {
+			return pos, nil
+		}
+		buf = append(buf[:0], buf[pos:]...)
+		for !eof && len(buf) < cap(buf) {
+			n, err := src.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return 0, fmt.Errorf("error reading file: %v", err)
+			}
+		}
+		progress()
+		return 0, nil
+	}
+
+	var scanned int64
+	pos, err := fill(0)
+	if err != nil {
+		return nil, err
+	}
+	var a, b uint32
+	rolling := false
+	for len(buf)-pos >= blockSize {
+		window := buf[pos : pos+blockSize]
+		if !rolling {
+			a, b = 0, 0
+			for i, c := range window {
+				a += uint32(c)
+				b += uint32(blockSize-i) * uint32(c)
+			}
+			rolling = true
+		}
+
+		if index, ok := matchBlock(window, a&0xFFFF|b<<16, signatures); ok {
+			if err := d.addCopy(index, blockSize); err != nil {
+				return nil, fmt.Errorf("error sending delta: %v", err)
+			}
+			pos += blockSize
+			scanned += int64(blockSize)
+			rolling = false
+		} else {
+			// Slide the window one byte
+			out := uint32(buf[pos])
+			if err := d.addLiteral(buf[pos]); err != nil {
+				return nil, fmt.Errorf("error sending delta: %v", err)
+			}
+			pos++
+			scanned++
+			if len(buf)-pos >= blockSize {
+				in := uint32(buf[pos+blockSize-1])
+				a = a - out + in
+				b = b - uint32(blockSize)*out + a
+			} else {
+				// Recomputed once more data is buffered
+				rolling = false
+			}
+		}
+
+		if len(buf)-pos < blockSize {
+			if pos, err = fill(pos); err != nil {
+				return nil, err
+			}
+			if size > 0 {
+				fmt.Printf("\rProgress: %.1f%%", float64(scanned)/float64(size)*100)
+			}
+		}
+	}
+	for _, c := range buf[pos:] {
+		if err := d.addLiteral(c); err != nil {
+			return nil, fmt.Errorf("error sending delta: %v", err)
+		}
+	}
+	if err := d.flushLiteral(); err != nil {
+		return nil, fmt.Errorf("error sending delta: %v", err)
+	}
+	if err := d.flushCopy(); err != nil {
+		return nil, fmt.Errorf("error sending delta: %v", err)
+	}
+	if size > 0 {
+		fmt.Printf("\rProgress: 100.0%%\n")
+	}
+	return hasher.Sum(nil), nil
+}
+
+func matchBlock(window []byte, weak uint32, signatures map[uint32][]blockSignature) (int32, bool) {
+	candidates := signatures[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := sha256.Sum256(window)
+	for _, sig := range candidates {
+		if bytes.Equal(sig.strong[:], strong[:deltaStrongSize]) {
+			return sig.index, true
+		}
+	}
+	return 0, false
+}
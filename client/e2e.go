@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// End-to-end encrypted files are sealed on the client before upload: the
+// server only ever sees an encrypted name ending in e2eSuffix and content
+// made of a header followed by AES-GCM sealed segments.
+const (
+	e2eMagic       = "DFTPE2E1"
+	e2eSaltSize    = 32
+	e2eHeaderSize  = len(e2eMagic) + e2eSaltSize
+	e2eSegmentSize = 64 << 10
+	e2eTagSize     = 16
+	e2eSuffix      = ".e2e"
+)
+
+// e2eKeys are derived from the user's key file. Losing the file loses the
+// files encrypted with it.
+type e2eKeys struct {
+	nameIVKey  []byte
+	nameKey    []byte
+	contentKey []byte
+}
+
+// loadE2EKey reads a key file holding 64 hex digits.
+func loadE2EKey(path string) (*e2eKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		fmt.Printf("Warning: key file %s is readable by other users\n", path)
+	}
+	master, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(master) != 32 {
+		return nil, fmt.Errorf("%s must hold a 256-bit key as 64 hex digits", path)
+	}
+	return &e2eKeys{
+		nameIVKey:  deriveKey(master, "name-iv"),
+		nameKey:    deriveKey(master, "name"),
+		contentKey: deriveKey(master, "content"),
+	}, nil
+}
+
+// generateE2EKey writes a new random key to path, refusing to replace an
+// existing file.
+func generateE2EKey(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(key)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dftp-e2e " + label))
+	return mac.Sum(nil)
+}
+
+// encryptName encrypts a file name deterministically, so the same name
+// always maps to the same stored name. The IV is a MAC of the name, which
+// also authenticates it on the way back.
+func (k *e2eKeys) encryptName(name string) string {
+	mac := hmac.New(sha256.New, k.nameIVKey)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:aes.BlockSize]
+
+	block, _ := aes.NewCipher(k.nameKey)
+	sealed := make([]byte, aes.BlockSize+len(name))
+	copy(sealed, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(sealed[aes.BlockSize:], []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed) + e2eSuffix
+}
+
+// decryptName returns the name a stored name was encrypted from, or false
+// if it was not encrypted with these keys.
+func (k *e2eKeys) decryptName(stored string) (string, bool) {
+	encoded, ok := strings.CutSuffix(stored, e2eSuffix)
+	if !ok {
+		return "", false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) <= aes.BlockSize {
+		return "", false
+	}
+	iv := sealed[:aes.BlockSize]
+	block, _ := aes.NewCipher(k.nameKey)
+	name := make([]byte, len(sealed)-aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(name, sealed[aes.BlockSize:])
+
+	mac := hmac.New(sha256.New, k.nameIVKey)
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:aes.BlockSize], iv) {
+		return "", false
+	}
+	return string(name), true
+}
+
+// contentAEAD returns the cipher for a file with the given header. Every
+// upload gets a fresh salt and so a key of its own.
+func (k *e2eKeys) contentAEAD(header []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(k.contentKey, string(header[len(e2eMagic):])))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// e2eNonce is the segment's index followed by a flag marking the last
+// segment, so reordered, dropped or truncated segments fail to open.
+func e2eNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealedSize returns the size of size bytes of content once encrypted. An
+// empty file still has one, empty, segment.
+func sealedSize(size int64) int64 {
+	segments := (size + e2eSegmentSize - 1) / e2eSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return int64(e2eHeaderSize) + size + segments*e2eTagSize
+}
+
+// plainSize returns the size of the content of a sealed file of size bytes.
+func plainSize(size int64) int64 {
+	n := size - int64(e2eHeaderSize)
+	if n < e2eTagSize {
+		return 0
+	}
+	segments := (n + e2eSegmentSize + e2eTagSize - 1) / (e2eSegmentSize + e2eTagSize)
+	return n - segments*e2eTagSize
+}
+
+// e2eWriter encrypts what is written to it. Close seals the last segment
+// but does not close the underlying writer.
+type e2eWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	sealed  []byte
+	segment int64
+}
+
+func (k *e2eKeys) newWriter(w io.Writer) (*e2eWriter, error) {
+	header := make([]byte, e2eHeaderSize)
+	copy(header, e2eMagic)
+	if _, err := rand.Read(header[len(e2eMagic):]); err != nil {
+		return nil, err
+	}
+	aead, err := k.contentAEAD(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &e2eWriter{w: w, aead: aead, header: header, buf: make([]byte, 0, e2eSegmentSize)}, nil
+}
+
+func (w *e2eWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is sealed only once more data follows, so the
+		// last segment is never empty unless the whole file is
+		if len(w.buf) == e2eSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):e2eSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *e2eWriter) seal(final bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], e2eNonce(w.segment, final), w.buf, w.header)
+	w.segment++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.sealed)
+	return err
+}
+
+func (w *e2eWriter) Close() error {
+	return w.seal(true)
+}
+
+// e2eReader decrypts a sealed file of a known size read from r.
+type e2eReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	left    int64
+	segment int64
+	sealed  []byte
+	plain   []byte
+}
+
+func (k *e2eKeys) newReader(r io.Reader, size int64) (*e2eReader, error) {
+	if size < int64(e2eHeaderSize)+e2eTagSize {
+		return nil, fmt.Errorf("file is not end-to-end encrypted")
+	}
+	header := make([]byte, e2eHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(e2eMagic)]) != e2eMagic {
+		return nil, fmt.Errorf("file is not end-to-end encrypted")
+	}
+	aead, err := k.contentAEAD(header)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		left:   size - int64(e2eHeaderSize),
+		sealed: make([]byte, e2eSegmentSize+e2eTagSize),
+	}, nil
+}
+
+func (r *e2eReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.left == 0 {
+			return 0, io.EOF
+		}
+		n := int64(len(r.sealed))
+		if r.left < n {
+			n = r.left
+		}
+		if _, err := io.ReadFull(r.r, r.sealed[:n]); err != nil {
+			return 0, err
+		}
+		r.left -= n
+		plain, err := r.aead.Open(r.sealed[:0], e2eNonce(r.segment, r.left == 0), r.sealed[:n], r.header)
+		if err != nil {
+			return 0, fmt.Errorf("decryption failed: wrong key or damaged file")
+		}
+		r.plain = plain
+		r.segment++
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// remoteName is the name the server stores fileName under.
+func (f *FileOperation) remoteName(fileName string) string {
+	if f.keys == nil {
+		return fileName
+	}
+	return f.keys.encryptName(fileName)
+}
+
+// displayName is the name to show for a name received from the server,
+// and whether the file is end-to-end encrypted.
+func (f *FileOperation) displayName(stored string) (string, bool) {
+	if f.keys == nil {
+		return stored, false
+	}
+	if name, ok := f.keys.decryptName(stored); ok {
+		return name, true
+	}
+	return stored, false
+}
+
+// displaySize is the size to show for a file of size bytes on the server.
+func (f *FileOperation) displaySize(size int64, encrypted bool) int64 {
+	if encrypted {
+		return plainSize(size)
+	}
+	return size
+}
+
+// receiveContent writes size bytes of file content read from src to w,
+// decrypting it in end-to-end mode. The whole content is read even if
+// decryption fails, so the session stays usable.
+func (f *FileOperation) receiveContent(w io.Writer, src io.Reader, size int64) (int64, error) {
+	if f.keys == nil {
+		return f.copyContent(w, src, size, nil)
+	}
+	src = io.LimitReader(src, size)
+	defer io.Copy(io.Discard, src)
+	r, err := f.keys.newReader(src, size)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.copyContent(w, r, plainSize(size), nil)
+	if err != nil {
+		return n, err
+	}
+	// Reading on checks that the content ends where its size says
+	if extra, err := r.Read(make([]byte, 1)); extra > 0 || err != io.EOF {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("decrypted content is longer than expected")
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// viewDecrypted downloads fileName and shows the requested part of it,
+// since the server cannot read end-to-end encrypted content. Only the
+// requested part is kept, and the download stops being decrypted once it
+// has been seen.
+func (f *FileOperation) viewDecrypted(fileName string, mode byte, offset, length int64) {
+	var window viewWindow
+	switch mode {
+	case viewHead, viewHex:
+		if length == 0 {
+			length = 1024
+		}
+		window = &rangeWindow{skip: offset, limit: length}
+	case viewTail:
+		if length == 0 {
+			length = 1024
+		}
+		window = &tailWindow{ring: make([]byte, length)}
+	case viewLines:
+		if offset < 1 {
+			offset = 1
+		}
+		if length == 0 {
+			length = 20
+		}
+		window = &lineWindow{first: offset, last: offset + length - 1, line: 1}
+	}
+
+	size, err := f.fetchDecrypted(fileName, window)
+	if err != nil && err != errWindowFull {
+		fmt.Printf("View failed: %v\n", err)
+		return
+	}
+	start, part := window.result()
+
+	fmt.Println("\nFile content:")
+	fmt.Println(strings.Repeat("-", 80))
+	if mode == viewHex {
+		fmt.Print(hex.Dump(part))
+	} else {
+		fmt.Print(string(part))
+	}
+	fmt.Println("\n" + strings.Repeat("-", 80))
+	fmt.Printf("\nShowing bytes %d-%d of %d (decrypted locally)\n", start, start+int64(len(part)), size)
+}
+
+// errWindowFull is returned by a viewWindow that needs no more content.
+var errWindowFull = errors.New("view window is full")
+
+// viewWindow keeps the part of a file being viewed as its content is
+// written to it, and returns errWindowFull once later content cannot
+// change what it keeps.
+type viewWindow interface {
+	io.Writer
+	// result returns the kept content and its offset in the file.
+	result() (int64, []byte)
+}
+
+// rangeWindow keeps up to limit bytes after the first skip.
+type rangeWindow struct {
+	skip, limit int64
+	seen        int64
+	data        []byte
+}
+
+func (w *rangeWindow) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.seen < w.skip {
+		drop := min(int64(len(p)), w.skip-w.seen)
+		w.seen += drop
+		p = p[drop:]
+	}
+	keep := min(int64(len(p)), w.limit-int64(len(w.data)))
+	w.data = append(w.data, p[:keep]...)
+	w.seen += keep
+	if int64(len(w.data)) == w.limit {
+		return n, errWindowFull
+	}
+	return n, nil
+}
+
+func (w *rangeWindow) result() (int64, []byte) {
+	return min(w.skip, w.seen), w.data
+}
+
+// tailWindow keeps the last len(ring) bytes.
+type tailWindow struct {
+	ring  []byte
+	total int64
+}
+
+func (w *tailWindow) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > len(w.ring) {
+		w.total += int64(len(p) - len(w.ring))
+		p = p[len(p)-len(w.ring):]
+	}
+	for len(p) > 0 {
+		copied := copy(w.ring[w.total%int64(len(w.ring)):], p)
+		w.total += int64(copied)
+		p = p[copied:]
+	}
+	return n, nil
+}
+
+func (w *tailWindow) result() (int64, []byte) {
+	size := int64(len(w.ring))
+	if w.total < size {
+		return 0, w.ring[:w.total]
+	}
+	at := w.total % size
+	return w.total - size, append(w.ring[at:], w.ring[:at]...)
+}
+
+// lineWindow keeps lines first to last, counting from 1.
+type lineWindow struct {
+	first, last int64
+	line        int64
+	start       int64
+	data        []byte
+}
+
+func (w *lineWindow) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && w.line <= w.last {
+		end := bytes.IndexByte(p, '\n') + 1
+		if end == 0 {
+			end = len(p)
+		}
+		if w.line < w.first {
+			w.start += int64(end)
+		} else {
+			w.data = append(w.data, p[:end]...)
+		}
+		if p[end-1] == '\n' {
+			w.line++
+		}
+		p = p[end:]
+	}
+	if w.line > w.last {
+		return n, errWindowFull
+	}
+	return n, nil
+}
+
+func (w *lineWindow) result() (int64, []byte) {
+	return w.start, w.data
+}
+
+// fetchDecrypted downloads fileName, writes its decrypted content to w and
+// returns the size of the content. If w stops the download with an error,
+// the rest is read from the connection without being decrypted.
+func (f *FileOperation) fetchDecrypted(fileName string, w io.Writer) (int64, error) {
+	dl, err := f.openDownload(fileName)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	_, err = f.receiveContent(bw, dl.content, dl.size)
+	if finishErr := dl.finish(); err == nil {
+		err = finishErr
+	}
+	if err != nil {
+		return plainSize(dl.size), err
+	}
+	return plainSize(dl.size), bw.Flush()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Frame types sent by the server while following a file
+const (
+	followEnd       byte = 0
+	followData      byte = 1
+	followTruncated byte = 2
+)
+
+// followFile prints the end of a remote file and then everything appended to
+// it until the user presses Enter.
+func (f *FileOperation) followFile(fileName string, stdin *bufio.Reader) {
+	if f.keys != nil {
+		fmt.Println("Following is not available with end-to-end encryption: the server cannot read the files.")
+		return
+	}
+
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := f.conn.Write([]byte{7}); err != nil {
+		fmt.Printf("Error sending operation type: %v\n", err)
+		return
+	}
+	if err := writeString(f.conn, fileName); err != nil {
+		fmt.Printf("Error sending filename: %v\n", err)
+		return
+	}
+	// Start from the server's default tail length
+	if err := binary.Write(f.conn, binary.LittleEndian, int64(0)); err != nil {
+		fmt.Printf("Error sending tail length: %v\n", err)
+		return
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(f.conn, status); err != nil {
+		fmt.Printf("Error reading status: %v\n", err)
+		return
+	}
+	if status[0] == 0 {
+		errMsg, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading error message: %v\n", err)
+			return
+		}
+		fmt.Printf("Follow failed: %s\n", errMsg)
+		return
+	}
+
+	// Frames arrive for as long as the file grows
+	f.conn.SetDeadline(time.Time{})
+	fmt.Printf("Following %s. Press Enter to stop.\n", fileName)
+	fmt.Println(strings.Repeat("-", 80))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			frameType := make([]byte, 1)
+			if _, err := io.ReadFull(f.conn, frameType); err != nil {
+				fmt.Printf("\nError reading from server: %v\n", err)
+				return
+			}
+			switch frameType[0] {
+			case followData:
+				var n int32
+				if err := binary.Read(f.conn, binary.LittleEndian, &n); err != nil {
+					fmt.Printf("\nError reading data length: %v\n", err)
+					return
+				}
+				if _, err := io.CopyN(os.Stdout, f.conn, int64(n)); err != nil {
+					fmt.Printf("\nError reading data: %v\n", err)
+					return
+				}
+			case followTruncated:
+				fmt.Println("\n--- file truncated or replaced, following from the start ---")
+			case followEnd:
+				reason, err := readString(f.conn)
+				if err != nil {
+					fmt.Printf("\nError reading end reason: %v\n", err)
+					return
+				}
+				fmt.Println("\n" + strings.Repeat("-", 80))
+				if reason != "cancelled" {
+					fmt.Printf("Follow ended: %s. Press Enter to return to the menu.\n", reason)
+				}
+				return
+			default:
+				fmt.Printf("\nUnexpected frame type %d\n", frameType[0])
+				return
+			}
+		}
+	}()
+
+	stdin.ReadString('\n')
+	if _, err := f.conn.Write([]byte{0}); err != nil {
+		fmt.Printf("Error sending cancel request: %v\n", err)
+	}
+	<-done
+}
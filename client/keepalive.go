@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// While the menu waits for the user, the client pings the server every
+// heartbeatInterval, if the server agreed to the heartbeat capability. Pings
+// keep the connection alive without counting as activity, so the server
+// still closes idle sessions; its replies warn when that is near. When the
+// server has closed the session, or the connection is lost, the next
+// operation logs in again with the same credentials.
+var heartbeatInterval time.Duration
+
+const reconnectAttempts = 5
+
+// hold takes the connection for an operation chosen at the menu.
+func (f *FileOperation) hold() {
+	f.mu.Lock()
+	f.held = true
+	f.warned = false
+}
+
+// release hands the connection back to the heartbeat.
+func (f *FileOperation) release() {
+	if f.held {
+		f.held = false
+		f.mu.Unlock()
+	}
+}
+
+// heartbeat pings the server whenever no operation holds the connection.
+func (f *FileOperation) heartbeat() {
+	for range time.Tick(heartbeatInterval) {
+		if !f.mu.TryLock() {
+			continue
+		}
+		if !f.lost {
+			f.ping()
+		}
+		f.mu.Unlock()
+	}
+}
+
+// ping sends a ping (operation 27) and shows the server's warning, once per
+// idle spell.
+func (f *FileOperation) ping() {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	var warning string
+	_, err := f.conn.Write([]byte{27})
+	if err == nil {
+		var status byte
+		var msg string
+		if status, msg, err = readStatus(f.conn); err == nil && status != statusOK {
+			// The server closed the session and sent a notice instead
+			fmt.Printf("\n%s.\n", msg)
+			f.lost = true
+			return
+		}
+	}
+	if err == nil {
+		var left int32
+		if err = binary.Read(f.conn, binary.LittleEndian, &left); err == nil {
+			warning, err = readString(f.conn)
+		}
+	}
+	if err != nil {
+		fmt.Println("\nConnection to the server lost; the next operation will reconnect.")
+		f.lost = true
+		return
+	}
+	if warning != "" && !f.warned {
+		fmt.Printf("\nWarning: %s.\n", warning)
+		f.warned = true
+	}
+}
+
+// login opens a connection to the server and logs in with credentials.
+func login(credentials string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error opening connection: %v", err)
+	}
+	conn = limitConnection(conn)
+	if _, err := conn.Write([]byte(credentials + "\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending credentials: %v", err)
+	}
+	response := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	m, err := conn.Read(response)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || !strings.Contains(string(response[:m]), "Authentication successful") {
+		conn.Close()
+		return nil, fmt.Errorf("error logging in: %s", strings.TrimSpace(string(response[:m])))
+	}
+	return conn, nil
+}
+
+// reconnect replaces a closed session with a new one, retrying with growing
+// pauses while the server is unreachable, as during a restart.
+func (f *FileOperation) reconnect() error {
+	f.conn.Close()
+	wait := time.Second
+	var err error
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		fmt.Println("Reconnecting to the server...")
+		var conn net.Conn
+		if conn, err = login(f.credentials); err == nil {
+			f.conn = conn
+			f.lost = false
+			if f.capabilities != nil {
+				if err = f.negotiateCapabilities(); err != nil {
+					return err
+				}
+			}
+			fmt.Println("Reconnected.")
+			return nil
+		}
+		if attempt < reconnectAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// noticeShutdown starts a notice the server sends just before it closes the
+// session, followed by a message as for a status.
+const noticeShutdown byte = 0xFE
+
+// serverClosed reports whether the server has closed the session, printing
+// its notice if it sent one. It only looks at data already received, so it
+// returns at once while the session is open.
+func (f *FileOperation) serverClosed() bool {
+	if f.lost {
+		return true
+	}
+	defer f.conn.SetReadDeadline(time.Time{})
+	f.conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	b := make([]byte, 1)
+	n, err := f.conn.Read(b)
+	if n == 1 && b[0] == noticeShutdown {
+		f.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := readString(f.conn)
+		if err != nil {
+			msg = "The server closed the connection"
+		}
+		fmt.Printf("%s.\n", msg)
+		return true
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return false
+		}
+		fmt.Println("The server closed the connection.")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Preview kinds sent by the server
+const (
+	previewText  byte = 0
+	previewTable byte = 1
+)
+
+func (f *FileOperation) previewFile(fileName string) {
+	if f.keys != nil {
+		fmt.Println("Previews are not available with end-to-end encryption: the server cannot read the files.")
+		return
+	}
+
+	f.conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (8 for preview)
+	if _, err := f.conn.Write([]byte{8}); err != nil {
+		fmt.Printf("Error sending operation type: %v\n", err)
+		return
+	}
+	if err := writeString(f.conn, fileName); err != nil {
+		fmt.Printf("Error sending filename: %v\n", err)
+		return
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(f.conn, status); err != nil {
+		fmt.Printf("Error reading status: %v\n", err)
+		return
+	}
+	if status[0] != statusOK {
+		errMsg, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading error message: %v\n", err)
+			return
+		}
+		fmt.Printf("Preview failed: %s\n", errMsg)
+		return
+	}
+
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(f.conn, kind); err != nil {
+		fmt.Printf("Error reading preview kind: %v\n", err)
+		return
+	}
+	title, err := readString(f.conn)
+	if err != nil {
+		fmt.Printf("Error reading preview title: %v\n", err)
+		return
+	}
+
+	fmt.Printf("\n%s: %s\n", fileName, title)
+	fmt.Println(strings.Repeat("-", 80))
+	if kind[0] == previewText {
+		text, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading preview: %v\n", err)
+			return
+		}
+		fmt.Println(text)
+		fmt.Println(strings.Repeat("-", 80))
+		return
+	}
+
+	var rowCount int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &rowCount); err != nil {
+		fmt.Printf("Error reading row count: %v\n", err)
+		return
+	}
+	rows := make([][]string, rowCount)
+	for i := range rows {
+		var cellCount int32
+		if err := binary.Read(f.conn, binary.LittleEndian, &cellCount); err != nil {
+			fmt.Printf("Error reading cell count: %v\n", err)
+			return
+		}
+		rows[i] = make([]string, cellCount)
+		for j := range rows[i] {
+			if rows[i][j], err = readString(f.conn); err != nil {
+				fmt.Printf("Error reading cell: %v\n", err)
+				return
+			}
+		}
+	}
+	printTable(rows)
+	fmt.Println(strings.Repeat("-", 80))
+}
+
+// printTable prints rows as aligned columns, treating the first row as the
+// header.
+func printTable(rows [][]string) {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := len([]rune(cell)); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	for r, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-len([]rune(cell)))
+		}
+		fmt.Println(strings.TrimRight(strings.Join(cells, "  "), " "))
+		if r == 0 {
+			separators := make([]string, len(widths))
+			for i, w := range widths {
+				separators[i] = strings.Repeat("-", w)
+			}
+			fmt.Println(strings.Join(separators, "  "))
+		}
+	}
+}
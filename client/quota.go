@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+func (f *FileOperation) showQuota() {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (9 for quota and usage)
+	if _, err := f.conn.Write([]byte{9}); err != nil {
+		fmt.Printf("Error sending operation type: %v\n", err)
+		return
+	}
+
+	// Usage and limits, in bytes and files; a limit of 0 means unlimited
+	values := make([]int64, 4)
+	for i := range values {
+		if err := binary.Read(f.conn, binary.LittleEndian, &values[i]); err != nil {
+			fmt.Printf("Error reading quota: %v\n", err)
+			return
+		}
+	}
+	usedBytes, usedFiles, limitBytes, limitFiles := values[0], values[1], values[2], values[3]
+
+	fmt.Println("\nStorage usage:")
+	if limitBytes > 0 {
+		fmt.Printf("  Space: %s of %s (%.1f%%)\n", formatSize(usedBytes), formatSize(limitBytes),
+			float64(usedBytes)/float64(limitBytes)*100)
+	} else {
+		fmt.Printf("  Space: %s (no limit)\n", formatSize(usedBytes))
+	}
+	if limitFiles > 0 {
+		fmt.Printf("  Files: %d of %d\n", usedFiles, limitFiles)
+	} else {
+		fmt.Printf("  Files: %d (no limit)\n", usedFiles)
+	}
+}
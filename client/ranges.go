@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// With -streams above 1, files of parallelMinSize bytes or more are sent
+// and fetched in parts of parallelPartSize over that many connections, if
+// the server supports ranged transfers. Each connection moves one part at a
+// time, so faster connections end up moving more parts.
+const (
+	parallelMinSize  = 16 << 20
+	parallelPartSize = 8 << 20
+)
+
+// parallel reports whether a transfer of size bytes goes over several
+// connections. End-to-end encrypted content is sealed as one stream, so it
+// always goes over one.
+func (f *FileOperation) parallel(size int64) bool {
+	return streams > 1 && f.capabilities["ranges"] && f.keys == nil && size >= parallelMinSize
+}
+
+// openStreams opens n more connections to the server, logged in as the
+// same user.
+func (f *FileOperation) openStreams(n int) ([]net.Conn, error) {
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := login(f.credentials)
+		if err != nil {
+			closeStreams(conns)
+			return nil, fmt.Errorf("another connection: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func closeStreams(conns []net.Conn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// partQueue hands out the parts of a file to the connections moving it and
+// stops handing them out after the first failure.
+type partQueue struct {
+	mu     sync.Mutex
+	next   int64
+	count  int64
+	size   int64
+	done   int64
+	err    error
+	report func(done int64)
+}
+
+func newPartQueue(size int64, report func(int64)) *partQueue {
+	return &partQueue{count: (size + parallelPartSize - 1) / parallelPartSize, size: size, report: report}
+}
+
+// take returns the offset and length of the next part, or ok false when
+// there are none left or a part failed.
+func (q *partQueue) take() (index, offset, length int64, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil || q.next == q.count {
+		return 0, 0, 0, false
+	}
+	index = q.next
+	q.next++
+	offset = index * parallelPartSize
+	length = parallelPartSize
+	if q.size-offset < length {
+		length = q.size - offset
+	}
+	return index, offset, length, true
+}
+
+// finish records the outcome of a part.
+func (q *partQueue) finish(length int64, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		if q.err == nil {
+			q.err = err
+		}
+		return
+	}
+	q.done += length
+	q.report(q.done)
+}
+
+// run moves the parts over conns, one worker per connection, and returns
+// the first error.
+func (q *partQueue) run(conns []net.Conn, move func(conn net.Conn, index, offset, length int64) error) error {
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			for {
+				index, offset, length, ok := q.take()
+				if !ok {
+					return
+				}
+				conn.SetDeadline(time.Now().Add(transferTimeout))
+				q.finish(length, move(conn, index, offset, length))
+			}
+		}(conn)
+	}
+	wg.Wait()
+	return q.err
+}
+
+func showProgress(total int64) func(int64) {
+	return func(done int64) {
+		fmt.Printf("\rProgress: %.1f%%", float64(done)/float64(total)*100)
+	}
+}
+
+// parallelUpload sends file in parts over several connections. The server
+// joins the parts and checks them against the file's hash, which is
+// computed while the parts are sent.
+func (f *FileOperation) parallelUpload(file *os.File, info os.FileInfo) error {
+	fileName := filepath.Base(file.Name())
+	size := info.Size()
+
+	// Send operation type (23 to begin a ranged upload) with the name,
+	// size and part size
+	if _, err := f.conn.Write([]byte{23}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, fileName); err != nil {
+		return fmt.Errorf("error sending filename: %v", err)
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, []int64{size, parallelPartSize}); err != nil {
+		return fmt.Errorf("error sending file size: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading upload status: %v", err)
+	}
+	if status != statusOK {
+		return uploadError(status, msg)
+	}
+	id, err := readString(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading upload id: %v", err)
+	}
+
+	extra, err := f.openStreams(streams - 1)
+	if err != nil {
+		// The server drops the upload when it is finished with parts
+		// missing
+		f.finishRangedUpload(id, make([]byte, sha256.Size))
+		return err
+	}
+	defer closeStreams(extra)
+
+	hashed := make(chan []byte, 1)
+	go func() {
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, size)); err != nil {
+			hashed <- nil
+			return
+		}
+		hashed <- hasher.Sum(nil)
+	}()
+
+	start := time.Now()
+	queue := newPartQueue(size, showProgress(size))
+	sendErr := queue.run(append([]net.Conn{f.conn}, extra...), func(conn net.Conn, index, offset, length int64) error {
+		return sendPart(conn, file.Name(), id, index, offset, length)
+	})
+	fmt.Println()
+	hash := <-hashed
+	if sendErr != nil {
+		return fmt.Errorf("error sending file content: %v", sendErr)
+	}
+	if hash == nil {
+		return fmt.Errorf("error reading file")
+	}
+	f.conn.SetDeadline(time.Now().Add(transferTimeout))
+	if err := f.finishRangedUpload(id, hash); err != nil {
+		return err
+	}
+	fmt.Printf("Successfully sent %s (%d bytes over %d connections in %s)\n",
+		fileName, size, len(extra)+1, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// sendPart sends one part of the file at path. Each part opens the file
+// itself, so the kernel can send it straight from the page cache.
+func sendPart(conn net.Conn, path, id string, index, offset, length int64) error {
+	// Send operation type (24 for a ranged upload part)
+	if _, err := conn.Write([]byte{24}); err != nil {
+		return err
+	}
+	if err := writeString(conn, id); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.LittleEndian, index); err != nil {
+		return err
+	}
+	status, msg, err := readStatus(conn)
+	if err != nil {
+		return err
+	}
+	if status != statusOK {
+		return fmt.Errorf("server refused part %d: %s", index, msg)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(conn, file, length); err != nil {
+		return err
+	}
+
+	if status, msg, err = readStatus(conn); err != nil {
+		return err
+	}
+	if status != statusOK {
+		return fmt.Errorf("server failed to store part %d: %s", index, msg)
+	}
+	return nil
+}
+
+// finishRangedUpload asks the server to join the parts of upload id and
+// check them against hash.
+func (f *FileOperation) finishRangedUpload(id string, hash []byte) error {
+	// Send operation type (25 to finish a ranged upload)
+	if _, err := f.conn.Write([]byte{25}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, id); err != nil {
+		return fmt.Errorf("error sending upload id: %v", err)
+	}
+	if _, err := f.conn.Write(hash); err != nil {
+		return fmt.Errorf("error sending file hash: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading server response: %v", err)
+	}
+	if status != statusOK {
+		return fmt.Errorf("server refused upload: %s", msg)
+	}
+	return nil
+}
+
+// parallelDownload fetches fileName, of size bytes, in parts over several
+// connections into the Downloads directory. Every part carries the file's
+// size and version, so a file changed during the download is detected.
+func (f *FileOperation) parallelDownload(fileName string, size int64) error {
+	if err := os.MkdirAll("Downloads", os.ModePerm); err != nil {
+		return fmt.Errorf("error creating Downloads directory: %v", err)
+	}
+	downloadPath := filepath.Join("Downloads", fileName)
+	file, err := os.Create(downloadPath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	file.Close()
+
+	extra, err := f.openStreams(streams - 1)
+	if err != nil {
+		os.Remove(downloadPath)
+		return err
+	}
+	defer closeStreams(extra)
+
+	var versionMu sync.Mutex
+	var version int64
+	start := time.Now()
+	queue := newPartQueue(size, showProgress(size))
+	err = queue.run(append([]net.Conn{f.conn}, extra...), func(conn net.Conn, index, offset, length int64) error {
+		partVersion, err := fetchPart(conn, downloadPath, fileName, offset, length, size)
+		if err != nil {
+			return err
+		}
+		versionMu.Lock()
+		defer versionMu.Unlock()
+		if version == 0 {
+			version = partVersion
+		} else if partVersion != version {
+			return fmt.Errorf("%s changed on the server during the download", fileName)
+		}
+		return nil
+	})
+	fmt.Println()
+	if err != nil {
+		os.Remove(downloadPath)
+		return fmt.Errorf("error reading file content: %v", err)
+	}
+	fmt.Printf("Successfully received %s (%d bytes over %d connections in %s)\n",
+		fileName, size, len(extra)+1, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// fetchPart downloads length bytes of fileName at offset into the same
+// place in the file at path and returns the version of the file they came
+// from.
+func fetchPart(conn net.Conn, path, fileName string, offset, length, size int64) (int64, error) {
+	// Send operation type (26 for a ranged download)
+	if _, err := conn.Write([]byte{26}); err != nil {
+		return 0, err
+	}
+	if err := writeString(conn, fileName); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(conn, binary.LittleEndian, []int64{offset, length}); err != nil {
+		return 0, err
+	}
+	status, msg, err := readStatus(conn)
+	if err != nil {
+		return 0, err
+	}
+	if status != statusOK {
+		return 0, fmt.Errorf("server error: %s", msg)
+	}
+	// File size, version and the length of the part that follows
+	header := make([]int64, 3)
+	if err := binary.Read(conn, binary.LittleEndian, header); err != nil {
+		return 0, err
+	}
+	if header[0] != size || header[2] != length {
+		io.CopyN(io.Discard, conn, header[2])
+		return 0, fmt.Errorf("%s changed on the server during the download", fileName)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		io.CopyN(io.Discard, conn, length)
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		io.CopyN(io.Discard, conn, length)
+		return 0, err
+	}
+	if _, err := io.CopyN(file, conn, length); err != nil {
+		return 0, err
+	}
+	return header[1], nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (f *FileOperation) searchFiles(query string) {
+	f.conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (6 for content search)
+	if _, err := f.conn.Write([]byte{6}); err != nil {
+		fmt.Printf("Error sending operation type: %v\n", err)
+		return
+	}
+	if err := writeString(f.conn, query); err != nil {
+		fmt.Printf("Error sending query: %v\n", err)
+		return
+	}
+
+	status := make([]byte, 1)
+	if _, err := f.conn.Read(status); err != nil {
+		fmt.Printf("Error reading status: %v\n", err)
+		return
+	}
+	if status[0] == 0 {
+		msg, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading error message: %v\n", err)
+			return
+		}
+		fmt.Printf("Search failed: %s\n", msg)
+		return
+	}
+
+	var fileCount int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &fileCount); err != nil {
+		fmt.Printf("Error reading match count: %v\n", err)
+		return
+	}
+	if fileCount == 0 {
+		fmt.Printf("No files contain %q.\n", query)
+		return
+	}
+
+	fmt.Printf("\nFiles containing %q:\n", query)
+	fmt.Println(strings.Repeat("-", 80))
+	for i := int32(0); i < fileCount; i++ {
+		fileName, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading file name: %v\n", err)
+			return
+		}
+		fmt.Println(fileName)
+
+		var snippetCount int32
+		if err := binary.Read(f.conn, binary.LittleEndian, &snippetCount); err != nil {
+			fmt.Printf("Error reading snippet count: %v\n", err)
+			return
+		}
+		for j := int32(0); j < snippetCount; j++ {
+			var line int32
+			if err := binary.Read(f.conn, binary.LittleEndian, &line); err != nil {
+				fmt.Printf("Error reading line number: %v\n", err)
+				return
+			}
+			snippet, err := readString(f.conn)
+			if err != nil {
+				fmt.Printf("Error reading snippet: %v\n", err)
+				return
+			}
+			fmt.Printf("  %6d: %s\n", line, snippet)
+		}
+	}
+	fmt.Println(strings.Repeat("-", 80))
+}
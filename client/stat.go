@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Flags in a file details reply describing how the server stores a file.
+const (
+	statCompressed   byte = 1 << 0
+	statEncrypted    byte = 1 << 1
+	statDeduplicated byte = 1 << 2
+)
+
+// fileDetails is what the server reports about a stored file.
+type fileDetails struct {
+	size, stored, modTime int64
+	flags                 byte
+}
+
+// requestFileDetails asks the server how it stores fileName.
+func (f *FileOperation) requestFileDetails(fileName string) (*fileDetails, error) {
+	// Send operation type (22 for file details)
+	if _, err := f.conn.Write([]byte{22}); err != nil {
+		return nil, fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, f.remoteName(fileName)); err != nil {
+		return nil, fmt.Errorf("error sending filename: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return nil, fmt.Errorf("server error: %s", msg)
+	}
+
+	// Logical size, size in the store and modification time
+	d := &fileDetails{}
+	for _, v := range []*int64{&d.size, &d.stored, &d.modTime} {
+		if err := binary.Read(f.conn, binary.LittleEndian, v); err != nil {
+			return nil, fmt.Errorf("error reading file details: %v", err)
+		}
+	}
+	if err := binary.Read(f.conn, binary.LittleEndian, &d.flags); err != nil {
+		return nil, fmt.Errorf("error reading file details: %v", err)
+	}
+	return d, nil
+}
+
+func (f *FileOperation) showFileDetails(fileName string) {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	d, err := f.requestFileDetails(fileName)
+	if err != nil {
+		fmt.Printf("File details failed: %v\n", err)
+		return
+	}
+
+	var storage []string
+	if d.flags&statCompressed != 0 {
+		storage = append(storage, "compressed")
+	}
+	if d.flags&statEncrypted != 0 {
+		storage = append(storage, "encrypted at rest")
+	}
+	if d.flags&statDeduplicated != 0 {
+		storage = append(storage, "deduplicated")
+	}
+	if len(storage) == 0 {
+		storage = append(storage, "as uploaded")
+	}
+
+	fmt.Printf("\nDetails of '%s':\n", fileName)
+	if f.keys != nil {
+		fmt.Printf("  Size:     %s (%s end-to-end encrypted)\n", formatSize(plainSize(d.size)), formatSize(d.size))
+	} else {
+		fmt.Printf("  Size:     %s\n", formatSize(d.size))
+	}
+	fmt.Printf("  Stored:   %s\n", formatSize(d.stored))
+	fmt.Printf("  Modified: %s\n", time.Unix(d.modTime, 0).Format("2006-01-02 15:04:05"))
+	fmt.Printf("  Storage:  %s\n", strings.Join(storage, ", "))
+}
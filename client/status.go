@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (f *FileOperation) showServerStatus() {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (10 for server status)
+	if _, err := f.conn.Write([]byte{10}); err != nil {
+		fmt.Printf("Error sending operation type: %v\n", err)
+		return
+	}
+
+	var count int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &count); err != nil {
+		fmt.Printf("Error reading status count: %v\n", err)
+		return
+	}
+
+	fmt.Println("\nServer status:")
+	fmt.Println(strings.Repeat("-", 60))
+	for i := int32(0); i < count; i++ {
+		name, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading status name: %v\n", err)
+			return
+		}
+		value, err := readString(f.conn)
+		if err != nil {
+			fmt.Printf("Error reading status value: %v\n", err)
+			return
+		}
+		fmt.Printf("%-30s %s\n", name, value)
+	}
+	fmt.Println(strings.Repeat("-", 60))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitRate caps the bytes per second the client sends and receives over
+// all its connections together; zero means unlimited.
+var limitRate int64
+
+// rateBucket is the token bucket the client's connections share. It holds
+// up to one second's worth of tokens.
+var rateBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// parseRate parses a rate in bytes per second with an optional K, M or G
+// suffix, as in "500K" or "2M".
+func parseRate(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// waitForTokens blocks until n more bytes fit within the rate limit.
+func waitForTokens(n int) {
+	rateBucket.mu.Lock()
+	now := time.Now()
+	rate := float64(limitRate)
+	if rateBucket.last.IsZero() {
+		rateBucket.tokens = rate
+	} else {
+		rateBucket.tokens += now.Sub(rateBucket.last).Seconds() * rate
+	}
+	rateBucket.last = now
+	if rateBucket.tokens > rate {
+		rateBucket.tokens = rate
+	}
+	rateBucket.tokens -= float64(n)
+	var delay time.Duration
+	if rateBucket.tokens < 0 {
+		delay = time.Duration(-rateBucket.tokens / rate * float64(time.Second))
+	}
+	rateBucket.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// throttledConn is a connection held to the rate limit. Data moves in
+// pieces of a twentieth of a second's worth, so transfers stay smooth. It
+// hides the underlying connection, so the kernel cannot copy files to it
+// directly and bypass the limit.
+type throttledConn struct {
+	net.Conn
+}
+
+// limitConnection returns conn held to the rate limit, if there is one.
+func limitConnection(conn net.Conn) net.Conn {
+	if limitRate == 0 {
+		return conn
+	}
+	return throttledConn{conn}
+}
+
+func ratePiece() int {
+	piece := int(limitRate / 20)
+	if piece < 4<<10 {
+		piece = 4 << 10
+	}
+	if piece > 256<<10 {
+		piece = 256 << 10
+	}
+	return piece
+}
+
+func (c throttledConn) Read(p []byte) (int, error) {
+	if piece := ratePiece(); len(p) > piece {
+		p = p[:piece]
+	}
+	n, err := c.Conn.Read(p)
+	waitForTokens(n)
+	return n, err
+}
+
+func (c throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := ratePiece()
+		if piece > len(p) {
+			piece = len(p)
+		}
+		waitForTokens(piece)
+		n, err := c.Conn.Write(p[:piece])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[piece:]
+	}
+	return written, nil
+}
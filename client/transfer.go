@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// transferTimeout is how long a transfer may go without progress before
+// the client gives up on the server.
+const transferTimeout = 5 * time.Minute
+
+// copyContent copies size bytes from src to dst in pieces of bufferSize,
+// extending the connection deadline for each piece, so a large transfer is
+// limited by its progress rather than its total time. Between a file and
+// the connection the copy is left to the kernel (sendfile or splice on
+// Linux); other copies go through a buffer of bufferSize bytes. progress,
+// if set, is called with the bytes copied so far after each piece.
+func (f *FileOperation) copyContent(dst io.Writer, src io.Reader, size int64, progress func(int64)) (int64, error) {
+	buf := make([]byte, bufferSize)
+	var done int64
+	for done < size {
+		piece := int64(bufferSize)
+		if left := size - done; left < piece {
+			piece = left
+		}
+		f.conn.SetDeadline(time.Now().Add(transferTimeout))
+		n, err := io.CopyBuffer(dst, io.LimitReader(src, piece), buf)
+		done += n
+		if progress != nil {
+			progress(done)
+		}
+		if err != nil {
+			return done, err
+		}
+		if n < piece {
+			return done, io.ErrUnexpectedEOF
+		}
+	}
+	f.conn.SetDeadline(time.Now().Add(transferTimeout))
+	return done, nil
+}
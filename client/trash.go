@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type trashEntry struct {
+	id      int64
+	name    string
+	deleted int64
+	size    int64
+	// encrypted is set for end-to-end encrypted files, whose name and size
+	// have been decrypted
+	encrypted bool
+}
+
+// manageTrash lists the user's trash and lets them restore a file or empty
+// the trash.
+func (f *FileOperation) manageTrash(stdin *bufio.Reader) {
+	entries, err := f.listTrash()
+	if err != nil {
+		fmt.Printf("Error listing trash: %v\n", err)
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("The trash is empty.")
+		return
+	}
+
+	fmt.Println("\nTrash:")
+	fmt.Printf("%-4s %-30s %-20s %10s\n", "#", "Name", "Deleted", "Size")
+	fmt.Println(strings.Repeat("-", 67))
+	for i, e := range entries {
+		fmt.Printf("%-4d %-30s %-20s %10s\n", i+1, e.name,
+			time.Unix(e.deleted, 0).Format("2006-01-02 15:04:05"), formatSize(e.size))
+	}
+
+	fmt.Print("\nEnter r<#> to restore, e to empty the trash, or press Enter to return: ")
+	input, _ := stdin.ReadString('\n')
+	input = strings.TrimSpace(input)
+	switch {
+	case input == "":
+		return
+	case input == "e":
+		fmt.Printf("Permanently delete %d files? (y/N): ", len(entries))
+		confirm, _ := stdin.ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(confirm), "y") {
+			fmt.Println("Cancelled.")
+			return
+		}
+		if err := f.emptyTrash(); err != nil {
+			fmt.Printf("Emptying trash failed: %v\n", err)
+		}
+	case input[0] == 'r':
+		n, err := strconv.Atoi(input[1:])
+		if err != nil || n < 1 || n > len(entries) {
+			fmt.Println("Invalid entry number.")
+			return
+		}
+		entry := entries[n-1]
+		fmt.Printf("Restore as (press Enter for '%s'): ", entry.name)
+		newName, _ := stdin.ReadString('\n')
+		newName = strings.TrimSpace(newName)
+		if newName != "" && entry.encrypted {
+			newName = f.remoteName(newName)
+		}
+		if err := f.restoreFromTrash(entry.id, newName); err != nil {
+			fmt.Printf("Restore failed: %v\n", err)
+			return
+		}
+		fmt.Printf("Restored '%s'.\n", entry.name)
+	default:
+		fmt.Println("Invalid choice.")
+	}
+}
+
+func (f *FileOperation) listTrash() ([]trashEntry, error) {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (14 for list trash)
+	if _, err := f.conn.Write([]byte{14}); err != nil {
+		return nil, fmt.Errorf("error sending operation type: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return nil, fmt.Errorf("server error: %s", msg)
+	}
+
+	var count int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("error reading entry count: %v", err)
+	}
+	entries := make([]trashEntry, count)
+	for i := range entries {
+		e := &entries[i]
+		if err := binary.Read(f.conn, binary.LittleEndian, &e.id); err != nil {
+			return nil, fmt.Errorf("error reading entry: %v", err)
+		}
+		if e.name, err = readString(f.conn); err != nil {
+			return nil, fmt.Errorf("error reading entry: %v", err)
+		}
+		for _, v := range []*int64{&e.deleted, &e.size} {
+			if err := binary.Read(f.conn, binary.LittleEndian, v); err != nil {
+				return nil, fmt.Errorf("error reading entry: %v", err)
+			}
+		}
+		e.name, e.encrypted = f.displayName(e.name)
+		e.size = f.displaySize(e.size, e.encrypted)
+	}
+	return entries, nil
+}
+
+func (f *FileOperation) restoreFromTrash(id int64, newName string) error {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (15 for restore from trash)
+	if _, err := f.conn.Write([]byte{15}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := binary.Write(f.conn, binary.LittleEndian, id); err != nil {
+		return fmt.Errorf("error sending trash id: %v", err)
+	}
+	if err := writeString(f.conn, newName); err != nil {
+		return fmt.Errorf("error sending filename: %v", err)
+	}
+
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return fmt.Errorf("server error: %s", msg)
+	}
+	return nil
+}
+
+func (f *FileOperation) emptyTrash() error {
+	f.conn.SetDeadline(time.Now().Add(time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (16 for empty trash)
+	if _, err := f.conn.Write([]byte{16}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return fmt.Errorf("server error: %s", msg)
+	}
+
+	var removed int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &removed); err != nil {
+		return fmt.Errorf("error reading count: %v", err)
+	}
+	fmt.Printf("Permanently deleted %d files.\n", removed)
+	return nil
+}
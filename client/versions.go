@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type fileVersion struct {
+	id      int64
+	size    int64
+	modTime int64
+}
+
+// manageVersions lists the versions of fileName and lets the user download
+// or restore one of them.
+func (f *FileOperation) manageVersions(fileName string, stdin *bufio.Reader) {
+	versions, err := f.listVersions(fileName)
+	if err != nil {
+		fmt.Printf("Error listing versions: %v\n", err)
+		return
+	}
+	if len(versions) == 0 {
+		fmt.Printf("No previous versions of %s\n", fileName)
+		return
+	}
+
+	fmt.Printf("\nPrevious versions of %s:\n", fileName)
+	fmt.Printf("%-4s %-20s %-20s %10s\n", "#", "Replaced", "Modified", "Size")
+	fmt.Println(strings.Repeat("-", 57))
+	for i, v := range versions {
+		fmt.Printf("%-4d %-20s %-20s %10s\n", i+1,
+			time.Unix(0, v.id).Format("2006-01-02 15:04:05"),
+			time.Unix(v.modTime, 0).Format("2006-01-02 15:04:05"),
+			formatSize(f.displaySize(v.size, f.keys != nil)))
+	}
+
+	fmt.Print("\nEnter d<#> to download, r<#> to restore, or press Enter to return: ")
+	input, _ := stdin.ReadString('\n')
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return
+	}
+	n, err := strconv.Atoi(input[1:])
+	if err != nil || n < 1 || n > len(versions) {
+		fmt.Println("Invalid version number.")
+		return
+	}
+	version := versions[n-1]
+
+	switch input[0] {
+	case 'd':
+		if err := f.downloadVersion(fileName, version.id); err != nil {
+			fmt.Printf("Download failed: %v\n", err)
+		}
+	case 'r':
+		if err := f.restoreVersion(fileName, version.id); err != nil {
+			fmt.Printf("Restore failed: %v\n", err)
+			return
+		}
+		fmt.Printf("Restored %s to the version replaced at %s\n", fileName,
+			time.Unix(0, version.id).Format("2006-01-02 15:04:05"))
+	default:
+		fmt.Println("Invalid choice.")
+	}
+}
+
+// sendVersionRequest sends an operation on fileName, with a version id for
+// every operation but the listing, and reads the server's status.
+func (f *FileOperation) sendVersionRequest(opType byte, fileName string, id int64) error {
+	if _, err := f.conn.Write([]byte{opType}); err != nil {
+		return fmt.Errorf("error sending operation type: %v", err)
+	}
+	if err := writeString(f.conn, f.remoteName(fileName)); err != nil {
+		return fmt.Errorf("error sending filename: %v", err)
+	}
+	if opType != 11 {
+		if err := binary.Write(f.conn, binary.LittleEndian, id); err != nil {
+			return fmt.Errorf("error sending version id: %v", err)
+		}
+	}
+
+	status, msg, err := readStatus(f.conn)
+	if err != nil {
+		return fmt.Errorf("error reading status: %v", err)
+	}
+	if status != statusOK {
+		return fmt.Errorf("server error: %s", msg)
+	}
+	return nil
+}
+
+func (f *FileOperation) listVersions(fileName string) ([]fileVersion, error) {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (11 for list versions)
+	if err := f.sendVersionRequest(11, fileName, 0); err != nil {
+		return nil, err
+	}
+
+	var count int32
+	if err := binary.Read(f.conn, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("error reading version count: %v", err)
+	}
+	versions := make([]fileVersion, count)
+	for i := range versions {
+		for _, v := range []*int64{&versions[i].id, &versions[i].size, &versions[i].modTime} {
+			if err := binary.Read(f.conn, binary.LittleEndian, v); err != nil {
+				return nil, fmt.Errorf("error reading version: %v", err)
+			}
+		}
+	}
+	return versions, nil
+}
+
+// downloadVersion saves a version to Downloads, with the time it was
+// replaced added to its name.
+func (f *FileOperation) downloadVersion(fileName string, id int64) error {
+	f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (12 for download version)
+	if err := f.sendVersionRequest(12, fileName, id); err != nil {
+		return err
+	}
+
+	var fileSize int64
+	if err := binary.Read(f.conn, binary.LittleEndian, &fileSize); err != nil {
+		return fmt.Errorf("error reading file size: %v", err)
+	}
+
+	if err := os.MkdirAll("Downloads", os.ModePerm); err != nil {
+		return fmt.Errorf("error creating Downloads directory: %v", err)
+	}
+	downloadPath := filepath.Join("Downloads",
+		fmt.Sprintf("%s.%s", fileName, time.Unix(0, id).Format("20060102-150405")))
+	file, err := os.Create(downloadPath)
+	if err != nil {
+		io.CopyN(io.Discard, f.conn, fileSize)
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer file.Close()
+
+	received, err := f.receiveContent(file, f.conn, fileSize)
+	if err != nil {
+		file.Close()
+		os.Remove(downloadPath)
+		return fmt.Errorf("error reading file content: %v", err)
+	}
+	fmt.Printf("Version saved to %s (%s)\n", downloadPath, formatSize(received))
+	return nil
+}
+
+func (f *FileOperation) restoreVersion(fileName string, id int64) error {
+	f.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	defer f.conn.SetDeadline(time.Time{})
+
+	// Send operation type (13 for restore version)
+	return f.sendVersionRequest(13, fileName, id)
+}
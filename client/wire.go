@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Status codes sent by the server in reply to a request. Anything but
+// statusOK is followed by an error message.
+const (
+	statusError         byte = 0
+	statusOK            byte = 1
+	statusQuotaExceeded byte = 2
+	statusDiskFull      byte = 3
+	statusReadOnly      byte = 4
+	statusUnsupported   byte = 5
+	statusBusy          byte = 6
+)
+
+// readString reads an int32 length followed by that many bytes.
+func readString(r io.Reader) (string, error) {
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeString writes s as an int32 length followed by its bytes.
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(len(s))); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+// readStatus reads a status byte and, if it is not statusOK, the error
+// message that follows it.
+func readStatus(r io.Reader) (byte, string, error) {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return 0, "", err
+	}
+	if status[0] == statusOK {
+		return statusOK, "", nil
+	}
+	msg, err := readString(r)
+	return status[0], msg, err
+}
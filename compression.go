@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Compressed transfers send the content as frames: a uint32 length followed
+// by that many bytes of compressed data, ended by an empty frame. Frames let
+// the receiver find the end of the content without knowing its compressed
+// size in advance.
+const (
+	maxFrameSize = 64 << 10
+	// A sample that compresses to more than this fraction of its size is
+	// not worth compressing
+	compressibleRatio = 0.9
+)
+
+// codec is a compression format both sides can agree on.
+type codec struct {
+	name      string
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs lists the supported formats, most preferred first.
+var codecs = []codec{
+	{
+		name: "gzip",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name: "zlib",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	},
+	{
+		name: "deflate",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+}
+
+func findCodec(name string) *codec {
+	for i := range codecs {
+		if codecs[i].name == name {
+			return &codecs[i]
+		}
+	}
+	return nil
+}
+
+// capabilitySet holds the optional protocol features agreed with a client,
+// such as "compress:gzip".
+type capabilitySet map[string]bool
+
+// serverCapabilities returns what the server offers, in order of preference.
+func serverCapabilities() []string {
+	var caps []string
+	for _, name := range currentConfig().CompressionCodecs {
+		caps = append(caps, "compress:"+name)
+	}
+	// Ranged uploads and downloads over parallel connections
+	caps = append(caps, "ranges")
+	// Pings that report the idle timeout
+	caps = append(caps, "heartbeat")
+	return caps
+}
+
+// codec returns the most preferred agreed codec, or nil if compression was
+// not agreed.
+func (c capabilitySet) codec() *codec {
+	for _, name := range currentConfig().CompressionCodecs {
+		if c["compress:"+name] {
+			return findCodec(name)
+		}
+	}
+	return nil
+}
+
+// handleCapabilities reads the capabilities a client supports and replies
+// with those the server agrees to use on this connection.
+func handleCapabilities(reader *bufio.Reader, conn net.Conn, username string) (capabilitySet, error) {
+	var count int32
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("error reading capability count: %v", err)
+	}
+	if count < 0 || count > 64 {
+		return nil, fmt.Errorf("invalid capability count %d", count)
+	}
+	offered := make(map[string]bool)
+	for i := int32(0); i < count; i++ {
+		capability, err := readString(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error reading capability: %v", err)
+		}
+		offered[capability] = true
+	}
+
+	caps := make(capabilitySet)
+	var agreed []string
+	for _, capability := range serverCapabilities() {
+		if offered[capability] {
+			caps[capability] = true
+			agreed = append(agreed, capability)
+		}
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(agreed))); err != nil {
+		return nil, err
+	}
+	for _, capability := range agreed {
+		if err := writeString(conn, capability); err != nil {
+			return nil, err
+		}
+	}
+	logFor(conn).Debug("Agreed capabilities", "capabilities", strings.Join(agreed, ","))
+	return caps, nil
+}
+
+// handleCompressedUpload receives a file the client may have compressed
+// with one of the agreed codecs.
+func handleCompressedUpload(reader *bufio.Reader, conn net.Conn, username string, caps capabilitySet) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	var fileSize int64
+	if err := binary.Read(reader, binary.LittleEndian, &fileSize); err != nil {
+		return fmt.Errorf("error reading file size: %v", err)
+	}
+	codecName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading codec: %v", err)
+	}
+	if codecName != "" && (!caps["compress:"+codecName] || findCodec(codecName) == nil) {
+		return sendStatus(conn, statusUnsupported, fmt.Sprintf("Codec %q was not agreed", codecName))
+	}
+	return receiveUpload(reader, conn, fileName, fileSize, username, codecName)
+}
+
+// handleCompressedDownload sends a file compressed with the preferred
+// agreed codec, unless its content does not compress.
+func handleCompressedDownload(reader *bufio.Reader, conn net.Conn, username string, caps capabilitySet) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+	if !validFileName(fileName) {
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "a download")
+	}
+	defer worker()
+
+	file, err := openStoredFile(path.Join(username, fileName))
+	if err != nil {
+		return sendStatus(conn, statusError, fmt.Sprintf("File %s does not exist", fileName))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return sendStatus(conn, statusError, "Error checking file")
+	}
+	fileSize := info.Size()
+
+	cfg := currentConfig()
+	c := caps.codec()
+	if c != nil && (fileSize < cfg.CompressionMinSize || !compressible(fileName, file, fileSize)) {
+		c = nil
+	}
+	codecName := ""
+	if c != nil {
+		codecName = c.name
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.LittleEndian, fileSize); err != nil {
+		return err
+	}
+	if err := writeString(conn, codecName); err != nil {
+		return err
+	}
+
+	if c == nil {
+		if _, err := sendContent(conn, file, 0, fileSize); err != nil {
+			return fmt.Errorf("error sending file content: %v", err)
+		}
+		logFor(conn).Info("File downloaded", "file", fileName, "bytes", fileSize, "compression", "none")
+		return nil
+	}
+
+	wire := &countingWriter{w: deadlineWriter{conn}}
+	frames := newFrameWriter(wire)
+	encoder, err := c.newWriter(frames, cfg.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, io.NewSectionReader(file, 0, fileSize)); err != nil {
+		return fmt.Errorf("error sending file content: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("error sending file content: %v", err)
+	}
+	if err := frames.Close(); err != nil {
+		return fmt.Errorf("error sending file content: %v", err)
+	}
+	logFor(conn).Info("File downloaded", "file", fileName, "bytes", fileSize,
+		"compression", codecName, "sent", wire.n)
+	return nil
+}
+
+// compressedExtensions are formats that are already compressed.
+var compressedExtensions = extensionSet(".gz", ".tgz", ".zip", ".bz2", ".xz", ".zst", ".lz4", ".7z", ".rar",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp3", ".mp4", ".mkv", ".mov", ".avi", ".ogg", ".flac",
+	".pdf", ".docx", ".xlsx", ".pptx", ".jar", ".apk", ".e2e")
+
+// compressible reports whether content is worth compressing, judged by its
+// extension and by compressing a sample from its start.
+func compressible(fileName string, content io.ReaderAt, size int64) bool {
+	if compressedExtensions[strings.ToLower(filepath.Ext(fileName))] {
+		return false
+	}
+	sample := make([]byte, maxFrameSize)
+	n, err := content.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	var out bytes.Buffer
+	w, _ := flate.NewWriter(&out, flate.BestSpeed)
+	w.Write(sample[:n])
+	w.Close()
+	return float64(out.Len()) < float64(n)*compressibleRatio
+}
+
+// frameWriter splits what is written to it into frames.
+type frameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{w: w, buf: make([]byte, 0, maxFrameSize)}
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(f.buf[len(f.buf):maxFrameSize], p)
+		f.buf = f.buf[:len(f.buf)+n]
+		p = p[n:]
+		written += n
+		if len(f.buf) == maxFrameSize {
+			if err := f.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (f *frameWriter) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	if err := binary.Write(f.w, binary.LittleEndian, uint32(len(f.buf))); err != nil {
+		return err
+	}
+	_, err := f.w.Write(f.buf)
+	f.buf = f.buf[:0]
+	return err
+}
+
+// Close sends what is buffered and the empty frame that ends the content.
+func (f *frameWriter) Close() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return binary.Write(f.w, binary.LittleEndian, uint32(0))
+}
+
+// frameReader returns the data of the frames read from r, up to the empty
+// frame that ends them.
+type frameReader struct {
+	r    io.Reader
+	left uint32
+	done bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for f.left == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := binary.Read(f.r, binary.LittleEndian, &f.left); err != nil {
+			return 0, err
+		}
+		if f.left > maxFrameSize {
+			return 0, fmt.Errorf("frame of %d bytes is too large", f.left)
+		}
+		f.done = f.left == 0
+	}
+	if uint32(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// finish checks that decoded has no content left and reads up to the end
+// of the frames, so the next request starts in the right place.
+func (f *frameReader) finish(decoded io.Reader) error {
+	var one [1]byte
+	if n, _ := decoded.Read(one[:]); n > 0 {
+		return fmt.Errorf("content is longer than declared")
+	}
+	n, err := io.Copy(io.Discard, f)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%d bytes of unexpected data after the content", n)
+	}
+	return nil
+}
+
+// countingReader and countingWriter count the bytes that pass through
+// them, for logging transfer sizes on the wire.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
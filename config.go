@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// serverConfig holds the tunables read from server.conf. Every field has a
+// default, so the file is optional.
+type serverConfig struct {
+	// Content search
+	IndexEnabled      bool
+	IndexExtensions   map[string]bool
+	IndexMaxBytes     int64
+	SearchMaxResults  int
+	SearchMaxSnippets int
+
+	// File view
+	ViewDefaultBytes int64
+	ViewMaxBytes     int64
+	ViewDefaultLines int
+
+	// Follow mode
+	FollowPollInterval time.Duration
+
+	// Structured preview
+	PreviewRows      int
+	PreviewTextBytes int64
+
+	// Default storage quotas; zero means unlimited
+	QuotaBytes int64
+	QuotaFiles int64
+
+	// Disk-space guard
+	DiskLowWatermark      watermark
+	DiskCriticalWatermark watermark
+	DiskCheckInterval     time.Duration
+
+	// File versioning; a keep count of zero disables it and a zero age
+	// keeps versions until the count limit removes them
+	VersionsKeep   int
+	VersionsMaxAge time.Duration
+
+	// How long deleted files stay in the trash; zero keeps them until the
+	// trash is emptied
+	TrashRetention time.Duration
+
+	// Deduplicated storage of new uploads
+	DedupEnabled bool
+
+	// Wire compression: the codecs offered to clients in order of
+	// preference (none disables it), the compression level and the
+	// smallest file worth compressing
+	CompressionCodecs  []string
+	CompressionLevel   int
+	CompressionMinSize int64
+
+	// Transfers: the buffer uploads and downloads are copied through, and
+	// the socket buffer sizes; zero leaves socket buffers to the OS
+	TransferBufferSize int64
+	SocketBufferSize   int64
+
+	// Bandwidth limits in bytes per second, for the whole server, the
+	// default for each user and for each session; zero means unlimited
+	RateLimit        int64
+	RateLimitUser    int64
+	RateLimitSession int64
+
+	// Admission control: connections open at once, in total and from one
+	// address, and sessions per user; zero means unlimited. Heavy
+	// operations run on a pool of workers (its size is read at startup
+	// only) and wait in a queue of bounded length and time for a free one.
+	MaxConnections      int64
+	MaxConnectionsPerIP int64
+	MaxSessionsPerUser  int64
+	WorkerPoolSize      int
+	WorkerQueueSize     int
+	WorkerQueueTimeout  time.Duration
+
+	// How long a shutdown waits for transfers in progress to finish
+	ShutdownTimeout time.Duration
+
+	// Sessions without operations for IdleTimeout are closed (zero keeps
+	// them open); pings within IdleWarning of it are answered with a warning
+	IdleTimeout time.Duration
+	IdleWarning time.Duration
+
+	// Path of the Unix socket serverctl talks to; empty disables it. Read
+	// at startup only.
+	ControlSocket string
+
+	// Audit log: the file (empty disables it), the size it is rotated at
+	// (zero never rotates) and how many rotated files are kept, and whether
+	// records also go to syslog. Read at startup only.
+	AuditLog        string
+	AuditLogMaxSize int64
+	AuditLogKeep    int
+	AuditSyslog     bool
+
+	// Application log: level, format ("text" or "json") and file (empty
+	// logs to stderr), rotated at LogMaxSize or every LogRotateInterval
+	// (zero turns either off), keeping LogKeep old files. Only the level
+	// changes on a reload.
+	LogLevel          slog.Level
+	LogFormat         string
+	LogFile           string
+	LogMaxSize        int64
+	LogRotateInterval time.Duration
+	LogKeep           int
+
+	// Where files are kept: "local", "memory" or "s3". Read at startup only.
+	StorageBackend string
+	S3Endpoint     string
+	S3Bucket       string
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3Prefix       string
+
+	// Compression of stored files. Read at startup only.
+	StorageCompression      bool
+	StorageCompressionLevel int
+
+	// Encryption at rest. The master keys are also needed to read files
+	// stored while it was enabled. Read at startup only.
+	EncryptionEnabled bool
+	EncryptionKey     string
+	EncryptionKeyFile string
+}
+
+var activeConfig atomic.Pointer[serverConfig]
+
+// currentConfig returns the configuration the server is running with.
+func currentConfig() *serverConfig {
+	return activeConfig.Load()
+}
+
+func defaultConfig() *serverConfig {
+	return &serverConfig{
+		IndexEnabled: false,
+		IndexExtensions: extensionSet(".txt", ".log", ".csv", ".tsv", ".md", ".json", ".yaml", ".yml",
+			".xml", ".ini", ".conf", ".go", ".py", ".c", ".h", ".java", ".js", ".ts", ".sh", ".sql"),
+		IndexMaxBytes:     64 << 20,
+		SearchMaxResults:  50,
+		SearchMaxSnippets: 5,
+		ViewDefaultBytes:  1024,
+		ViewMaxBytes:      64 << 10,
+		ViewDefaultLines:  20,
+
+		FollowPollInterval: 500 * time.Millisecond,
+
+		PreviewRows:      20,
+		PreviewTextBytes: 16 << 10,
+
+		DiskLowWatermark:      watermark{percent: 5},
+		DiskCriticalWatermark: watermark{percent: 1},
+		DiskCheckInterval:     30 * time.Second,
+
+		VersionsKeep: 5,
+
+		TrashRetention: 30 * 24 * time.Hour,
+
+		CompressionCodecs:  []string{"gzip", "zlib", "deflate"},
+		CompressionLevel:   6,
+		CompressionMinSize: 1 << 10,
+
+		TransferBufferSize: 256 << 10,
+
+		MaxConnections:      1000,
+		MaxConnectionsPerIP: 100,
+		MaxSessionsPerUser:  64,
+		WorkerPoolSize:      64,
+		WorkerQueueSize:     256,
+		WorkerQueueTimeout:  30 * time.Second,
+
+		ShutdownTimeout: 2 * time.Minute,
+
+		IdleTimeout: 5 * time.Minute,
+		IdleWarning: time.Minute,
+
+		ControlSocket: "control.sock",
+
+		AuditLog:        "audit.log",
+		AuditLogMaxSize: 100 << 20,
+		AuditLogKeep:    10,
+
+		LogLevel:          slog.LevelInfo,
+		LogFormat:         "text",
+		LogMaxSize:        100 << 20,
+		LogRotateInterval: 24 * time.Hour,
+		LogKeep:           7,
+
+		StorageCompressionLevel: 6,
+
+		StorageBackend: "local",
+		S3Region:       "us-east-1",
+	}
+}
+
+// reloadConfig reads server.conf again and makes it the active
+// configuration. Settings read at startup only keep their values; it
+// returns the names of those the file changes.
+func reloadConfig() ([]string, error) {
+	next, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	prev := currentConfig()
+	var ignored []string
+	keepSetting(&ignored, "worker_pool_size", &next.WorkerPoolSize, prev.WorkerPoolSize)
+	keepSetting(&ignored, "control_socket", &next.ControlSocket, prev.ControlSocket)
+	keepSetting(&ignored, "audit_log", &next.AuditLog, prev.AuditLog)
+	keepSetting(&ignored, "audit_log_max_size", &next.AuditLogMaxSize, prev.AuditLogMaxSize)
+	keepSetting(&ignored, "audit_log_keep", &next.AuditLogKeep, prev.AuditLogKeep)
+	keepSetting(&ignored, "audit_syslog", &next.AuditSyslog, prev.AuditSyslog)
+	keepSetting(&ignored, "log_format", &next.LogFormat, prev.LogFormat)
+	keepSetting(&ignored, "log_file", &next.LogFile, prev.LogFile)
+	keepSetting(&ignored, "log_max_size", &next.LogMaxSize, prev.LogMaxSize)
+	keepSetting(&ignored, "log_rotate_interval", &next.LogRotateInterval, prev.LogRotateInterval)
+	keepSetting(&ignored, "log_keep", &next.LogKeep, prev.LogKeep)
+	keepSetting(&ignored, "storage_backend", &next.StorageBackend, prev.StorageBackend)
+	keepSetting(&ignored, "s3_endpoint", &next.S3Endpoint, prev.S3Endpoint)
+	keepSetting(&ignored, "s3_bucket", &next.S3Bucket, prev.S3Bucket)
+	keepSetting(&ignored, "s3_region", &next.S3Region, prev.S3Region)
+	keepSetting(&ignored, "s3_access_key", &next.S3AccessKey, prev.S3AccessKey)
+	keepSetting(&ignored, "s3_secret_key", &next.S3SecretKey, prev.S3SecretKey)
+	keepSetting(&ignored, "s3_prefix", &next.S3Prefix, prev.S3Prefix)
+	keepSetting(&ignored, "storage_compression", &next.StorageCompression, prev.StorageCompression)
+	keepSetting(&ignored, "storage_compression_level", &next.StorageCompressionLevel, prev.StorageCompressionLevel)
+	keepSetting(&ignored, "encryption_enabled", &next.EncryptionEnabled, prev.EncryptionEnabled)
+	keepSetting(&ignored, "encryption_key", &next.EncryptionKey, prev.EncryptionKey)
+	keepSetting(&ignored, "encryption_key_file", &next.EncryptionKeyFile, prev.EncryptionKeyFile)
+	activeConfig.Store(next)
+	logLevel.Set(next.LogLevel)
+	slog.Info("Reloaded configuration", "file", configFile)
+	if len(ignored) > 0 {
+		slog.Warn("Some changes take effect after a restart", "settings", strings.Join(ignored, ","))
+	}
+	return ignored, nil
+}
+
+// keepSetting restores a setting read at startup only, noting its name if
+// the new value differs.
+func keepSetting[T comparable](ignored *[]string, name string, next *T, prev T) {
+	if *next != prev {
+		*ignored = append(*ignored, name)
+		*next = prev
+	}
+}
+
+// readConfig reads a "key = value" config file on top of the defaults.
+// Blank lines and lines starting with '#' are ignored. A missing file is not
+// an error.
+func readConfig(filePath string) (*serverConfig, error) {
+	cfg := defaultConfig()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", filePath, lineNum)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := applyConfigValue(cfg, key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filePath, lineNum, err)
+		}
+	}
+	return cfg, scanner.Err()
+}
+
+func applyConfigValue(cfg *serverConfig, key, value string) error {
+	var err error
+	switch key {
+	case "index_enabled":
+		cfg.IndexEnabled, err = strconv.ParseBool(value)
+	case "index_extensions":
+		cfg.IndexExtensions = extensionSet(strings.Split(value, ",")...)
+	case "index_max_bytes":
+		cfg.IndexMaxBytes, err = parseSize(value)
+	case "search_max_results":
+		cfg.SearchMaxResults, err = strconv.Atoi(value)
+	case "search_max_snippets":
+		cfg.SearchMaxSnippets, err = strconv.Atoi(value)
+	case "view_default_bytes":
+		cfg.ViewDefaultBytes, err = parsePositiveSize(value)
+	case "view_max_bytes":
+		cfg.ViewMaxBytes, err = parsePositiveSize(value)
+	case "view_default_lines":
+		cfg.ViewDefaultLines, err = strconv.Atoi(value)
+	case "follow_poll_interval":
+		cfg.FollowPollInterval, err = parsePositiveDuration(value)
+	case "preview_rows":
+		cfg.PreviewRows, err = strconv.Atoi(value)
+	case "preview_text_bytes":
+		cfg.PreviewTextBytes, err = parseSize(value)
+	case "quota_bytes":
+		cfg.QuotaBytes, err = parseLimit(value, parseSize)
+	case "quota_files":
+		cfg.QuotaFiles, err = parseLimit(value, parseCount)
+	case "disk_low_watermark":
+		cfg.DiskLowWatermark, err = parseWatermark(value)
+	case "disk_critical_watermark":
+		cfg.DiskCriticalWatermark, err = parseWatermark(value)
+	case "disk_check_interval":
+		cfg.DiskCheckInterval, err = parsePositiveDuration(value)
+	case "versions_keep":
+		cfg.VersionsKeep, err = strconv.Atoi(value)
+		if err == nil && cfg.VersionsKeep < 0 {
+			err = fmt.Errorf("count must not be negative")
+		}
+	case "versions_max_age":
+		cfg.VersionsMaxAge, err = parseAge(value)
+	case "trash_retention":
+		cfg.TrashRetention, err = parseAge(value)
+	case "dedup_enabled":
+		cfg.DedupEnabled, err = strconv.ParseBool(value)
+	case "compression_codecs":
+		cfg.CompressionCodecs, err = parseCodecs(value)
+	case "compression_level":
+		cfg.CompressionLevel, err = strconv.Atoi(value)
+		if err == nil && (cfg.CompressionLevel < 1 || cfg.CompressionLevel > 9) {
+			err = fmt.Errorf("level must be between 1 and 9")
+		}
+	case "compression_min_size":
+		cfg.CompressionMinSize, err = parseSize(value)
+	case "transfer_buffer_size":
+		cfg.TransferBufferSize, err = parseSize(value)
+		if err == nil && (cfg.TransferBufferSize < 4<<10 || cfg.TransferBufferSize > 64<<20) {
+			err = fmt.Errorf("size must be between 4K and 64M")
+		}
+	case "socket_buffer_size":
+		cfg.SocketBufferSize, err = parseSize(value)
+		if err == nil && cfg.SocketBufferSize > 64<<20 {
+			err = fmt.Errorf("size must be at most 64M")
+		}
+	case "rate_limit":
+		cfg.RateLimit, err = parseLimit(value, parseSize)
+	case "rate_limit_user":
+		cfg.RateLimitUser, err = parseLimit(value, parseSize)
+	case "rate_limit_session":
+		cfg.RateLimitSession, err = parseLimit(value, parseSize)
+	case "max_connections":
+		cfg.MaxConnections, err = parseLimit(value, parseCount)
+	case "max_connections_per_ip":
+		cfg.MaxConnectionsPerIP, err = parseLimit(value, parseCount)
+	case "max_sessions_per_user":
+		cfg.MaxSessionsPerUser, err = parseLimit(value, parseCount)
+	case "worker_pool_size":
+		cfg.WorkerPoolSize, err = strconv.Atoi(value)
+		if err == nil && cfg.WorkerPoolSize < 1 {
+			err = fmt.Errorf("pool needs at least one worker")
+		}
+	case "worker_queue_size":
+		cfg.WorkerQueueSize, err = strconv.Atoi(value)
+		if err == nil && cfg.WorkerQueueSize < 0 {
+			err = fmt.Errorf("queue size must not be negative")
+		}
+	case "worker_queue_timeout":
+		cfg.WorkerQueueTimeout, err = parsePositiveDuration(value)
+	case "shutdown_timeout":
+		cfg.ShutdownTimeout, err = parsePositiveDuration(value)
+	case "idle_timeout":
+		cfg.IdleTimeout, err = parseAge(value)
+	case "idle_warning":
+		cfg.IdleWarning, err = parseAge(value)
+	case "control_socket":
+		cfg.ControlSocket = value
+	case "audit_log":
+		cfg.AuditLog = value
+	case "audit_log_max_size":
+		cfg.AuditLogMaxSize, err = parseLimit(value, parseSize)
+	case "audit_log_keep":
+		cfg.AuditLogKeep, err = strconv.Atoi(value)
+		if err == nil && cfg.AuditLogKeep < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "audit_syslog":
+		cfg.AuditSyslog, err = strconv.ParseBool(value)
+	case "log_level":
+		err = cfg.LogLevel.UnmarshalText([]byte(value))
+	case "log_format":
+		switch value {
+		case "text", "json":
+			cfg.LogFormat = value
+		default:
+			err = fmt.Errorf("expected text or json")
+		}
+	case "log_file":
+		cfg.LogFile = value
+	case "log_max_size":
+		cfg.LogMaxSize, err = parseLimit(value, parseSize)
+	case "log_rotate_interval":
+		cfg.LogRotateInterval, err = parseAge(value)
+	case "log_keep":
+		cfg.LogKeep, err = strconv.Atoi(value)
+		if err == nil && cfg.LogKeep < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "storage_backend":
+		switch value {
+		case "local", "memory", "s3":
+			cfg.StorageBackend = value
+		default:
+			err = fmt.Errorf("expected local, memory or s3")
+		}
+	case "s3_endpoint":
+		cfg.S3Endpoint = value
+	case "s3_bucket":
+		cfg.S3Bucket = value
+	case "s3_region":
+		cfg.S3Region = value
+	case "s3_access_key":
+		cfg.S3AccessKey = value
+	case "s3_secret_key":
+		cfg.S3SecretKey = value
+	case "s3_prefix":
+		cfg.S3Prefix = value
+	case "storage_compression":
+		cfg.StorageCompression, err = strconv.ParseBool(value)
+	case "storage_compression_level":
+		cfg.StorageCompressionLevel, err = strconv.Atoi(value)
+		if err == nil && (cfg.StorageCompressionLevel < 1 || cfg.StorageCompressionLevel > 9) {
+			err = fmt.Errorf("level must be between 1 and 9")
+		}
+	case "encryption_enabled":
+		cfg.EncryptionEnabled, err = strconv.ParseBool(value)
+	case "encryption_key":
+		cfg.EncryptionKey = value
+	case "encryption_key_file":
+		cfg.EncryptionKeyFile = value
+	default:
+		slog.Warn("Ignoring unknown config key", "key", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return nil
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix
+// (powers of 1024), e.g. "512", "64K", "10G".
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, "B")
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("size must not be negative")
+	}
+	return n * multiplier, nil
+}
+
+func parseCount(value string) (int64, error) {
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func parsePositiveSize(value string) (int64, error) {
+	n, err := parseSize(value)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+	return n, nil
+}
+
+func parsePositiveDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive")
+	}
+	return d, nil
+}
+
+// parseAge parses a retention age. Besides Go durations it accepts a whole
+// number of days such as "30d"; "0" means no age limit.
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("age must not be negative")
+	}
+	return d, err
+}
+
+// parseCodecs parses a comma-separated list of codec names; "none" or an
+// empty list turns compression off.
+func parseCodecs(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+		if findCodec(name) == nil {
+			return nil, fmt.Errorf("unknown codec %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func extensionSet(exts ...string) map[string]bool {
+	set := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		set[ext] = true
+	}
+	return set
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// The control socket gives operators runtime control of the server through
+// serverctl. It is a Unix socket that only the server's own user may open,
+// which stands in for authentication. A client sends one command line and
+// reads the reply until the server closes the connection: "OK" or
+// "ERROR <message>" on the first line, then the command's output.
+
+// controlHelp lists the commands, as shown by "help".
+var controlHelp = []string{
+	"status                 server health and metrics",
+	"sessions               sessions with user, address, login time, operation and bytes moved",
+	"kick <address>...      close the sessions at the given addresses",
+	"kick-user <username>   close every session of a user",
+	"quota [username...]    storage usage against quotas, for all users by default",
+	"reload-config          read server.conf again",
+	"reload-users           read id_passwd.txt again and close sessions of removed users",
+	"gc                     purge expired trash and versions and remove unreferenced chunks",
+	"drain                  stop accepting connections and exit once sessions have closed",
+	"help                   this list",
+}
+
+var (
+	controlListener net.Listener
+	// controlSignals is the channel handleShutdown reads; drain sends to it
+	controlSignals chan os.Signal
+)
+
+// startControlSocket listens for control connections on path. It does not
+// take over the socket of another server that is still running, unless that
+// server handed this one the listener.
+func startControlSocket(path string, signalChannel chan os.Signal) {
+	if path == "" {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		if !overlapping.Load() {
+			slog.Warn("Control socket is in use by another server; not listening on it", "path", path)
+			return
+		}
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		slog.Error("Error opening control socket", "error", err)
+		return
+	}
+	// The file is removed at shutdown, but not after a handoff, when it
+	// belongs to the new process
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(path, 0600); err != nil {
+		slog.Error("Error restricting control socket", "error", err)
+		l.Close()
+		return
+	}
+	controlListener = l
+	controlSignals = signalChannel
+	slog.Info("Control socket listening", "path", path)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(conn)
+		}
+	}()
+}
+
+// closeControlSocket stops serving control connections at shutdown.
+func closeControlSocket() {
+	if controlListener == nil {
+		return
+	}
+	controlListener.Close()
+	if !handedOff.Load() {
+		os.Remove(controlListener.Addr().String())
+	}
+}
+
+// handleControl runs one command and sends its reply.
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fmt.Fprintln(conn, "ERROR empty command")
+		return
+	}
+	slog.Info("Control command", "command", strings.Join(fields, " "))
+
+	var out bytes.Buffer
+	if err := runControlCommand(fields[0], fields[1:], &out); err != nil {
+		slog.Warn("Control command failed", "command", fields[0], "error", err)
+		fmt.Fprintf(conn, "ERROR %v\n", err)
+		return
+	}
+	fmt.Fprintln(conn, "OK")
+	conn.Write(out.Bytes())
+}
+
+func runControlCommand(name string, args []string, out io.Writer) error {
+	switch name {
+	case "status":
+		for _, pair := range serverStatus() {
+			fmt.Fprintf(out, "%-26s %s\n", pair[0], pair[1])
+		}
+	case "sessions":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SESSION\tUSER\tADDRESS\tLOGGED IN\tOPERATION\tIDLE\tRECEIVED\tSENT")
+		for _, s := range listSessions() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", s.id, s.username, s.addr,
+				s.started.Format("2006-01-02 15:04:05"), s.operation,
+				s.idle.Round(time.Second), s.bytesIn, s.bytesOut)
+		}
+		return w.Flush()
+	case "kick":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: kick <address>...")
+		}
+		closed := 0
+		for _, addr := range args {
+			closed += closeSessions(closeByAddress, addr, nil, "Session closed by an administrator")
+		}
+		fmt.Fprintf(out, "Closed %d sessions\n", closed)
+	case "kick-user":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: kick-user <username>")
+		}
+		fmt.Fprintf(out, "Closed %d sessions\n", closeSessions(closeByUser, args[0], nil, "Session closed by an administrator"))
+	case "quota":
+		users := args
+		if len(users) == 0 {
+			users = accountNames()
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USER\tBYTES\tBYTE QUOTA\tFILES\tFILE QUOTA")
+		for _, username := range users {
+			if lookupAccount(username) == nil {
+				return fmt.Errorf("no user %s", username)
+			}
+			usage, err := currentUsage(username)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error reading usage of %s: %v", username, err)
+			}
+			limits := quotaFor(username)
+			fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", username, usage.Bytes, formatLimit(limits.Bytes), usage.Files, formatLimit(limits.Files))
+		}
+		return w.Flush()
+	case "reload-config":
+		ignored, err := reloadConfig()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Reloaded %s\n", configFile)
+		if len(ignored) > 0 {
+			fmt.Fprintf(out, "Changes to %s take effect after a restart\n", strings.Join(ignored, ", "))
+		}
+	case "reload-users":
+		users, closed, err := reloadUsers()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Loaded %d users from %s; closed %d sessions of removed users\n", users, credentials, closed)
+	case "gc":
+		trashed := purgeExpiredTrash()
+		expireAllVersions()
+		chunks := sweepChunks()
+		fmt.Fprintf(out, "Purged %d files from trash, applied version retention and removed %d unreferenced chunks\n", trashed, chunks)
+		if overlapping.Load() {
+			fmt.Fprintln(out, "Chunks are not removed until the previous server process has exited")
+		}
+	case "drain":
+		if draining.Load() {
+			return fmt.Errorf("the server is already draining")
+		}
+		select {
+		case controlSignals <- syscall.SIGTERM:
+		default:
+			return fmt.Errorf("a shutdown or restart is already in progress")
+		}
+		fmt.Fprintln(out, "Draining; the server exits once every session has closed")
+	case "help":
+		for _, line := range controlHelp {
+			fmt.Fprintln(out, line)
+		}
+	default:
+		return fmt.Errorf("unknown command %q; try help", name)
+	}
+	return nil
+}
+
+// formatLimit shows a quota limit, zero being unlimited.
+func formatLimit(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(n)
+}
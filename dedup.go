@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+)
+
+// maxManifestChunks bounds the chunk list of a deduplicated upload.
+const maxManifestChunks = 1 << 20
+
+// handleDedupUpload receives a file as a list of chunk hashes, asks the
+// client only for the chunks the user's own files already contain, and
+// commits a manifest for it. Chunks stored for other users are requested
+// like new ones and deduplicated once received, so the chunks requested
+// do not tell a user what anyone else stores.
+func handleDedupUpload(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+	var fileSize int64
+	if err := binary.Read(reader, binary.LittleEndian, &fileSize); err != nil {
+		return fmt.Errorf("error reading file size: %v", err)
+	}
+	var count int32
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return fmt.Errorf("error reading chunk count: %v", err)
+	}
+	if count < 0 || count > maxManifestChunks {
+		return fmt.Errorf("invalid chunk count %d", count)
+	}
+
+	m := &manifest{Size: fileSize}
+	var total int64
+	rawHash := make([]byte, 32)
+	for i := int32(0); i < count; i++ {
+		var size int32
+		if _, err := io.ReadFull(reader, rawHash); err != nil {
+			return fmt.Errorf("error reading chunk hash: %v", err)
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+			return fmt.Errorf("error reading chunk size: %v", err)
+		}
+		if size <= 0 || size > maxChunkSize {
+			return fmt.Errorf("invalid chunk size %d", size)
+		}
+		m.Chunks = append(m.Chunks, chunkRef{Hash: hex.EncodeToString(rawHash), Size: int64(size), offset: total})
+		total += int64(size)
+	}
+
+	if !validFileName(fileName) || total != fileSize {
+		logFor(conn).Warn("Rejected deduplicated upload", "file", fileName, "bytes", fileSize)
+		return sendStatus(conn, statusError, "Invalid file name or chunk list")
+	}
+	if !dedupActive() {
+		return sendStatus(conn, statusUnsupported, "Deduplicated uploads are disabled on this server")
+	}
+
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "an upload")
+	}
+	defer worker()
+
+	release, err := reserveUpload(username, fileName, fileSize)
+	if err != nil {
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "error", err)
+		if _, ok := err.(*errQuotaExceeded); ok {
+			return sendStatus(conn, statusQuotaExceeded, err.Error())
+		}
+		return sendStatus(conn, statusError, err.Error())
+	}
+	defer release()
+
+	known, err := userChunks(username)
+	if err != nil {
+		sendStatus(conn, statusError, "Error reading existing files")
+		return fmt.Errorf("error listing chunks of %s: %v", username, err)
+	}
+
+	// Take references to the chunks the user already has, so they cannot
+	// be collected while the rest of the file arrives. Every occurrence in
+	// the manifest holds one reference.
+	occurrences := make(map[string]int)
+	for _, c := range m.Chunks {
+		occurrences[c.Hash]++
+	}
+	held := make(map[string]bool)
+	var missing []int32
+	var missingBytes int64
+	for i, c := range m.Chunks {
+		if _, seen := held[c.Hash]; seen {
+			continue
+		}
+		held[c.Hash] = known[c.Hash] && refChunk(c.Hash, occurrences[c.Hash])
+		if !held[c.Hash] {
+			missing = append(missing, int32(i))
+			missingBytes += c.Size
+		}
+	}
+	releaseHeld := func() {
+		var hashes []string
+		for hash, ok := range held {
+			for n := 0; ok && n < occurrences[hash]; n++ {
+				hashes = append(hashes, hash)
+			}
+		}
+		releaseChunks(hashes)
+	}
+
+	if status, msg := checkUploadSpace(missingBytes); status != statusOK {
+		releaseHeld()
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "reason", msg)
+		return sendStatus(conn, status, msg)
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		releaseHeld()
+		return fmt.Errorf("error sending upload status: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(missing))); err != nil {
+		releaseHeld()
+		return fmt.Errorf("error sending missing chunk count: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, missing); err != nil {
+		releaseHeld()
+		return fmt.Errorf("error sending missing chunks: %v", err)
+	}
+
+	// Receive the missing chunks. A chunk that does not match its hash fails
+	// the upload, but the rest are still read so the connection stays usable.
+	var uploadErr error
+	for _, i := range missing {
+		c := m.Chunks[i]
+		data := make([]byte, c.Size)
+		extendReadDeadline(conn)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			releaseHeld()
+			return fmt.Errorf("error reading chunk: %v", err)
+		}
+		if uploadErr != nil {
+			continue
+		}
+		if chunkHash(data) != c.Hash {
+			uploadErr = fmt.Errorf("chunk %d does not match its hash", i)
+			continue
+		}
+		if err := storeChunk(c.Hash, data, occurrences[c.Hash]); err != nil {
+			uploadErr = fmt.Errorf("error storing chunk: %v", err)
+			continue
+		}
+		held[c.Hash] = true
+	}
+	if uploadErr == nil {
+		var sum []byte
+		if sum, uploadErr = manifestChecksum(m); uploadErr == nil {
+			auditFor(conn).setChecksum(sum)
+			uploadErr = commitManifest(username, fileName, m)
+		}
+	}
+	if uploadErr != nil {
+		releaseHeld()
+		sendStatus(conn, statusError, "Failed to store file")
+		return fmt.Errorf("error storing %s: %v", fileName, uploadErr)
+	}
+
+	logFor(conn).Info("File received", "file", fileName, "bytes", fileSize, "chunks", len(m.Chunks), "chunks_sent", len(missing))
+	go indexUploadedFile(username, fileName)
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending upload status: %v", err)
+	}
+	return nil
+}
+
+// manifestChecksum returns the SHA-256 of the content m describes, read
+// from its stored chunks.
+func manifestChecksum(m *manifest) ([]byte, error) {
+	file := &manifestFile{manifest: m, current: -1}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// userChunks returns the hashes of the chunks in the user's files, previous
+// versions and trash.
+func userChunks(username string) (map[string]bool, error) {
+	chunks := make(map[string]bool)
+	for _, dir := range []string{username, path.Join(versionsDirName, username), trashDir(username)} {
+		err := walkStore(dir, func(name string, info os.FileInfo) error {
+			if info.IsDir() {
+				return nil
+			}
+			if m, err := loadManifest(name); err == nil && m != nil {
+				for _, hash := range m.hashes() {
+					chunks[hash] = true
+				}
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+// commitManifest stores m as the current copy of fileName. The manifest's
+// chunk references must already be held.
+func commitManifest(username, fileName string, m *manifest) error {
+	staging, stagingName, err := createStagingFile(username, fileName)
+	if err != nil {
+		return err
+	}
+	if err := m.write(staging); err != nil {
+		staging.Abort()
+		return err
+	}
+	if err := staging.Close(); err != nil {
+		return err
+	}
+	if err := commitFile(username, fileName, stagingName); err != nil {
+		store.Remove(stagingName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net"
+	"path"
+)
+
+// Instructions in a delta upload stream.
+const (
+	deltaEnd     byte = 0
+	deltaCopy    byte = 1 // int32 first block, int32 block count
+	deltaLiteral byte = 2 // int32 length, then that many bytes
+	// Literal data compressed with an agreed codec: codec name, int32
+	// length, int32 compressed length, then the compressed bytes
+	deltaCompressedLiteral byte = 3
+)
+
+const (
+	minDeltaBlockSize = 2 << 10
+	maxDeltaBlockSize = 1 << 20
+	maxDeltaLiteral   = 1 << 20
+	// deltaStrongSize is how much of each block's SHA-256 is sent; the
+	// whole-file hash catches the rare collision.
+	deltaStrongSize = 16
+)
+
+// deltaBlockSize picks a block size of about the square root of the file
+// size, which balances signature size against match granularity.
+func deltaBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size))) &^ 1023
+	if bs < minDeltaBlockSize {
+		return minDeltaBlockSize
+	}
+	if bs > maxDeltaBlockSize {
+		return maxDeltaBlockSize
+	}
+	return bs
+}
+
+// weakChecksum is the rsync rolling checksum of block.
+func weakChecksum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xFFFF | b<<16
+}
+
+// handleDeltaUpload updates a file from a stream of instructions that copy
+// blocks of the server's current copy or add new data. The server first
+// sends the signatures of its blocks; the result is checked against the
+// client's hash of the whole file and committed like an upload.
+func handleDeltaUpload(reader *bufio.Reader, conn net.Conn, username string, caps capabilitySet) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+	var fileSize int64
+	if err := binary.Read(reader, binary.LittleEndian, &fileSize); err != nil {
+		return fmt.Errorf("error reading file size: %v", err)
+	}
+	if !validFileName(fileName) || fileSize < 0 {
+		logFor(conn).Warn("Rejected delta upload", "file", fileName, "bytes", fileSize)
+		return sendStatus(conn, statusError, "Invalid file name or size")
+	}
+
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "an upload")
+	}
+	defer worker()
+
+	if status, msg := checkUploadSpace(fileSize); status != statusOK {
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "reason", msg)
+		return sendStatus(conn, status, msg)
+	}
+	release, err := reserveUpload(username, fileName, fileSize)
+	if err != nil {
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "error", err)
+		if _, ok := err.(*errQuotaExceeded); ok {
+			return sendStatus(conn, statusQuotaExceeded, err.Error())
+		}
+		return sendStatus(conn, statusError, err.Error())
+	}
+	defer release()
+
+	// Without a current copy there is nothing to copy from and the client
+	// sends everything as literal data
+	var base storedFile
+	var baseSize int64
+	if file, err := openStoredFile(path.Join(username, fileName)); err == nil {
+		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			base, baseSize = file, info.Size()
+		}
+	}
+	blockSize := deltaBlockSize(baseSize)
+	blockCount := int32(baseSize / int64(blockSize))
+
+	var signatures bytes.Buffer
+	if base != nil {
+		block := make([]byte, blockSize)
+		for i := int32(0); i < blockCount; i++ {
+			if _, err := base.ReadAt(block, int64(i)*int64(blockSize)); err != nil {
+				sendStatus(conn, statusError, "Error reading current file")
+				return fmt.Errorf("error computing signatures: %v", err)
+			}
+			binary.Write(&signatures, binary.LittleEndian, weakChecksum(block))
+			strong := sha256.Sum256(block)
+			signatures.Write(strong[:deltaStrongSize])
+		}
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending upload status: %v", err)
+	}
+	for _, v := range []int32{int32(blockSize), blockCount} {
+		if err := binary.Write(conn, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("error sending signatures: %v", err)
+		}
+	}
+	if _, err := conn.Write(signatures.Bytes()); err != nil {
+		return fmt.Errorf("error sending signatures: %v", err)
+	}
+
+	staging, stagingName, err := createStagingFile(username, fileName)
+	if err != nil {
+		return fmt.Errorf("error creating staging file: %v", err)
+	}
+	hasher := sha256.New()
+	copied, literal, sent, err := applyDelta(reader, conn, io.MultiWriter(staging, hasher), base, blockSize, blockCount, fileSize, caps)
+	if err != nil {
+		staging.Abort()
+		return err
+	}
+	if err := staging.Close(); err != nil {
+		return fmt.Errorf("error writing staging file: %v", err)
+	}
+
+	uploadErr := verifyDelta(reader, hasher, copied+literal, fileSize)
+	if uploadErr == nil {
+		auditFor(conn).setChecksum(hasher.Sum(nil))
+		if uploadErr = storeStagedContent(stagingName); uploadErr == nil {
+			uploadErr = commitFile(username, fileName, stagingName)
+		}
+	}
+	if uploadErr != nil {
+		store.Remove(stagingName)
+		logFor(conn).Error("Delta upload failed", "file", fileName, "error", uploadErr)
+		return sendStatus(conn, statusError, uploadErr.Error())
+	}
+
+	logFor(conn).Info("File received", "file", fileName, "bytes", fileSize,
+		"copied", copied, "literal", literal, "sent", sent)
+	go indexUploadedFile(username, fileName)
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending upload status: %v", err)
+	}
+	return nil
+}
+
+// applyDelta writes the file described by the instruction stream to w and
+// returns how many bytes were copied from base and received as literals,
+// and how many bytes the literals took on the wire.
+func applyDelta(reader *bufio.Reader, conn net.Conn, w io.Writer, base storedFile, blockSize int, blockCount int32, fileSize int64, caps capabilitySet) (int64, int64, int64, error) {
+	var copied, literal, sent int64
+	for {
+		extendReadDeadline(conn)
+		op, err := reader.ReadByte()
+		if err != nil {
+			return copied, literal, sent, fmt.Errorf("error reading delta instruction: %v", err)
+		}
+
+		switch op {
+		case deltaEnd:
+			return copied, literal, sent, nil
+
+		case deltaCopy:
+			var first, count int32
+			if err := binary.Read(reader, binary.LittleEndian, &first); err != nil {
+				return copied, literal, sent, fmt.Errorf("error reading copy instruction: %v", err)
+			}
+			if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+				return copied, literal, sent, fmt.Errorf("error reading copy instruction: %v", err)
+			}
+			if first < 0 || count <= 0 || int64(first)+int64(count) > int64(blockCount) {
+				return copied, literal, sent, fmt.Errorf("copy of blocks %d+%d out of range", first, count)
+			}
+			n := int64(count) * int64(blockSize)
+			if copied+literal+n > fileSize {
+				return copied, literal, sent, fmt.Errorf("delta is longer than the declared size")
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(base, int64(first)*int64(blockSize), n)); err != nil {
+				return copied, literal, sent, fmt.Errorf("error copying blocks: %v", err)
+			}
+			copied += n
+
+		case deltaLiteral:
+			var n int32
+			if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+				return copied, literal, sent, fmt.Errorf("error reading literal length: %v", err)
+			}
+			if n <= 0 || n > maxDeltaLiteral || copied+literal+int64(n) > fileSize {
+				return copied, literal, sent, fmt.Errorf("invalid literal length %d", n)
+			}
+			if _, err := io.CopyN(w, reader, int64(n)); err != nil {
+				return copied, literal, sent, fmt.Errorf("error receiving literal data: %v", err)
+			}
+			literal += int64(n)
+			sent += int64(n)
+
+		case deltaCompressedLiteral:
+			n, compressed, err := applyCompressedLiteral(reader, w, caps, fileSize-copied-literal)
+			if err != nil {
+				return copied, literal, sent, err
+			}
+			literal += n
+			sent += compressed
+
+		default:
+			return copied, literal, sent, fmt.Errorf("unknown delta instruction %d", op)
+		}
+	}
+}
+
+// applyCompressedLiteral decompresses a compressed literal to w. It returns
+// the literal's length and its compressed length.
+func applyCompressedLiteral(reader *bufio.Reader, w io.Writer, caps capabilitySet, remaining int64) (int64, int64, error) {
+	codecName, err := readString(reader)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading literal codec: %v", err)
+	}
+	var n, compressed int32
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return 0, 0, fmt.Errorf("error reading literal length: %v", err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &compressed); err != nil {
+		return 0, 0, fmt.Errorf("error reading literal length: %v", err)
+	}
+	c := findCodec(codecName)
+	if c == nil || !caps["compress:"+codecName] {
+		return 0, 0, fmt.Errorf("codec %q was not agreed", codecName)
+	}
+	if n <= 0 || n > maxDeltaLiteral || int64(n) > remaining || compressed <= 0 || compressed > maxDeltaLiteral*2 {
+		return 0, 0, fmt.Errorf("invalid literal length %d (%d compressed)", n, compressed)
+	}
+	data := make([]byte, compressed)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, 0, fmt.Errorf("error receiving literal data: %v", err)
+	}
+	decoder, err := c.newReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error decompressing literal data: %v", err)
+	}
+	defer decoder.Close()
+	// Read one byte past the declared length to catch literals that are
+	// longer than they claim
+	copied, err := io.Copy(w, io.LimitReader(decoder, int64(n)+1))
+	if err != nil || copied != int64(n) {
+		return 0, 0, fmt.Errorf("compressed literal does not match its length")
+	}
+	return int64(n), int64(compressed), nil
+}
+
+// verifyDelta reads the client's SHA-256 of the whole file and checks the
+// rebuilt file against it.
+func verifyDelta(reader *bufio.Reader, hasher hash.Hash, written, fileSize int64) error {
+	expected := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(reader, expected); err != nil {
+		return fmt.Errorf("error reading file hash: %v", err)
+	}
+	if written != fileSize {
+		return fmt.Errorf("rebuilt file is %d bytes, expected %d", written, fileSize)
+	}
+	if !bytes.Equal(hasher.Sum(nil), expected) {
+		return fmt.Errorf("rebuilt file does not match the client's hash")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Disk states, from healthy to read-only.
+const (
+	diskOK       int32 = 0
+	diskLow      int32 = 1 // new uploads refused
+	diskCritical int32 = 2 // server is read-only
+)
+
+// watermark is a free-space threshold, either an absolute byte count or a
+// percentage of the filesystem size.
+type watermark struct {
+	bytes   int64
+	percent float64
+}
+
+func parseWatermark(value string) (watermark, error) {
+	if strings.HasSuffix(value, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil {
+			return watermark{}, err
+		}
+		if p < 0 || p > 100 {
+			return watermark{}, fmt.Errorf("percentage must be between 0 and 100")
+		}
+		return watermark{percent: p}, nil
+	}
+	n, err := parseSize(value)
+	return watermark{bytes: n}, err
+}
+
+// threshold returns the watermark in bytes for a filesystem of the given size.
+func (w watermark) threshold(total uint64) uint64 {
+	if w.percent > 0 {
+		return uint64(float64(total) * w.percent / 100)
+	}
+	return uint64(w.bytes)
+}
+
+func (w watermark) String() string {
+	if w.percent > 0 {
+		return strconv.FormatFloat(w.percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatInt(w.bytes, 10)
+}
+
+var (
+	diskState     atomic.Int32
+	diskFreeBytes atomic.Uint64
+	diskTotal     atomic.Uint64
+	// diskMonitored is false when free space cannot be read on this
+	// platform or filesystem; the guard then lets everything through.
+	diskMonitored atomic.Bool
+)
+
+// monitorDiskSpace refreshes the disk state at the configured interval.
+func monitorDiskSpace() {
+	checkDiskSpace()
+	for {
+		time.Sleep(currentConfig().DiskCheckInterval)
+		checkDiskSpace()
+	}
+}
+
+// checkDiskSpace reads free space in the store and updates the disk state,
+// logging every transition.
+func checkDiskSpace() int32 {
+	free, total, err := storeSpace()
+	if err != nil {
+		if diskMonitored.Swap(false) || diskState.Load() != diskOK {
+			slog.Warn("Disk space monitoring disabled", "error", err)
+		}
+		diskState.Store(diskOK)
+		return diskOK
+	}
+	diskMonitored.Store(true)
+	diskFreeBytes.Store(free)
+	diskTotal.Store(total)
+
+	cfg := currentConfig()
+	state := diskOK
+	switch {
+	case free <= cfg.DiskCriticalWatermark.threshold(total):
+		state = diskCritical
+	case free <= cfg.DiskLowWatermark.threshold(total):
+		state = diskLow
+	}
+
+	if previous := diskState.Swap(state); previous != state {
+		switch state {
+		case diskCritical:
+			slog.Error("Free space critically low; server is now read-only", "dir", baseDir, "free", free)
+		case diskLow:
+			slog.Warn("Free space low; refusing new uploads", "dir", baseDir, "free", free)
+		default:
+			slog.Info("Free space back to normal", "dir", baseDir, "free", free)
+		}
+	}
+	return state
+}
+
+func diskStateName(state int32) string {
+	switch state {
+	case diskLow:
+		return "low"
+	case diskCritical:
+		return "critical (read-only)"
+	}
+	return "ok"
+}
+
+// readOnly reports whether the server refuses all writes.
+func readOnly() bool {
+	return diskState.Load() == diskCritical
+}
+
+// checkUploadSpace decides whether an upload of fileSize bytes may start,
+// returning the status to send and, if refused, the message for the client.
+// It re-reads free space so the decision does not wait for the next poll,
+// and counts uploads already in progress against it.
+func checkUploadSpace(fileSize int64) (byte, string) {
+	state := checkDiskSpace()
+	if !diskMonitored.Load() {
+		return statusOK, ""
+	}
+	switch state {
+	case diskCritical:
+		return statusReadOnly, "Server is read-only: disk space is critically low"
+	case diskLow:
+		return statusDiskFull, "Server disk space is low; uploads are temporarily refused"
+	}
+
+	free := diskFreeBytes.Load()
+	needed := uint64(fileSize) + uint64(totalInFlight()) + currentConfig().DiskLowWatermark.threshold(diskTotal.Load())
+	if needed > free {
+		return statusDiskFull, fmt.Sprintf("Not enough disk space on the server for %d bytes", fileSize)
+	}
+	return statusOK, ""
+}
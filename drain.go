@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A shutdown drains the server instead of cutting transfers off. The
+// listener closes, so no new connections arrive, and each session is closed
+// once it has been idle for drainIdle, after a notice frame tells the client
+// why. Operations that continue a parallel transfer are still served while
+// draining, so transfers in flight finish; other operations are answered
+// with the notice. Sessions still open after shutdown_timeout are closed,
+// which discards their partial uploads like any dropped connection.
+const drainIdle = 2 * time.Second
+
+// noticeShutdown starts a notice frame, sent unasked just before the server
+// closes a session, for a shutdown or after an idle timeout: the byte and a
+// message, shaped like a status so that a client reading a reply gets the
+// message.
+const noticeShutdown byte = 0xFE
+
+var (
+	draining atomic.Bool
+	// shutdownMessage is sent in notices; it is set before draining starts
+	shutdownMessage = "Server is shutting down"
+)
+
+// continuesTransfer reports whether opType belongs to a parallel transfer
+// already in progress.
+func continuesTransfer(opType byte) bool {
+	return opType == 24 || opType == 25 || opType == 26
+}
+
+// wake cuts the wait of an idle session short when the server starts
+// draining.
+func (s *session) wake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.busy {
+		s.conn.SetReadDeadline(time.Now().Add(drainIdle))
+	}
+}
+
+// sendNotice tells the client why the session is closing.
+func sendNotice(s *session, msg string) {
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := sendStatus(s.conn, noticeShutdown, msg); err == nil {
+		s.sessionLog.Info("Closed session", "reason", msg)
+	}
+}
+
+// handleShutdown drains the server on the first interrupt and closes every
+// session on the second or when shutdown_timeout runs out. A restart signal
+// hands the listener to a new process first; if that fails the server keeps
+// running.
+func handleShutdown(signalChannel chan os.Signal, wg *sync.WaitGroup) {
+	for sig := range signalChannel {
+		if !isRestartSignal(sig) {
+			break
+		}
+		slog.Info("Restarting: starting a new server process")
+		if err := handOff(); err != nil {
+			slog.Error("Restart failed, still serving", "error", err)
+			continue
+		}
+		handedOff.Store(true)
+		shutdownMessage = restartMessage
+		break
+	}
+	fmt.Print("\r")
+	timeout := currentConfig().ShutdownTimeout
+	slog.Info("Shutting down: waiting for transfers to finish (interrupt again to stop now)", "timeout", timeout)
+	draining.Store(true)
+	listener.Close()
+
+	mu.Lock()
+	for _, s := range authenticatedSessions {
+		s.wake()
+	}
+	mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+wait:
+	for {
+		select {
+		case <-done:
+			return
+		case sig := <-signalChannel:
+			if isRestartSignal(sig) {
+				continue
+			}
+			slog.Warn("Interrupted again; closing all sessions")
+			break wait
+		case <-deadline.C:
+			slog.Warn("Shutdown timeout reached; closing remaining sessions")
+			break wait
+		}
+	}
+
+	mu.Lock()
+	for _, s := range authenticatedSessions {
+		s.conn.Close()
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encrypted objects start with a fixed-size header holding the id of the
+// master key and the file's data key wrapped by it, followed by the content
+// in AES-GCM sealed segments. The header has a fixed size so rotating the
+// master key only rewrites the header.
+const (
+	encMagic       = "DFTPENC1"
+	encHeaderSize  = 128
+	encSegmentSize = 64 << 10
+	encTagSize     = 16
+	maxKeyIDLength = 32
+
+	// Header layout
+	encKeyIDOffset   = len(encMagic) + 1 // after the key id length byte
+	encWrapOffset    = encKeyIDOffset + maxKeyIDLength
+	encWrapNonceSize = 12
+	encDataKeySize   = 32
+)
+
+// keyRing holds the master keys. New data keys are wrapped with the current
+// key; the others are kept to unwrap files that have not been rotated yet.
+type keyRing struct {
+	keys    map[string][]byte
+	current string
+}
+
+// loadKeyRing reads the master keys from the config: encryption_key, or
+// encryption_key_file with one "id:hexkey" line per key, the last being
+// current. It returns nil if no key is configured.
+func loadKeyRing(cfg *serverConfig) (*keyRing, error) {
+	ring := &keyRing{keys: make(map[string][]byte)}
+	switch {
+	case cfg.EncryptionKey != "" && cfg.EncryptionKeyFile != "":
+		return nil, fmt.Errorf("set encryption_key or encryption_key_file, not both")
+	case cfg.EncryptionKey != "":
+		if err := ring.add(cfg.EncryptionKey); err != nil {
+			return nil, fmt.Errorf("invalid encryption_key: %v", err)
+		}
+	case cfg.EncryptionKeyFile != "":
+		file, err := os.Open(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil && info.Mode().Perm()&0077 != 0 {
+			slog.Warn("Key file is readable by other users", "file", cfg.EncryptionKeyFile)
+		}
+		scanner := bufio.NewScanner(file)
+		lineNum := 0
+		for scanner.Scan() {
+			lineNum++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := ring.add(line); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", cfg.EncryptionKeyFile, lineNum, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	if ring.current == "" {
+		return nil, fmt.Errorf("no master key found")
+	}
+	return ring, nil
+}
+
+// add parses "id:hexkey", or a bare hex key with the id "default", and
+// makes it the current key.
+func (r *keyRing) add(entry string) error {
+	id, keyHex, ok := strings.Cut(entry, ":")
+	if !ok {
+		id, keyHex = "default", entry
+	}
+	if !validKeyID(id) {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(keyHex))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("key %s must be 64 hex digits (256 bits)", id)
+	}
+	if _, dup := r.keys[id]; dup {
+		return fmt.Errorf("duplicate key id %q", id)
+	}
+	r.keys[id] = key
+	r.current = id
+	return nil
+}
+
+func validKeyID(id string) bool {
+	if id == "" || len(id) > maxKeyIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptionHeader builds the header for a file whose data key is wrapped
+// with the current master key.
+func (r *keyRing) encryptionHeader(dataKey []byte) ([]byte, error) {
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	header[len(encMagic)] = byte(len(r.current))
+	copy(header[encKeyIDOffset:], r.current)
+
+	aead, err := newGCM(r.keys[r.current])
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[encWrapOffset : encWrapOffset+encWrapNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The magic and key id are authenticated with the wrapped key
+	aead.Seal(header[encWrapOffset+encWrapNonceSize:encWrapOffset+encWrapNonceSize],
+		nonce, dataKey, header[:encWrapOffset])
+	return header, nil
+}
+
+// isEncrypted reports whether header starts an encrypted object.
+func isEncrypted(header []byte) bool {
+	return len(header) == encHeaderSize && string(header[:len(encMagic)]) == encMagic
+}
+
+// headerKeyID returns the id of the master key an encrypted object's data
+// key is wrapped with.
+func headerKeyID(header []byte) string {
+	n := int(header[len(encMagic)])
+	if n > maxKeyIDLength {
+		n = maxKeyIDLength
+	}
+	return string(header[encKeyIDOffset : encKeyIDOffset+n])
+}
+
+// unwrapDataKey returns the data key of an encrypted object.
+func (r *keyRing) unwrapDataKey(header []byte) ([]byte, error) {
+	id := headerKeyID(header)
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", id)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[encWrapOffset : encWrapOffset+encWrapNonceSize]
+	wrapped := header[encWrapOffset+encWrapNonceSize : encWrapOffset+encWrapNonceSize+encDataKeySize+encTagSize]
+	dataKey, err := aead.Open(nil, nonce, wrapped, header[:encWrapOffset])
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key with master key %q", id)
+	}
+	return dataKey, nil
+}
+
+// readHeader reads the first encHeaderSize bytes of file, or fewer if the
+// file is shorter.
+func readHeader(file io.ReaderAt) []byte {
+	header := make([]byte, encHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	return header[:n]
+}
+
+// segmentNonce is the segment's index followed by a flag marking the last
+// segment, so reordered, dropped or truncated segments fail to open.
+func segmentNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// contentSize returns the size of the content of an encrypted object of
+// storedSize bytes. Every segment but the last is full.
+func contentSize(storedSize int64) int64 {
+	n := storedSize - encHeaderSize
+	if n < encTagSize {
+		return 0
+	}
+	segments := (n + encSegmentSize + encTagSize - 1) / (encSegmentSize + encTagSize)
+	return n - segments*encTagSize
+}
+
+// encryptedStorage encrypts what is written to the store beneath it and
+// decrypts what is read. Objects without the header, such as those stored
+// before encryption was turned on, are read as they are.
+type encryptedStorage struct {
+	Storage
+	keys *keyRing
+	// encrypt is false when encryption has been turned off but existing
+	// encrypted files must stay readable.
+	encrypt bool
+}
+
+func (s *encryptedStorage) Open(name string) (storedFile, error) {
+	raw, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	header := readHeader(raw)
+	if !isEncrypted(header) {
+		return raw, nil
+	}
+	dataKey, err := s.keys.unwrapDataKey(header)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("error opening %s: %v", name, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return &encryptedFile{raw: raw, aead: aead, segment: -1}, nil
+}
+
+func (s *encryptedStorage) Create(name string) (storageWriter, error) {
+	w, err := s.Storage.Create(name)
+	if err != nil || !s.encrypt {
+		return w, err
+	}
+	dataKey := make([]byte, encDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	header, err := s.keys.encryptionHeader(dataKey)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &encryptedWriter{w: w, aead: aead, buf: make([]byte, 0, encSegmentSize)}, nil
+}
+
+// Stat reports the content size of encrypted objects.
+func (s *encryptedStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := s.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.contentInfo(name, info), nil
+}
+
+// List reports the content size of encrypted objects. It reads the header
+// of every file listed.
+func (s *encryptedStorage) List(dir string) ([]os.FileInfo, error) {
+	infos, err := s.Storage.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		infos[i] = s.contentInfo(path.Join(dir, info.Name()), info)
+	}
+	return infos, nil
+}
+
+// contentInfo returns info with the content size of name if it is
+// encrypted.
+func (s *encryptedStorage) contentInfo(name string, info os.FileInfo) os.FileInfo {
+	if info.IsDir() || info.Size() < encHeaderSize {
+		return info
+	}
+	raw, err := s.Storage.Open(name)
+	if err != nil {
+		return info
+	}
+	defer raw.Close()
+	if !isEncrypted(readHeader(raw)) {
+		return info
+	}
+	return sizedInfo{info, contentSize(info.Size())}
+}
+
+// encryptedFile decrypts an encrypted object one segment at a time, keeping
+// the most recently used segment.
+type encryptedFile struct {
+	raw  storedFile
+	aead cipher.AEAD
+	pos  int64
+
+	mu      sync.Mutex
+	segment int64
+	plain   []byte
+	sealed  []byte
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	info, err := f.raw.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sizedInfo{info, contentSize(info.Size())}, nil
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := f.raw.Stat()
+	if err != nil {
+		return 0, err
+	}
+	storedSize := info.Size()
+	size := contentSize(storedSize)
+	lastSegment := (size - 1) / encSegmentSize
+	if size == 0 {
+		lastSegment = 0
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= size {
+			return read, io.EOF
+		}
+		index := pos / encSegmentSize
+		if index != f.segment {
+			start := encHeaderSize + index*(encSegmentSize+encTagSize)
+			length := storedSize - start
+			if length > encSegmentSize+encTagSize {
+				length = encSegmentSize + encTagSize
+			}
+			if cap(f.sealed) < int(length) {
+				f.sealed = make([]byte, encSegmentSize+encTagSize)
+			}
+			sealed := f.sealed[:length]
+			if _, err := f.raw.ReadAt(sealed, start); err != nil && err != io.EOF {
+				return read, err
+			}
+			f.segment = -1
+			f.plain, err = f.aead.Open(f.plain[:0], segmentNonce(index, index == lastSegment), sealed, nil)
+			if err != nil {
+				return read, fmt.Errorf("encrypted segment %d failed authentication", index)
+			}
+			f.segment = index
+		}
+		read += copy(p[read:], f.plain[pos-index*encSegmentSize:])
+	}
+	return read, nil
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative seek position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *encryptedFile) Close() error {
+	return f.raw.Close()
+}
+
+// encryptedWriter seals content into segments. A full segment is only
+// sealed once more data follows it, so the last segment, which carries the
+// final flag, is never empty unless the whole file is.
+type encryptedWriter struct {
+	w       storageWriter
+	aead    cipher.AEAD
+	buf     []byte
+	sealed  []byte
+	segment int64
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == encSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptedWriter) seal(final bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], segmentNonce(w.segment, final), w.buf, nil)
+	w.segment++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.sealed)
+	return err
+}
+
+func (w *encryptedWriter) Close() error {
+	if err := w.seal(true); err != nil {
+		w.w.Abort()
+		return err
+	}
+	return w.w.Close()
+}
+
+func (w *encryptedWriter) Abort() {
+	w.w.Abort()
+}
+
+// headerRewriter is implemented by stores that can overwrite the start of
+// an object in place.
+type headerRewriter interface {
+	rewriteHeader(name string, header []byte) error
+}
+
+// rotateKeys re-wraps the data key of every encrypted object with the
+// current master key. Content is not re-encrypted: only headers change,
+// in place where the store allows it. The server must not be running.
+func rotateKeys() error {
+	s := encryptionLayer()
+	if s == nil {
+		return fmt.Errorf("no master key is configured")
+	}
+	start := time.Now()
+	var rotated, current, plain, failed int
+	err := walkStore("", func(name string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+		raw, err := s.Storage.Open(name)
+		if err != nil {
+			slog.Error("Error opening file for key rotation", "file", name, "error", err)
+			failed++
+			return nil
+		}
+		header := readHeader(raw)
+		raw.Close()
+		switch {
+		case !isEncrypted(header):
+			plain++
+			return nil
+		case headerKeyID(header) == s.keys.current:
+			current++
+			return nil
+		}
+
+		dataKey, err := s.keys.unwrapDataKey(header)
+		if err == nil {
+			header, err = s.keys.encryptionHeader(dataKey)
+		}
+		if err == nil {
+			err = replaceHeader(s.Storage, name, header)
+		}
+		if err != nil {
+			slog.Error("Error rotating key", "file", name, "error", err)
+			failed++
+			return nil
+		}
+		rotated++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Re-wrapped data keys", "key", s.keys.current, "rotated", rotated, "current", current,
+		"unencrypted", plain, "failed", failed, "duration", time.Since(start).Round(time.Millisecond))
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be rotated", failed)
+	}
+	return nil
+}
+
+// replaceHeader writes a new header over an encrypted object, copying the
+// rest of it unchanged on stores that cannot write in place.
+func replaceHeader(backend Storage, name string, header []byte) error {
+	if hw, ok := backend.(headerRewriter); ok {
+		return hw.rewriteHeader(name, header)
+	}
+	raw, err := backend.Open(name)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	w, err := backend.Create(name)
+	if err != nil {
+		return err
+	}
+	rest := io.NewSectionReader(raw, encHeaderSize, 1<<62)
+	if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(header), rest)); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// addMasterKey appends a new random master key to the key file. It becomes
+// the current key the next time the server starts.
+func addMasterKey(cfg *serverConfig) (string, error) {
+	if cfg.EncryptionKeyFile == "" {
+		return "", fmt.Errorf("encryption_key_file is not set")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	id := "key-" + time.Now().UTC().Format("20060102-150405")
+	file, err := os.OpenFile(cfg.EncryptionKeyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintf(file, "%s:%s\n", id, hex.EncodeToString(key)); err != nil {
+		file.Close()
+		return "", err
+	}
+	return id, file.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"time"
+)
+
+// Frame types sent while following a file. Every follow ends with exactly
+// one followEnd frame, and the client sends exactly one cancel byte.
+const (
+	followEnd       byte = 0 // reason string follows
+	followData      byte = 1 // int32 length and bytes follow
+	followTruncated byte = 2 // file shrank or was replaced; data restarts at offset 0
+)
+
+// handleFollowFile streams the end of a file and then everything appended
+// to it until the client sends a cancel byte, like tail -f.
+func handleFollowFile(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+	var tailBytes int64
+	if err := binary.Read(reader, binary.LittleEndian, &tailBytes); err != nil {
+		return fmt.Errorf("error reading tail length: %v", err)
+	}
+
+	if !validFileName(fileName) {
+		logFor(conn).Warn("Invalid filename in follow request", "file", fileName)
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+
+	filePath := path.Join(username, fileName)
+	file, err := openStoredFile(filePath)
+	if err != nil {
+		logFor(conn).Warn("Follow of unavailable file", "file", fileName, "error", err)
+		return sendStatus(conn, statusError, fmt.Sprintf("File %s does not exist", fileName))
+	}
+	defer func() { file.Close() }()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		sendStatus(conn, statusError, "Error checking file")
+		return fmt.Errorf("error checking file: %v", err)
+	}
+
+	data, start, err := readViewRange(file, fileInfo.Size(), viewRequest{mode: viewTail, length: tailBytes})
+	if err != nil {
+		sendStatus(conn, statusError, "Error reading file")
+		return fmt.Errorf("error reading file: %v", err)
+	}
+	position := start + int64(len(data))
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	if err := sendFollowData(conn, data); err != nil {
+		return err
+	}
+	logFor(conn).Info("Following file", "file", fileName, "offset", start)
+
+	// The idle deadline does not apply while following; the session stays
+	// open until the client cancels or the file stops growing.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("error clearing read deadline: %v", err)
+	}
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := reader.ReadByte()
+		cancelled <- err
+	}()
+
+	endReason := ""
+	endFollow := func(reason string) error {
+		endReason = reason
+		if _, err := conn.Write([]byte{followEnd}); err != nil {
+			return fmt.Errorf("error sending end frame: %v", err)
+		}
+		return writeString(conn, reason)
+	}
+
+	cfg := currentConfig()
+	ticker := time.NewTicker(cfg.FollowPollInterval)
+	defer ticker.Stop()
+	lastGrowth := time.Now()
+	buf := getTransferBuffer()
+	defer putTransferBuffer(buf)
+	// A follow with no new data for the session's idle timeout ends; zero
+	// follows until the client cancels.
+	timeout := sessionIdleTimeout(username)
+
+	for endReason == "" {
+		select {
+		case err := <-cancelled:
+			if err != nil {
+				return fmt.Errorf("error reading cancel request: %v", err)
+			}
+			if err := endFollow("cancelled"); err != nil {
+				return err
+			}
+			logFor(conn).Info("Stopped following file", "file", fileName)
+			return nil
+
+		case <-ticker.C:
+		}
+
+		pathInfo, err := store.Stat(filePath)
+		if err != nil {
+			if err := endFollow("file was deleted"); err != nil {
+				return err
+			}
+			break
+		}
+		openInfo, err := fileIdentity(file)
+		if err != nil {
+			return fmt.Errorf("error checking followed file: %v", err)
+		}
+
+		// A log rotated away under the same name is followed from its start
+		if !sameObject(pathInfo, openInfo) {
+			newFile, err := openStoredFile(filePath)
+			if err != nil {
+				continue
+			}
+			file.Close()
+			file = newFile
+			position = -1
+		}
+		contentInfo, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("error checking followed file: %v", err)
+		}
+		if contentInfo.Size() < position || position < 0 {
+			if _, err := conn.Write([]byte{followTruncated}); err != nil {
+				return fmt.Errorf("error sending truncation frame: %v", err)
+			}
+			position = 0
+		}
+
+		for position < contentInfo.Size() {
+			n, err := file.ReadAt(*buf, position)
+			if n > 0 {
+				if err := sendFollowData(conn, (*buf)[:n]); err != nil {
+					return err
+				}
+				position += int64(n)
+				lastGrowth = time.Now()
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading followed file: %v", err)
+			}
+		}
+
+		if draining.Load() {
+			if err := endFollow(shutdownMessage); err != nil {
+				return err
+			}
+		} else if timeout > 0 && time.Since(lastGrowth) > timeout {
+			if err := endFollow(fmt.Sprintf("no new data for %s", timeout)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The server ended the follow; wait for the client's cancel byte so it
+	// is not mistaken for the next operation.
+	if err := <-cancelled; err != nil {
+		return fmt.Errorf("error reading cancel request: %v", err)
+	}
+	logFor(conn).Info("Follow ended", "file", fileName, "reason", endReason)
+	return nil
+}
+
+func sendFollowData(conn net.Conn, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := conn.Write([]byte{followData}); err != nil {
+		return fmt.Errorf("error sending data frame: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(data))); err != nil {
+		return fmt.Errorf("error sending data length: %v", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("error sending data: %v", err)
+	}
+	return nil
+}
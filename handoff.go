@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// A restart hands the listening socket to a new server process, so the
+// port never closes: the old process starts the new one with the socket,
+// waits until it accepts connections and then drains like a shutdown. The
+// two run side by side until the old one has exited.
+//
+// Each process keeps its own chunk reference counts, and a new process
+// cannot see chunks the old one stores after it started. So while
+// overlapping is set the new process stores uploads without deduplicating
+// them and leaves chunks whose count drops to zero in place. Once the old
+// process is gone it counts references again and removes those chunks.
+var overlapping atomic.Bool
+
+// handedOff is set in the old process once a new one has taken over.
+var handedOff atomic.Bool
+
+const restartMessage = "Server is restarting; reconnect to continue"
+
+// dedupActive reports whether new uploads are deduplicated.
+func dedupActive() bool {
+	return currentConfig().DedupEnabled && !overlapping.Load()
+}
+
+// finishHandoff runs once the process that handed over the listener has
+// exited.
+func finishHandoff() {
+	slog.Info("Previous server process has exited; counting chunk references again")
+	loadChunkRefs(true)
+	overlapping.Store(false)
+}
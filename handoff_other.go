@@ -0,0 +1,31 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Listener handoff is not implemented on this platform; restarts stop and
+// start the server.
+var restartSignals []os.Signal
+
+func isRestartSignal(sig os.Signal) bool {
+	return false
+}
+
+func handedOver() bool {
+	return false
+}
+
+func openListener(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func reportReady() {}
+
+func handOff() error {
+	return errors.New("restarts with a listener handoff are not supported on this platform")
+}
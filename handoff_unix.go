@@ -0,0 +1,143 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Environment variables through which a server passes its successor the
+// descriptors of the listening socket and of the pipe the successor reports
+// readiness on.
+const (
+	listenFDEnv = "DFTP_LISTEN_FD"
+	readyFDEnv  = "DFTP_READY_FD"
+)
+
+// handoffTimeout is how long a new process has to start accepting
+// connections before the restart is abandoned.
+const handoffTimeout = time.Minute
+
+// restartSignals trigger a restart with a listener handoff.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+func isRestartSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// handedOver reports whether this process was started by a handoff.
+func handedOver() bool {
+	return os.Getenv(listenFDEnv) != ""
+}
+
+// openListener takes over the listener handed over by a predecessor, or
+// listens on address.
+func openListener(address string) (net.Listener, error) {
+	if !handedOver() {
+		return net.Listen("tcp", address)
+	}
+	f, err := inheritedFile(listenFDEnv, "listener")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func inheritedFile(env, name string) (*os.File, error) {
+	fd, err := strconv.Atoi(os.Getenv(env))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", env, err)
+	}
+	os.Unsetenv(env)
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// reportReady tells the predecessor, if any, that this process accepts
+// connections, and waits in the background for the predecessor to exit.
+func reportReady() {
+	if os.Getenv(readyFDEnv) == "" {
+		return
+	}
+	f, err := inheritedFile(readyFDEnv, "ready")
+	if err != nil {
+		slog.Error("Error reporting readiness", "error", err)
+		return
+	}
+	f.Write([]byte("ready\n"))
+	f.Close()
+
+	// The predecessor is the parent; when it exits this process is
+	// reparented
+	parent := os.Getppid()
+	go func() {
+		for os.Getppid() == parent {
+			time.Sleep(time.Second)
+		}
+		finishHandoff()
+	}()
+}
+
+// handOff starts a new server process from the current executable with the
+// same arguments, passes it the listener and waits until it accepts
+// connections. The executable is looked up again, so a new binary
+// installed at the same path is the one started.
+func handOff() error {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("listener cannot be handed over")
+	}
+	listenFile, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer listenFile.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyWrite.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// ExtraFiles become descriptors 3, 4, ... in the new process
+	cmd.ExtraFiles = []*os.File{listenFile, readyWrite}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	// The pipe reads EOF if the new process exits before it is ready
+	ready := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(readyRead, make([]byte, len("ready\n")))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(handoffTimeout):
+		err = fmt.Errorf("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new server process %d did not start: %v", cmd.Process.Pid, err)
+	}
+	slog.Info("Handed the listener over to new server process", "pid", cmd.Process.Pid)
+	return nil
+}
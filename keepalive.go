@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Sessions are closed, with a notice, after idle_timeout without an
+// operation; a per-user idle_timeout overrides it and zero keeps sessions
+// open. Within an operation the same timeout applies to each read and
+// write, so a client that stops sending or reading mid-transfer does not
+// hold the session, or a worker, forever. Pings do not count as activity: they keep the connection alive
+// through NAT and firewalls and let the client notice a dead connection
+// early. The reply to a ping tells the client how long the session may stay
+// idle and, within idle_warning of the timeout, carries a warning for the
+// user.
+const opPing byte = 27
+
+// sessionIdleTimeout returns how long a session of username may stay idle,
+// zero for no limit.
+func sessionIdleTimeout(username string) time.Duration {
+	if value := lookupAccount(username).option("idle_timeout"); value != "" {
+		if d, err := parseAge(value); err == nil {
+			return d
+		} else {
+			slog.Warn("Ignoring invalid idle_timeout", "user", username, "value", value, "error", err)
+		}
+	}
+	return currentConfig().IdleTimeout
+}
+
+// idle marks the session as waiting for its next operation and sets how
+// long it may wait: until its idle timeout, or drainIdle while the server
+// is draining.
+func (s *session) idle() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy && s.opType != opPing {
+		s.lastActive = time.Now()
+	}
+	s.busy = false
+	s.conn.SetWriteDeadline(time.Time{})
+	if draining.Load() {
+		return s.conn.SetReadDeadline(time.Now().Add(drainIdle))
+	}
+	timeout := sessionIdleTimeout(s.username)
+	if timeout == 0 {
+		return s.conn.SetReadDeadline(time.Time{})
+	}
+	return s.conn.SetReadDeadline(s.lastActive.Add(timeout))
+}
+
+// begin marks the session busy with opType. It returns false if the server
+// is draining and the operation would start something new.
+func (s *session) begin(opType byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if draining.Load() && !continuesTransfer(opType) {
+		return false
+	}
+	s.busy = true
+	s.opType = opType
+	if opType != opPing {
+		s.lastActive = time.Now()
+	}
+	deadline := s.operationDeadline()
+	s.conn.SetReadDeadline(deadline)
+	s.conn.SetWriteDeadline(deadline)
+	return true
+}
+
+// operationDeadline returns when a read or write within an operation of the
+// session times out: its idle timeout from now, or never if that is zero.
+func (s *session) operationDeadline() time.Time {
+	timeout := sessionIdleTimeout(s.username)
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// connDeadline is operationDeadline for the session of conn. Connections
+// without a session use the configured idle_timeout.
+func connDeadline(conn net.Conn) time.Time {
+	if c, ok := conn.(*throttledConn); ok {
+		return c.s.operationDeadline()
+	}
+	if timeout := currentConfig().IdleTimeout; timeout > 0 {
+		return time.Now().Add(timeout)
+	}
+	return time.Time{}
+}
+
+// extendReadDeadline lets the next read on conn wait for the idle timeout.
+func extendReadDeadline(conn net.Conn) {
+	conn.SetReadDeadline(connDeadline(conn))
+}
+
+// extendWriteDeadline lets the next write on conn wait for the idle timeout.
+func extendWriteDeadline(conn net.Conn) {
+	conn.SetWriteDeadline(connDeadline(conn))
+}
+
+// idleFor returns how long the session has been without an operation.
+func (s *session) idleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive)
+}
+
+// handlePing answers a ping with statusOK, the seconds left before the
+// session is closed for being idle (int32, -1 for never) and a warning,
+// empty unless the timeout is near.
+func handlePing(conn net.Conn, s *session) error {
+	left := int32(-1)
+	warning := ""
+	if timeout := sessionIdleTimeout(s.username); timeout > 0 {
+		remaining := timeout - s.idleFor()
+		if remaining < 0 {
+			remaining = 0
+		}
+		left = int32(remaining / time.Second)
+		if remaining <= currentConfig().IdleWarning {
+			warning = fmt.Sprintf("The session will be closed in %s unless you run an operation", remaining.Round(time.Second))
+		}
+	}
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.LittleEndian, left); err != nil {
+		return err
+	}
+	return writeString(conn, warning)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// The server logs through log/slog, as text or JSON lines, to stderr or to
+// a rotating file. Messages logged while a session runs an operation carry
+// the session and request IDs and the user, so they can be matched with
+// each other and with the audit log. The level can be changed with a
+// config reload; the rest is read at startup.
+
+var logLevel slog.LevelVar
+
+// setupLogging makes the configured handler the default logger.
+func setupLogging(cfg *serverConfig) error {
+	var w io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		f, err := openRotatingFile(cfg.LogFile, cfg.LogMaxSize, cfg.LogRotateInterval, cfg.LogKeep)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	logLevel.Set(cfg.LogLevel)
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var h slog.Handler
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs an error that keeps the server from starting and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// startRequest numbers the operation the session is about to run and
+// opens its audit record.
+func (s *session) startRequest(opType byte) {
+	s.requests++
+	s.request = fmt.Sprintf("%s.%d", s.id, s.requests)
+	s.log = s.sessionLog.With("request", s.request)
+	s.startAudit(opType)
+}
+
+// logFor returns the logger of the operation running on conn, or the
+// default logger for connections without a session.
+func logFor(conn net.Conn) *slog.Logger {
+	if c, ok := conn.(*throttledConn); ok {
+		return c.s.log
+	}
+	return slog.Default()
+}
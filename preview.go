@@ -0,0 +1,409 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Preview kinds. Tables are sent as rows of cells with the header first;
+// text is sent as a single string.
+const (
+	previewText  byte = 0
+	previewTable byte = 1
+)
+
+const maxPreviewCell = 60
+
+type preview struct {
+	kind  byte
+	title string
+	rows  [][]string
+	text  string
+}
+
+func handlePreviewFile(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+
+	if !validFileName(fileName) {
+		logFor(conn).Warn("Invalid filename in preview request", "file", fileName)
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "a preview")
+	}
+	defer worker()
+
+	file, err := openStoredFile(path.Join(username, fileName))
+	if err != nil {
+		logFor(conn).Warn("Preview of unavailable file", "file", fileName, "error", err)
+		return sendStatus(conn, statusError, fmt.Sprintf("File %s does not exist", fileName))
+	}
+	defer file.Close()
+
+	p, err := buildPreview(file, fileName)
+	if err != nil {
+		logFor(conn).Error("Error previewing file", "file", fileName, "error", err)
+		return sendStatus(conn, statusError, fmt.Sprintf("Cannot preview %s: %v", fileName, err))
+	}
+
+	if _, err := conn.Write([]byte{statusOK, p.kind}); err != nil {
+		return fmt.Errorf("error sending preview status: %v", err)
+	}
+	if err := writeString(conn, p.title); err != nil {
+		return fmt.Errorf("error sending preview title: %v", err)
+	}
+	if p.kind == previewText {
+		if err := writeString(conn, p.text); err != nil {
+			return fmt.Errorf("error sending preview text: %v", err)
+		}
+	} else {
+		if err := binary.Write(conn, binary.LittleEndian, int32(len(p.rows))); err != nil {
+			return fmt.Errorf("error sending row count: %v", err)
+		}
+		for _, row := range p.rows {
+			if err := binary.Write(conn, binary.LittleEndian, int32(len(row))); err != nil {
+				return fmt.Errorf("error sending cell count: %v", err)
+			}
+			for _, cell := range row {
+				if err := writeString(conn, cell); err != nil {
+					return fmt.Errorf("error sending cell: %v", err)
+				}
+			}
+		}
+	}
+
+	logFor(conn).Info("Previewed file", "file", fileName, "preview", p.title)
+	return nil
+}
+
+// buildPreview picks a preview format from the file extension, falling back
+// to sniffing the first bytes and finally to a plain text head.
+func buildPreview(file storedFile, fileName string) (*preview, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(fileName)
+
+	switch {
+	case strings.HasSuffix(name, ".csv"):
+		return previewDelimited(file, ',', "CSV")
+	case strings.HasSuffix(name, ".tsv"), strings.HasSuffix(name, ".tab"):
+		return previewDelimited(file, '\t', "TSV")
+	case strings.HasSuffix(name, ".json"):
+		return previewJSON(file, false)
+	case strings.HasSuffix(name, ".zip"), strings.HasSuffix(name, ".jar"):
+		return previewZip(file, info.Size())
+	case strings.HasSuffix(name, ".tar"):
+		return previewTar(file, false)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return previewTar(file, true)
+	}
+
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return previewZip(file, info.Size())
+	case len(head) > 262 && string(head[257:262]) == "ustar":
+		return previewTar(file, false)
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		if p, err := previewTar(file, true); err == nil {
+			return p, nil
+		}
+	}
+	if p, err := previewImage(file, info.Size()); err == nil {
+		return p, nil
+	}
+	if trimmed := bytes.TrimSpace(head); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		if p, err := previewJSON(file, true); err == nil {
+			return p, nil
+		}
+	}
+
+	data, start, err := readViewRange(file, info.Size(), viewRequest{mode: viewHead})
+	if err != nil {
+		return nil, err
+	}
+	encoding, bomLen := fileEncoding(file)
+	content, encoding := decodeForView(data, start, encoding, bomLen, viewHead)
+	return &preview{kind: previewText, title: fmt.Sprintf("First %d bytes (%s)", len(data), encoding), text: string(content)}, nil
+}
+
+func rewind(file storedFile) error {
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+// truncateCell collapses whitespace in cell and shortens it to at most
+// maxPreviewCell bytes, without splitting a UTF-8 sequence.
+func truncateCell(cell string) string {
+	cell = strings.Join(strings.Fields(cell), " ")
+	if len(cell) > maxPreviewCell {
+		cut := maxPreviewCell - 3
+		for cut > 0 && !utf8.RuneStart(cell[cut]) {
+			cut--
+		}
+		return cell[:cut] + "..."
+	}
+	return cell
+}
+
+func previewDelimited(file storedFile, comma rune, format string) (*preview, error) {
+	if err := rewind(file); err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	maxRows := currentConfig().PreviewRows
+	var rows [][]string
+	for len(rows) <= maxRows {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(rows) == 0 {
+				return nil, err
+			}
+			break
+		}
+		row := make([]string, len(record))
+		for i, cell := range record {
+			row[i] = truncateCell(cell)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return &preview{kind: previewText, title: format + " (empty)"}, nil
+	}
+	return &preview{kind: previewTable, title: fmt.Sprintf("%s, header and first %d rows", format, len(rows)-1), rows: rows}, nil
+}
+
+// previewJSON pretty-prints a JSON document token by token, so files far
+// larger than the preview limit can be shown without loading them fully.
+// With strict set, any syntax error fails the preview instead of showing the
+// valid prefix; that is used when the format was only guessed.
+func previewJSON(file storedFile, strict bool) (*preview, error) {
+	if err := rewind(file); err != nil {
+		return nil, err
+	}
+	limit := int(currentConfig().PreviewTextBytes)
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	decoder.UseNumber()
+
+	var out strings.Builder
+	// Each open container records whether it is an object and how many
+	// values it has seen so far.
+	type container struct {
+		object bool
+		count  int
+	}
+	var stack []container
+	expectValue := false
+	truncated := false
+
+	for out.Len() < limit {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if strict || out.Len() == 0 {
+				return nil, err
+			}
+			truncated = true
+			break
+		}
+
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			closed := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if closed.count > 0 {
+				out.WriteString("\n" + strings.Repeat("  ", len(stack)))
+			}
+			out.WriteRune(rune(delim))
+			continue
+		}
+
+		if expectValue {
+			out.WriteString(": ")
+			expectValue = false
+		} else if len(stack) == 0 && out.Len() > 0 {
+			// Concatenated documents, e.g. JSON Lines
+			out.WriteString("\n")
+		} else if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.count > 0 {
+				out.WriteString(",")
+			}
+			top.count++
+			out.WriteString("\n" + strings.Repeat("  ", len(stack)))
+			if top.object {
+				writeJSONValue(&out, token)
+				expectValue = true
+				continue
+			}
+		}
+
+		switch v := token.(type) {
+		case json.Delim:
+			out.WriteRune(rune(v))
+			stack = append(stack, container{object: v == '{'})
+		default:
+			writeJSONValue(&out, v)
+		}
+	}
+
+	title := "JSON"
+	if truncated || len(stack) > 0 || out.Len() >= limit {
+		out.WriteString("\n... (truncated)")
+		title = fmt.Sprintf("JSON, first %d bytes pretty-printed", limit)
+	}
+	return &preview{kind: previewText, title: title, text: out.String()}, nil
+}
+
+// writeJSONValue writes a scalar token as JSON without escaping <, > and &,
+// which json.Marshal does for HTML safety.
+func writeJSONValue(out *strings.Builder, v interface{}) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+	out.Write(bytes.TrimRight(buf.Bytes(), "\n"))
+}
+
+func previewZip(file storedFile, size int64) (*preview, error) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, err
+	}
+	maxRows := currentConfig().PreviewRows
+	rows := [][]string{{"Name", "Size", "Compressed", "Modified"}}
+	for _, member := range archive.File {
+		if len(rows) > maxRows {
+			break
+		}
+		rows = append(rows, []string{
+			truncateCell(member.Name),
+			fmt.Sprintf("%d", member.UncompressedSize64),
+			fmt.Sprintf("%d", member.CompressedSize64),
+			member.Modified.Format("2006-01-02 15:04:05"),
+		})
+	}
+	return &preview{
+		kind:  previewTable,
+		title: fmt.Sprintf("ZIP archive, %d members (showing %d)", len(archive.File), len(rows)-1),
+		rows:  rows,
+	}, nil
+}
+
+func previewTar(file storedFile, gzipped bool) (*preview, error) {
+	if err := rewind(file); err != nil {
+		return nil, err
+	}
+	var r io.Reader = file
+	if gzipped {
+		gz, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	archive := tar.NewReader(r)
+	maxRows := currentConfig().PreviewRows
+	rows := [][]string{{"Name", "Size", "Mode", "Modified"}}
+	more := false
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(rows) == 1 {
+				return nil, err
+			}
+			break
+		}
+		if len(rows) > maxRows {
+			more = true
+			break
+		}
+		rows = append(rows, []string{
+			truncateCell(header.Name),
+			fmt.Sprintf("%d", header.Size),
+			os.FileMode(header.Mode).String(),
+			header.ModTime.Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	title := fmt.Sprintf("TAR archive, %d members", len(rows)-1)
+	if gzipped {
+		title = "Gzipped " + title
+	}
+	if more {
+		title += " (more not shown)"
+	}
+	return &preview{kind: previewTable, title: title, rows: rows}, nil
+}
+
+func previewImage(file storedFile, size int64) (*preview, error) {
+	if err := rewind(file); err != nil {
+		return nil, err
+	}
+	config, format, err := image.DecodeConfig(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	info, _ := file.Stat()
+	rows := [][]string{
+		{"Property", "Value"},
+		{"Format", strings.ToUpper(format)},
+		{"Width", fmt.Sprintf("%d px", config.Width)},
+		{"Height", fmt.Sprintf("%d px", config.Height)},
+		{"Color model", colorModelName(config)},
+		{"File size", fmt.Sprintf("%d bytes", size)},
+	}
+	if info != nil {
+		rows = append(rows, []string{"Modified", info.ModTime().Format(time.RFC3339)})
+	}
+	return &preview{kind: previewTable, title: strings.ToUpper(format) + " image", rows: rows}, nil
+}
+
+func colorModelName(config image.Config) string {
+	if config.ColorModel == nil {
+		return "unknown"
+	}
+	// Convert a sample color and report the concrete type, e.g. color.RGBA
+	return strings.TrimPrefix(fmt.Sprintf("%T", config.ColorModel.Convert(image.Black.C)), "color.")
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateCell(t *testing.T) {
+	if got := truncateCell(" a \t b\n"); got != "a b" {
+		t.Errorf("truncateCell collapsed whitespace to %q", got)
+	}
+	for _, r := range []string{"é", "€", "😀"} {
+		for pad := 0; pad < len(r); pad++ {
+			cell := strings.Repeat("a", maxPreviewCell-3-pad) + strings.Repeat(r, 10)
+			got := truncateCell(cell)
+			if !utf8.ValidString(got) || len(got) > maxPreviewCell || !strings.HasPrefix(cell, strings.TrimSuffix(got, "...")) {
+				t.Errorf("truncateCell with %d bytes before %q = %q", maxPreviewCell-3-pad, r, got[len(got)-8:])
+			}
+		}
+	}
+}
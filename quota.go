@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// quotaLimits are a user's storage limits. Zero means unlimited.
+type quotaLimits struct {
+	Bytes int64
+	Files int64
+}
+
+type quotaUsage struct {
+	Bytes int64
+	Files int64
+}
+
+// errQuotaExceeded is returned by reserveUpload when an upload would take
+// the user over quota.
+type errQuotaExceeded struct {
+	msg string
+}
+
+func (e *errQuotaExceeded) Error() string { return e.msg }
+
+var (
+	quotaMu sync.Mutex
+	// inFlight holds the declared size of every upload that has been
+	// accepted but not finished, by user and file name.
+	inFlight = make(map[string]map[string]int64)
+)
+
+// quotaFor returns the user's limits: per-user settings from the
+// credentials file override the server-wide defaults.
+func quotaFor(username string) quotaLimits {
+	cfg := currentConfig()
+	limits := quotaLimits{Bytes: cfg.QuotaBytes, Files: cfg.QuotaFiles}
+	account := lookupAccount(username)
+
+	if value := account.option("quota_bytes"); value != "" {
+		if n, err := parseLimit(value, parseSize); err == nil {
+			limits.Bytes = n
+		} else {
+			slog.Warn("Ignoring invalid quota_bytes", "user", username, "value", value, "error", err)
+		}
+	}
+	if value := account.option("quota_files"); value != "" {
+		if n, err := parseLimit(value, func(v string) (int64, error) { return strconv.ParseInt(v, 10, 64) }); err == nil {
+			limits.Files = n
+		} else {
+			slog.Warn("Ignoring invalid quota_files", "user", username, "value", value, "error", err)
+		}
+	}
+	return limits
+}
+
+// parseLimit parses a quota value, accepting "unlimited" for zero.
+func parseLimit(value string, parse func(string) (int64, error)) (int64, error) {
+	if strings.EqualFold(value, "unlimited") {
+		return 0, nil
+	}
+	n, err := parse(value)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("limit must not be negative")
+	}
+	return n, err
+}
+
+// userUsage adds up the files in the user's directory. Files named in skip
+// are left out. Previous versions and trashed files count towards the bytes
+// used but not the file count, since the user cannot upload over them.
+func userUsage(username string, skip map[string]int64) (quotaUsage, error) {
+	var usage quotaUsage
+	entries, err := store.List(username)
+	if err != nil {
+		return usage, err
+	}
+	for _, entry := range entries {
+		if _, ok := skip[entry.Name()]; ok || entry.IsDir() {
+			continue
+		}
+		info, err := statStoredFile(path.Join(username, entry.Name()))
+		if err != nil {
+			continue
+		}
+		usage.Bytes += info.Size()
+		usage.Files++
+	}
+	for _, dir := range []string{path.Join(versionsDirName, username), trashDir(username)} {
+		held, err := heldBytes(dir)
+		if err != nil {
+			return usage, err
+		}
+		usage.Bytes += held
+	}
+	return usage, nil
+}
+
+// heldBytes adds up the stored files under dir, leaving out trash metadata.
+func heldBytes(dir string) (int64, error) {
+	var total int64
+	err := walkStore(dir, func(name string, info os.FileInfo) error {
+		if info.IsDir() || strings.HasSuffix(name, ".json") {
+			return nil
+		}
+		if info, err := statStoredFile(name); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return total, err
+}
+
+// currentUsage returns on-disk usage with in-flight uploads counted at their
+// declared size.
+func currentUsage(username string) (quotaUsage, error) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	return usageLocked(username)
+}
+
+func usageLocked(username string) (quotaUsage, error) {
+	pending := inFlight[username]
+	usage, err := userUsage(username, pending)
+	if err != nil {
+		return usage, err
+	}
+	for _, size := range pending {
+		usage.Bytes += size
+		usage.Files++
+	}
+	return usage, nil
+}
+
+// totalInFlight returns the declared bytes of all uploads in progress.
+func totalInFlight() int64 {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	var total int64
+	for _, files := range inFlight {
+		for _, size := range files {
+			total += size
+		}
+	}
+	return total
+}
+
+// reserveUpload checks an upload of fileSize bytes against the user's quota
+// and reserves the space until release is called. Uploading over an existing
+// file only counts the difference in size, unless the old copy is kept as a
+// version.
+func reserveUpload(username, fileName string, fileSize int64) (release func(), err error) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	if _, busy := inFlight[username][fileName]; busy {
+		return nil, fmt.Errorf("file %s is already being uploaded", fileName)
+	}
+
+	usage, err := usageLocked(username)
+	if err != nil {
+		return nil, err
+	}
+	newFiles := usage.Files + 1
+	newBytes := usage.Bytes + fileSize
+	if info, err := statStoredFile(path.Join(username, fileName)); err == nil {
+		newFiles--
+		// A replaced file is kept as a version when versioning is on
+		if keep, _ := versionPolicy(username); keep == 0 {
+			newBytes -= info.Size()
+		}
+	}
+
+	limits := quotaFor(username)
+	// Checking fileSize on its own first keeps a huge declared size from
+	// overflowing newBytes past the limit
+	if limits.Bytes > 0 && (fileSize > limits.Bytes || newBytes > limits.Bytes) {
+		return nil, &errQuotaExceeded{fmt.Sprintf("Quota exceeded: upload needs %d bytes, %d of %d bytes in use",
+			fileSize, usage.Bytes, limits.Bytes)}
+	}
+	if limits.Files > 0 && newFiles > limits.Files {
+		return nil, &errQuotaExceeded{fmt.Sprintf("Quota exceeded: %d of %d files in use", usage.Files, limits.Files)}
+	}
+
+	if inFlight[username] == nil {
+		inFlight[username] = make(map[string]int64)
+	}
+	inFlight[username][fileName] = fileSize
+	return func() {
+		quotaMu.Lock()
+		delete(inFlight[username], fileName)
+		if len(inFlight[username]) == 0 {
+			delete(inFlight, username)
+		}
+		quotaMu.Unlock()
+	}, nil
+}
+
+// handleQuotaQuery sends the user's usage followed by their limits, each as
+// bytes and file count (int64). A limit of 0 means unlimited.
+func handleQuotaQuery(conn net.Conn, username string) error {
+	usage, err := currentUsage(username)
+	if err != nil {
+		return fmt.Errorf("error computing usage: %v", err)
+	}
+	limits := quotaFor(username)
+
+	for _, v := range []int64{usage.Bytes, usage.Files, limits.Bytes, limits.Files} {
+		if err := binary.Write(conn, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("error sending quota: %v", err)
+		}
+	}
+	logFor(conn).Debug("Queried quota", "bytes", usage.Bytes, "files", usage.Files)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestUserUsage(t *testing.T) {
+	saved := store
+	store = newMemoryStorage()
+	defer func() { store = saved }()
+
+	for name, size := range map[string]int{
+		"alice/a.txt":             10,
+		"alice/b.txt":             20,
+		".versions/alice/a.txt/1": 5,
+		".trash/alice/2":          7,
+		".trash/alice/2.json":     100,
+		"bob/c.txt":               1000,
+		".versions/bob/c.txt/3":   1000,
+		".trash/bob/4":            1000,
+	} {
+		if err := writeObject(name, []byte(strings.Repeat("x", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := userUsage("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (quotaUsage{Bytes: 42, Files: 2}); usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+
+	usage, err = userUsage("alice", map[string]int64{"b.txt": 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (quotaUsage{Bytes: 22, Files: 1}); usage != want {
+		t.Errorf("usage skipping b.txt = %+v, want %+v", usage, want)
+	}
+
+	// Users without versions or trash
+	if err := writeObject("carol/d.txt", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = userUsage("carol", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (quotaUsage{Bytes: 3, Files: 1}); usage != want {
+		t.Errorf("usage without history = %+v, want %+v", usage, want)
+	}
+}
+
+func TestReserveUploadHugeSize(t *testing.T) {
+	saved, savedConfig := store, currentConfig()
+	store = newMemoryStorage()
+	cfg := *savedConfig
+	cfg.QuotaBytes = 1 << 20
+	activeConfig.Store(&cfg)
+	defer func() {
+		store = saved
+		activeConfig.Store(savedConfig)
+	}()
+
+	if err := writeObject("alice/a.txt", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	release, err := reserveUpload("alice", "big.bin", math.MaxInt64)
+	if _, ok := err.(*errQuotaExceeded); !ok {
+		if release != nil {
+			release()
+		}
+		t.Fatalf("reserveUpload of MaxInt64 bytes = %v, want quota exceeded", err)
+	}
+}
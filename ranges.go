@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sync"
+)
+
+// Parallel transfers split a large file into parts that the client sends
+// or fetches over several connections at once. A ranged upload is begun on
+// one connection, which gets an id for it. Each part can then be sent on
+// any of the user's connections, and the upload is finished on the
+// connection that began it. Parts are kept as separate staging objects, so
+// they can arrive in any order on any backend, and are joined into the
+// file when it is finished.
+const (
+	minRangePartSize = 1 << 20
+	maxRangeParts    = 1 << 16
+)
+
+// rangedUpload is a ranged upload in progress.
+type rangedUpload struct {
+	id       string
+	username string
+	fileName string
+	size     int64
+	partSize int64
+	// owner is the connection that began the upload; it is aborted when
+	// that connection closes
+	owner   net.Conn
+	release func()
+
+	mu       sync.Mutex
+	received []bool
+	busy     []bool
+	closed   bool
+}
+
+var (
+	rangedMu      sync.Mutex
+	rangedUploads = make(map[string]*rangedUpload)
+)
+
+// part returns the offset and length of part i.
+func (u *rangedUpload) part(i int64) (int64, int64) {
+	offset := i * u.partSize
+	length := u.partSize
+	if u.size-offset < length {
+		length = u.size - offset
+	}
+	return offset, length
+}
+
+// rangeParts returns how many parts of partSize bytes a file of fileSize
+// bytes is sent in, or 0 if either size is out of range. It is worked out
+// without overflowing for any sizes a client sends.
+func rangeParts(fileSize, partSize int64) int64 {
+	if fileSize <= 0 || partSize < minRangePartSize {
+		return 0
+	}
+	parts := fileSize / partSize
+	if fileSize%partSize != 0 {
+		parts++
+	}
+	if parts > maxRangeParts {
+		return 0
+	}
+	return parts
+}
+
+func (u *rangedUpload) partName(i int64) string {
+	return path.Join(stagingDirName, u.username, fmt.Sprintf("%s.%s.part%d", u.fileName, u.id, i))
+}
+
+// close stops the upload taking parts and removes those received.
+func (u *rangedUpload) close() {
+	u.mu.Lock()
+	u.closed = true
+	received := append([]bool(nil), u.received...)
+	u.mu.Unlock()
+	for i, ok := range received {
+		if ok {
+			store.Remove(u.partName(int64(i)))
+		}
+	}
+	u.release()
+}
+
+// takeRangedUpload removes the upload id begun on conn from the table.
+func takeRangedUpload(id string, conn net.Conn) *rangedUpload {
+	rangedMu.Lock()
+	defer rangedMu.Unlock()
+	u := rangedUploads[id]
+	if u == nil || u.owner != conn {
+		return nil
+	}
+	delete(rangedUploads, id)
+	return u
+}
+
+// abortRangedUploads abandons the ranged uploads begun on conn.
+func abortRangedUploads(conn net.Conn) {
+	rangedMu.Lock()
+	var abandoned []*rangedUpload
+	for id, u := range rangedUploads {
+		if u.owner == conn {
+			abandoned = append(abandoned, u)
+			delete(rangedUploads, id)
+		}
+	}
+	rangedMu.Unlock()
+	for _, u := range abandoned {
+		logFor(conn).Info("Abandoned ranged upload", "file", u.fileName)
+		u.close()
+	}
+}
+
+// handleBeginRangedUpload checks a ranged upload against the quota and free
+// space and replies with the id its parts are sent with.
+func handleBeginRangedUpload(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+	var fileSize, partSize int64
+	if err := binary.Read(reader, binary.LittleEndian, &fileSize); err != nil {
+		return fmt.Errorf("error reading file size: %v", err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &partSize); err != nil {
+		return fmt.Errorf("error reading part size: %v", err)
+	}
+	parts := rangeParts(fileSize, partSize)
+	if !validFileName(fileName) || parts == 0 {
+		logFor(conn).Warn("Rejected ranged upload", "file", fileName, "bytes", fileSize)
+		return sendStatus(conn, statusError, "Invalid file name, size or part size")
+	}
+	if status, msg := checkUploadSpace(fileSize); status != statusOK {
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "reason", msg)
+		return sendStatus(conn, status, msg)
+	}
+	release, err := reserveUpload(username, fileName, fileSize)
+	if err != nil {
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "error", err)
+		if _, ok := err.(*errQuotaExceeded); ok {
+			return sendStatus(conn, statusQuotaExceeded, err.Error())
+		}
+		return sendStatus(conn, statusError, err.Error())
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		release()
+		return sendStatus(conn, statusError, "Error starting upload")
+	}
+	u := &rangedUpload{
+		id:       hex.EncodeToString(id),
+		username: username,
+		fileName: fileName,
+		size:     fileSize,
+		partSize: partSize,
+		owner:    conn,
+		release:  release,
+	}
+	u.received = make([]bool, parts)
+	u.busy = make([]bool, parts)
+	rangedMu.Lock()
+	rangedUploads[u.id] = u
+	rangedMu.Unlock()
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending upload status: %v", err)
+	}
+	if err := writeString(conn, u.id); err != nil {
+		return fmt.Errorf("error sending upload id: %v", err)
+	}
+	logFor(conn).Info("Began ranged upload", "file", fileName, "bytes", fileSize, "parts", parts)
+	return nil
+}
+
+// handleRangedUploadPart receives one part of a ranged upload.
+func handleRangedUploadPart(reader *bufio.Reader, conn net.Conn, username string) error {
+	id, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading upload id: %v", err)
+	}
+	var index int64
+	if err := binary.Read(reader, binary.LittleEndian, &index); err != nil {
+		return fmt.Errorf("error reading part number: %v", err)
+	}
+
+	rangedMu.Lock()
+	u := rangedUploads[id]
+	rangedMu.Unlock()
+	if u == nil || u.username != username {
+		return sendStatus(conn, statusError, "No such upload")
+	}
+	auditFor(conn).setPath(u.fileName)
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "an upload part")
+	}
+	defer worker()
+	u.mu.Lock()
+	if index < 0 || index >= int64(len(u.received)) || u.received[index] || u.busy[index] {
+		u.mu.Unlock()
+		return sendStatus(conn, statusError, fmt.Sprintf("Part %d is invalid or already sent", index))
+	}
+	u.busy[index] = true
+	u.mu.Unlock()
+	done := func(received bool) {
+		u.mu.Lock()
+		u.busy[index] = false
+		u.received[index] = received && !u.closed
+		stale := received && u.closed
+		u.mu.Unlock()
+		if stale {
+			store.Remove(u.partName(index))
+		}
+	}
+
+	w, err := store.Create(u.partName(index))
+	if err != nil {
+		done(false)
+		return sendStatus(conn, statusError, "Error: Failed to create file")
+	}
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		w.Abort()
+		done(false)
+		return fmt.Errorf("error sending part status: %v", err)
+	}
+
+	_, length := u.part(index)
+	if _, err := receiveContent(conn, w, reader, length); err != nil {
+		w.Abort()
+		done(false)
+		return fmt.Errorf("error receiving part %d of %s: %v", index, u.fileName, err)
+	}
+	if err := w.Close(); err != nil {
+		done(false)
+		return sendStatus(conn, statusError, "Error: Failed to write file")
+	}
+	done(true)
+	_, err = conn.Write([]byte{statusOK})
+	return err
+}
+
+// handleFinishRangedUpload joins the parts of a ranged upload, checks the
+// result against the SHA-256 hash the client sends and commits it.
+func handleFinishRangedUpload(reader *bufio.Reader, conn net.Conn, username string) error {
+	id, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading upload id: %v", err)
+	}
+	hash := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(reader, hash); err != nil {
+		return fmt.Errorf("error reading file hash: %v", err)
+	}
+	u := takeRangedUpload(id, conn)
+	if u == nil {
+		return sendStatus(conn, statusError, "No such upload")
+	}
+	defer u.close()
+	audit := auditFor(conn)
+	audit.setPath(u.fileName)
+
+	u.mu.Lock()
+	u.closed = true
+	missing := -1
+	for i, ok := range u.received {
+		if !ok {
+			missing = i
+			break
+		}
+	}
+	u.mu.Unlock()
+	if missing >= 0 {
+		return sendStatus(conn, statusError, fmt.Sprintf("Part %d was not received", missing))
+	}
+
+	if err := joinRangedUpload(u, hash); err != nil {
+		logFor(conn).Error("Error storing ranged upload", "file", u.fileName, "error", err)
+		return sendStatus(conn, statusError, fmt.Sprintf("Failed to store file: %v", err))
+	}
+	logFor(conn).Info("File received", "file", u.fileName, "bytes", u.size, "parts", len(u.received))
+	audit.setChecksum(hash)
+	go indexUploadedFile(username, u.fileName)
+	_, err = conn.Write([]byte{statusOK})
+	return err
+}
+
+// joinRangedUpload writes the parts of u in order to a staging file and
+// commits it if it matches hash.
+func joinRangedUpload(u *rangedUpload, hash []byte) error {
+	staging, stagingName, err := createStagingFile(u.username, u.fileName)
+	if err != nil {
+		return err
+	}
+	defer staging.Abort()
+
+	hasher := sha256.New()
+	dst := io.MultiWriter(staging, hasher)
+	buf := getTransferBuffer()
+	defer putTransferBuffer(buf)
+	for i := range u.received {
+		part, err := store.Open(u.partName(int64(i)))
+		if err != nil {
+			return err
+		}
+		_, length := u.part(int64(i))
+		n, err := io.CopyBuffer(dst, io.LimitReader(part, length), *buf)
+		part.Close()
+		if err != nil {
+			return err
+		}
+		if n != length {
+			return fmt.Errorf("part %d is %d bytes, not %d", i, n, length)
+		}
+	}
+	if !bytes.Equal(hasher.Sum(nil), hash) {
+		return fmt.Errorf("content does not match its hash")
+	}
+
+	if err := staging.Close(); err != nil {
+		return err
+	}
+	if err := storeStagedContent(stagingName); err != nil {
+		store.Remove(stagingName)
+		return err
+	}
+	if err := commitFile(u.username, u.fileName, stagingName); err != nil {
+		store.Remove(stagingName)
+		return err
+	}
+	return nil
+}
+
+// handleRangedDownload sends part of a file with the file's size and
+// version, so a client fetching parts over several connections can tell
+// if the file changed in between.
+func handleRangedDownload(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+	var offset, length int64
+	if err := binary.Read(reader, binary.LittleEndian, &offset); err != nil {
+		return fmt.Errorf("error reading offset: %v", err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return fmt.Errorf("error reading length: %v", err)
+	}
+	if !validFileName(fileName) {
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "a download part")
+	}
+	defer worker()
+
+	file, err := openStoredFile(path.Join(username, fileName))
+	if err != nil {
+		return sendStatus(conn, statusError, fmt.Sprintf("File %s does not exist", fileName))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return sendStatus(conn, statusError, "Error checking file")
+	}
+	identity, err := fileIdentity(file)
+	if err != nil {
+		return sendStatus(conn, statusError, "Error checking file")
+	}
+	size := info.Size()
+	if offset < 0 || offset > size || length < 0 {
+		return sendStatus(conn, statusError, "Invalid range")
+	}
+	if size-offset < length {
+		length = size - offset
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return err
+	}
+	for _, v := range []int64{size, identity.ModTime().UnixNano(), length} {
+		if err := binary.Write(conn, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("error sending range header: %v", err)
+		}
+	}
+	if _, err := sendContent(conn, file, offset, length); err != nil {
+		return fmt.Errorf("error sending file content: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRangeParts(t *testing.T) {
+	for _, tc := range []struct {
+		fileSize, partSize, want int64
+	}{
+		{1, minRangePartSize, 1},
+		{minRangePartSize, minRangePartSize, 1},
+		{minRangePartSize + 1, minRangePartSize, 2},
+		{maxRangeParts * minRangePartSize, minRangePartSize, maxRangeParts},
+		{maxRangeParts*minRangePartSize + 1, minRangePartSize, 0},
+		{math.MaxInt64, minRangePartSize, 0},
+		{math.MaxInt64, math.MaxInt64, 1},
+		{10, math.MaxInt64, 1},
+		{0, minRangePartSize, 0},
+		{-1, minRangePartSize, 0},
+		{minRangePartSize, minRangePartSize - 1, 0},
+		{minRangePartSize, math.MinInt64, 0},
+	} {
+		if got := rangeParts(tc.fileSize, tc.partSize); got != tc.want {
+			t.Errorf("rangeParts(%d, %d) = %d, want %d", tc.fileSize, tc.partSize, got, tc.want)
+		}
+	}
+}
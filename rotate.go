@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotatingFile is a log file that is renamed to name.1 once it grows past
+// maxSize, or when a write falls in a later interval than the one before
+// (intervals count from midnight UTC), older files moving up to
+// name.<keep>; the oldest is removed. Zero maxSize or interval turns that
+// trigger off. Several processes may append to the same file during a
+// restart; when another one has rotated it, the file is reopened rather
+// than rotated again.
+type rotatingFile struct {
+	mu       sync.Mutex
+	name     string
+	maxSize  int64
+	interval time.Duration
+	keep     int
+	file     *os.File
+	size     int64
+	// last is when the file was last written
+	last time.Time
+}
+
+func openRotatingFile(name string, maxSize int64, interval time.Duration, keep int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxSize: maxSize, interval: interval, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.last = file, info.Size(), info.ModTime()
+	return nil
+}
+
+// Write appends p, which should be whole records, rotating first if p
+// would take the file past maxSize or a new interval has begun. If the file
+// cannot be rotated, p is appended anyway and rotation is tried again on
+// the next write.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize ||
+		f.interval > 0 && !now.Truncate(f.interval).Equal(f.last.Truncate(f.interval))) {
+		f.rotate()
+	}
+	f.last = now
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() {
+	current, err := f.file.Stat()
+	if err != nil {
+		return
+	}
+	named, err := os.Stat(f.name)
+	moved := err != nil || !os.SameFile(current, named)
+	f.file.Close()
+	f.file = nil
+	// Unless another process already rotated it
+	if !moved {
+		if f.keep > 0 {
+			os.Remove(fmt.Sprintf("%s.%d", f.name, f.keep))
+			for i := f.keep - 1; i > 0; i-- {
+				os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+			}
+			os.Rename(f.name, f.name+".1")
+		} else {
+			os.Remove(f.name)
+		}
+	}
+	f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
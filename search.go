@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	indexDirName = ".index"
+	// maxTokenLines caps how many line numbers are kept per token and file.
+	// Tokens past the cap fall back to scanning the whole file on search.
+	maxTokenLines  = 1000
+	maxSnippetLen  = 200
+	minTokenLength = 2
+	maxTokenLength = 64
+)
+
+// contentIndex is a per-user inverted index over the text-like files in the
+// user's upload directory.
+type contentIndex struct {
+	// Postings maps a lower-cased token to the files containing it and the
+	// 1-based line numbers it occurs on.
+	Postings map[string]map[string][]int `json:"postings"`
+	// Files records every indexed file so removal does not need to walk
+	// all postings blindly.
+	Files map[string]bool `json:"files"`
+}
+
+type searchMatch struct {
+	fileName string
+	lines    []int
+	snippets []string
+}
+
+var (
+	indexLocksMu sync.Mutex
+	// indexLocks serialise reads and writes of each user's index, so
+	// rewriting one user's index does not hold up searches by others.
+	indexLocks = make(map[string]*sync.Mutex)
+)
+
+// lockIndex locks the user's index and returns the function that unlocks
+// it.
+func lockIndex(username string) (unlock func()) {
+	indexLocksMu.Lock()
+	mu := indexLocks[username]
+	if mu == nil {
+		mu = new(sync.Mutex)
+		indexLocks[username] = mu
+	}
+	indexLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func indexPath(username string) string {
+	return path.Join(indexDirName, username+".json")
+}
+
+func newContentIndex() *contentIndex {
+	return &contentIndex{
+		Postings: make(map[string]map[string][]int),
+		Files:    make(map[string]bool),
+	}
+}
+
+func loadIndex(username string) (*contentIndex, error) {
+	data, err := readObject(indexPath(username))
+	if err != nil {
+		return nil, err
+	}
+	idx := newContentIndex()
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("error decoding index for %s: %v", username, err)
+	}
+	return idx, nil
+}
+
+func saveIndex(username string, idx *contentIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeObject(indexPath(username), data)
+}
+
+// loadOrBuildIndex loads the user's index, building it from the upload
+// directory if none exists yet (e.g. indexing was just switched on).
+// Callers must hold the user's index lock.
+func loadOrBuildIndex(username string) (*contentIndex, error) {
+	idx, err := loadIndex(username)
+	if err == nil {
+		return idx, nil
+	}
+	if !os.IsNotExist(err) {
+		slog.Warn("Rebuilding unreadable index", "user", username, "error", err)
+	}
+
+	idx = newContentIndex()
+	entries, err := store.List(username)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := idx.addFile(username, entry.Name()); err != nil {
+			slog.Error("Error indexing file", "user", username, "file", entry.Name(), "error", err)
+		}
+	}
+	if err := saveIndex(username, idx); err != nil {
+		return nil, err
+	}
+	slog.Info("Built content index", "user", username, "files", len(idx.Files))
+	return idx, nil
+}
+
+// isIndexable reports whether a file looks like text worth indexing: a known
+// extension, within the size limit, and no NUL bytes in its first block.
+func isIndexable(filePath string) bool {
+	cfg := currentConfig()
+	if !cfg.IndexExtensions[strings.ToLower(path.Ext(filePath))] {
+		return false
+	}
+	info, err := statStoredFile(filePath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > cfg.IndexMaxBytes {
+		return false
+	}
+	file, err := openStoredFile(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	buf := make([]byte, 8192)
+	n, _ := io.ReadFull(file, buf)
+	return bytes.IndexByte(buf[:n], 0) < 0
+}
+
+// addFile tokenises fileName and adds its postings, replacing any existing
+// entries for the same file. Files that are not text-like are skipped.
+func (idx *contentIndex) addFile(username, fileName string) error {
+	idx.removeFile(fileName)
+
+	filePath := path.Join(username, fileName)
+	if !isIndexable(filePath) {
+		return nil
+	}
+	file, err := openStoredFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		seen := make(map[string]bool)
+		for _, token := range tokenize(scanner.Text()) {
+			if seen[token] {
+				continue
+			}
+			seen[token] = true
+
+			files := idx.Postings[token]
+			if files == nil {
+				files = make(map[string][]int)
+				idx.Postings[token] = files
+			}
+			// One extra entry past the cap marks the list as truncated
+			if len(files[fileName]) <= maxTokenLines {
+				files[fileName] = append(files[fileName], lineNum)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		idx.removeFile(fileName)
+		return err
+	}
+	idx.Files[fileName] = true
+	return nil
+}
+
+func (idx *contentIndex) removeFile(fileName string) {
+	if !idx.Files[fileName] {
+		return
+	}
+	for token, files := range idx.Postings {
+		delete(files, fileName)
+		if len(files) == 0 {
+			delete(idx.Postings, token)
+		}
+	}
+	delete(idx.Files, fileName)
+}
+
+// tokenize splits text into lower-cased runs of letters, digits and
+// underscores, dropping very short and very long runs.
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	tokens := fields[:0]
+	for _, field := range fields {
+		if len(field) < minTokenLength || len(field) > maxTokenLength {
+			continue
+		}
+		tokens = append(tokens, strings.ToLower(field))
+	}
+	return tokens
+}
+
+// indexUploadedFile updates the user's index after an upload. It runs in its
+// own goroutine so large logs do not hold up the client.
+func indexUploadedFile(username, fileName string) {
+	if !currentConfig().IndexEnabled {
+		return
+	}
+	defer lockIndex(username)()
+
+	idx, err := loadOrBuildIndex(username)
+	if err != nil {
+		slog.Error("Error loading index", "user", username, "error", err)
+		return
+	}
+	if err := idx.addFile(username, fileName); err != nil {
+		slog.Error("Error indexing file", "user", username, "file", fileName, "error", err)
+		return
+	}
+	if err := saveIndex(username, idx); err != nil {
+		slog.Error("Error saving index", "user", username, "error", err)
+	}
+}
+
+// removeFromIndex drops a deleted file from the user's index, if one exists.
+func removeFromIndex(username, fileName string) {
+	defer lockIndex(username)()
+
+	idx, err := loadIndex(username)
+	if err != nil {
+		return
+	}
+	if !idx.Files[fileName] {
+		return
+	}
+	idx.removeFile(fileName)
+	if err := saveIndex(username, idx); err != nil {
+		slog.Error("Error saving index", "user", username, "error", err)
+	}
+}
+
+// searchIndex finds files whose lines contain query (case-insensitive),
+// using the index to narrow down which files and lines to read.
+func searchIndex(username, query string) ([]searchMatch, error) {
+	cfg := currentConfig()
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("query must contain at least one word of %d or more characters", minTokenLength)
+	}
+
+	unlock := lockIndex(username)
+	idx, err := loadOrBuildIndex(username)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	candidates := candidateLines(idx, tokens)
+	unlock()
+
+	fileNames := make([]string, 0, len(candidates))
+	for fileName := range candidates {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	needle := strings.ToLower(strings.TrimSpace(query))
+	var matches []searchMatch
+	for _, fileName := range fileNames {
+		if len(matches) >= cfg.SearchMaxResults {
+			break
+		}
+		match, err := scanFile(path.Join(username, fileName), needle, candidates[fileName], cfg.SearchMaxSnippets)
+		if err != nil {
+			slog.Error("Error searching file", "user", username, "file", fileName, "error", err)
+			continue
+		}
+		if len(match.lines) > 0 {
+			match.fileName = fileName
+			matches = append(matches, match)
+		}
+	}
+	return matches, nil
+}
+
+// candidateLines intersects the postings of all tokens. A nil line set means
+// the postings were truncated and every line of the file has to be checked.
+func candidateLines(idx *contentIndex, tokens []string) map[string]map[int]bool {
+	var result map[string]map[int]bool
+	for i, token := range tokens {
+		next := make(map[string]map[int]bool)
+		for fileName, lines := range idx.Postings[token] {
+			prev, ok := result[fileName]
+			if i > 0 && !ok {
+				continue
+			}
+
+			var lineSet map[int]bool
+			if len(lines) <= maxTokenLines {
+				lineSet = make(map[int]bool, len(lines))
+				for _, line := range lines {
+					if prev == nil || prev[line] {
+						lineSet[line] = true
+					}
+				}
+				if len(lineSet) == 0 {
+					continue
+				}
+			} else {
+				lineSet = prev
+			}
+			next[fileName] = lineSet
+		}
+		result = next
+	}
+	return result
+}
+
+func scanFile(filePath, needle string, lines map[int]bool, maxSnippets int) (searchMatch, error) {
+	var match searchMatch
+	file, err := openStoredFile(filePath)
+	if err != nil {
+		return match, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() && len(match.lines) < maxSnippets {
+		lineNum++
+		if lines != nil && !lines[lineNum] {
+			continue
+		}
+		text := scanner.Text()
+		if !strings.Contains(strings.ToLower(text), needle) {
+			continue
+		}
+		match.lines = append(match.lines, lineNum)
+		match.snippets = append(match.snippets, snippet(text))
+	}
+	return match, scanner.Err()
+}
+
+// snippet trims a matching line and shortens it to at most maxSnippetLen
+// bytes, without splitting a UTF-8 sequence.
+func snippet(text string) string {
+	text = strings.TrimSpace(text)
+	if len(text) <= maxSnippetLen {
+		return text
+	}
+	cut := maxSnippetLen
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "..."
+}
+
+func handleContentSearch(reader *bufio.Reader, conn net.Conn, username string) error {
+	query, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading search query: %v", err)
+	}
+
+	if !currentConfig().IndexEnabled {
+		return sendStatus(conn, statusError, "Content search is disabled on this server")
+	}
+
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "a search")
+	}
+	defer worker()
+
+	matches, err := searchIndex(username, query)
+	if err != nil {
+		logFor(conn).Error("Search failed", "query", query, "error", err)
+		return sendStatus(conn, statusError, err.Error())
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending search status: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(matches))); err != nil {
+		return fmt.Errorf("error sending match count: %v", err)
+	}
+	for _, match := range matches {
+		if err := writeString(conn, match.fileName); err != nil {
+			return fmt.Errorf("error sending file name: %v", err)
+		}
+		if err := binary.Write(conn, binary.LittleEndian, int32(len(match.lines))); err != nil {
+			return fmt.Errorf("error sending snippet count: %v", err)
+		}
+		for i, line := range match.lines {
+			if err := binary.Write(conn, binary.LittleEndian, int32(line)); err != nil {
+				return fmt.Errorf("error sending line number: %v", err)
+			}
+			if err := writeString(conn, match.snippets[i]); err != nil {
+				return fmt.Errorf("error sending snippet: %v", err)
+			}
+		}
+	}
+
+	logFor(conn).Debug("Searched files", "query", query, "matches", len(matches))
+	return nil
+}
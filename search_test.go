@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSnippet(t *testing.T) {
+	short := "  error: disk full  "
+	if got := snippet(short); got != "error: disk full" {
+		t.Errorf("snippet(%q) = %q", short, got)
+	}
+
+	// Every offset of a two- and a three-byte rune against the cut
+	for _, r := range []string{"é", "€"} {
+		for pad := 0; pad < len(r); pad++ {
+			text := strings.Repeat("a", maxSnippetLen-pad) + strings.Repeat(r, 10)
+			got := snippet(text)
+			if !utf8.ValidString(got) {
+				t.Errorf("snippet with %d bytes before %q is not valid UTF-8: %q", maxSnippetLen-pad, r, got[len(got)-8:])
+			}
+			if body := strings.TrimSuffix(got, "..."); len(body) > maxSnippetLen || !strings.HasPrefix(text, body) {
+				t.Errorf("snippet with %d bytes before %q = %q", maxSnippetLen-pad, r, got[len(got)-8:])
+			}
+		}
+	}
+}
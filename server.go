@@ -2,14 +2,16 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"path"
 	"strings"
 	"sync"
 	"syscall"
@@ -17,43 +19,106 @@ import (
 )
 
 var (
-	authenticatedSessions = make(map[string]net.Conn)
+	authenticatedSessions = make(map[string]*session)
 	mu                    sync.Mutex
 	listener              net.Listener
 )
 
 const (
-	idleTimeout = 5 * time.Minute
 	baseDir     = "./uploads"
 	credentials = "id_passwd.txt"
+	configFile  = "server.conf"
 )
 
 func main() {
-	// Ensure base upload directory exists
-	if err := os.MkdirAll(baseDir, 0755); err != nil {
-		log.Fatalf("Error creating base upload directory: %v", err)
+	newKey := flag.Bool("new-key", false, "add a new master key to encryption_key_file and exit")
+	rotate := flag.Bool("rotate-keys", false, "re-wrap data keys with the current master key and exit")
+	flag.Parse()
+
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		fatal("Error reading config", "error", err)
+	}
+	activeConfig.Store(cfg)
+	// One-off commands report to the terminal
+	if !*newKey && !*rotate {
+		if err := setupLogging(cfg); err != nil {
+			fatal("Error opening log file", "error", err)
+		}
+	}
+
+	if *newKey {
+		id, err := addMasterKey(cfg)
+		if err != nil {
+			fatal("Error adding master key", "error", err)
+		}
+		slog.Info("Added master key; restart the server to use it and run with -rotate-keys to re-wrap existing files", "key", id, "file", cfg.EncryptionKeyFile)
+		return
 	}
 
+	store, err = newStorage(cfg)
+	if err != nil {
+		fatal("Error opening storage", "backend", cfg.StorageBackend, "error", err)
+	}
+	slog.Info("Using storage", "backend", cfg.StorageBackend)
+	if cfg.StorageCompression {
+		slog.Info("Compressing new files at rest")
+	}
+	if s := encryptionLayer(); s != nil {
+		if s.encrypt {
+			slog.Info("Encrypting new files", "key", s.keys.current)
+		} else {
+			slog.Info("Encryption is disabled; existing encrypted files remain readable")
+		}
+	}
+
+	if *rotate {
+		if err := rotateKeys(); err != nil {
+			fatal("Error rotating keys", "error", err)
+		}
+		return
+	}
+
+	// A process started by a restart shares the store with its
+	// predecessor, which may still be receiving uploads
+	overlapping.Store(handedOver())
+	if !overlapping.Load() {
+		// Uploads interrupted by a previous shutdown are never committed
+		cleanStaging()
+	}
+	loadChunkRefs(!overlapping.Load())
+
 	credentials, err := readCredentials(credentials)
 	if err != nil {
-		log.Fatalf("Error reading credentials: %v", err)
+		fatal("Error reading credentials", "error", err)
+	}
+	setAccounts(credentials)
+	startWorkerPool(cfg.WorkerPoolSize)
+	if err := openAuditLog(cfg); err != nil {
+		fatal("Error opening audit log", "error", err)
 	}
 
-	listener, err = net.Listen("tcp", ":8080")
+	listener, err = openListener(":8080")
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		fatal("Error starting server", "error", err)
 	}
 	defer listener.Close()
 
-	log.Println("TCP server is listening on port 8080...")
+	slog.Info("TCP server is listening", "port", 8080)
+
+	go monitorDiskSpace()
+	go expireVersions()
+	go purgeTrash()
 
 	var wg sync.WaitGroup
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(signalChannel, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, restartSignals...)...)
 
 	// Handle shutdown gracefully
 	// it is now a seperate func
 	go handleShutdown(signalChannel, &wg)
+	startControlSocket(cfg.ControlSocket, signalChannel)
+	reportReady()
 
 	for {
 		conn, err := listener.Accept()
@@ -61,79 +126,90 @@ func main() {
 			if strings.Contains(err.Error(), "use of closed network connection") {
 				break
 			}
-			log.Printf("Error accepting connection: %v", err)
+			slog.Error("Error accepting connection", "error", err)
 			continue
 		}
 
+		if reason := admitConnection(conn); reason != "" {
+			go refuseConnection(conn, reason)
+			continue
+		}
 		wg.Add(1)
-		go handleConnection(conn, credentials, &wg)
+		go handleConnection(conn, &wg)
 	}
+
+	wg.Wait()
+	closeControlSocket()
+	slog.Info("Server shutdown complete")
 }
 
-func readCredentials(filePath string) (map[string]string, error) {
+func readCredentials(filePath string) (map[string]*userAccount, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	credentials := make(map[string]string)
+	credentials := make(map[string]*userAccount)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if len(parts) == 2 {
-			credentials[parts[0]] = parts[1]
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		account := &userAccount{Password: parts[1], Options: map[string]string{}}
+		if len(parts) == 3 {
+			account.Options = parseAccountOptions(parts[2])
 		}
+		credentials[parts[0]] = account
 	}
 	return credentials, scanner.Err()
 }
 
-func handleConnection(conn net.Conn, credentials map[string]string, wg *sync.WaitGroup) {
+func handleConnection(conn net.Conn, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer releaseConnection(conn)
 	defer conn.Close()
+	tuneConnection(conn)
 
 	// Authentication process
-	username := authenticate(conn, credentials)
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	username := authenticate(conn)
 	if username == "" {
 		conn.Write([]byte("Incorrect username or password. Disconnecting.\n"))
 		return
 	}
 
-	log.Printf("Client %s connected", username)
-	// Create a unique directory for the authenticated user
-	clientDir := filepath.Join(baseDir, username)
-	if err := os.MkdirAll(clientDir, 0755); err != nil {
-		log.Printf("Error creating directory for %s: %v", username, err)
+	// Persist session in authenticatedSessions map
+	s, ok := registerSession(username, conn)
+	if !ok {
+		slog.Warn("Refused session: too many sessions", "user", username, "addr", conn.RemoteAddr().String())
+		auditEvent(nil, username, connectionIP(conn), "login", "busy", "too many sessions")
+		conn.Write([]byte("Server busy: too many sessions for this user. Try again later.\n"))
 		return
 	}
+	defer unregisterSession(s)
+	auditEvent(s, username, connectionIP(conn), "login", "ok", "")
+	defer auditEvent(s, username, connectionIP(conn), "logout", "ok", "")
 
-	// Persist session in authenticatedSessions map
-	clientAddr := conn.RemoteAddr().String()
-	mu.Lock()
-	authenticatedSessions[clientAddr] = conn
-	mu.Unlock()
-
-	defer func() {
-		mu.Lock()
-		delete(authenticatedSessions, clientAddr)
-		mu.Unlock()
-	}()
+	s.sessionLog.Info("Client connected", "addr", s.addr)
+	conn = throttleConnection(conn, s)
 
 	if _, err := conn.Write([]byte("Authentication successful. You are now connected.\n")); err != nil {
-		log.Printf("Error writing authentication success message: %v", err)
+		s.sessionLog.Error("Error writing authentication success message", "error", err)
 		return
 	}
 
-	handleClientOperations(conn, username, clientDir)
+	handleClientOperations(conn, s)
 }
 
 // Authentication function to validate the client credentials
-func authenticate(conn net.Conn, credentials map[string]string) string {
+func authenticate(conn net.Conn) string {
 	buf := make([]byte, 1024)
 	n, err := conn.Read(buf)
 	if err != nil {
-		log.Println("Error reading credentials:", err)
+		slog.Warn("Error reading credentials", "addr", conn.RemoteAddr().String(), "error", err)
 		conn.Write([]byte("Authentication failed: Error reading credentials\n"))
 		return ""
 	}
@@ -142,142 +218,356 @@ func authenticate(conn net.Conn, credentials map[string]string) string {
 	parts := strings.Split(input, ":")
 	if len(parts) != 2 {
 		conn.Write([]byte("Invalid format. Use username:password format.\n"))
+		auditEvent(nil, "", connectionIP(conn), "login", "denied", "invalid format")
 		return ""
 	}
 
 	username, password := parts[0], parts[1]
-	if storedPassword, ok := credentials[username]; ok && storedPassword == password {
+	if account := lookupAccount(username); account != nil && account.Password == password {
 		return username
 	}
 
 	conn.Write([]byte("Authentication failed: Invalid credentials\n"))
-	log.Printf("Failed authentication attempt for user: %s", username)
+	slog.Warn("Failed authentication attempt", "user", username, "addr", conn.RemoteAddr().String())
+	auditEvent(nil, username, connectionIP(conn), "login", "denied", "invalid credentials")
 	return ""
 }
 
-func handleClientOperations(conn net.Conn, username, clientDir string) {
+func handleClientOperations(conn net.Conn, s *session) {
+	username := s.username
 	reader := bufio.NewReader(conn)
+	// Capabilities agreed with the client; none until it asks
+	var caps capabilitySet
+	defer abortRangedUploads(conn)
+	// An operation still open when the loop returns has failed
+	defer s.finishAudit(true)
 
 	for {
-		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
-			log.Printf("Error setting read deadline: %v", err)
+		if err := s.idle(); err != nil {
+			s.sessionLog.Error("Error setting read deadline", "error", err)
 			return
 		}
 
 		opType, err := reader.ReadByte()
 		if err != nil {
+			if s.closed.Load() {
+				return
+			}
+			if draining.Load() {
+				sendNotice(s, shutdownMessage)
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				sendNotice(s, fmt.Sprintf("Session closed after %s without activity", sessionIdleTimeout(username)))
+				return
+			}
 			if err == io.EOF || strings.Contains(err.Error(), "connection reset by peer") {
-				log.Printf("Client %s disconnected", username)
+				s.sessionLog.Info("Client disconnected")
 				return
 			}
-			log.Printf("Error reading operation type from %s: %v", username, err)
+			s.sessionLog.Error("Error reading operation type", "error", err)
+			return
+		}
+		if !s.begin(opType) {
+			sendNotice(s, shutdownMessage)
 			return
 		}
+		s.startRequest(opType)
 
 		switch opType {
 		case 1: // File upload
-			// Read filename length
-			var fileNameLen int32
-			if err := binary.Read(reader, binary.LittleEndian, &fileNameLen); err != nil {
-				log.Printf("Error reading filename length: %v", err)
-				return
-			}
-
 			// Read filename
-			fileNameBuf := make([]byte, fileNameLen)
-			if _, err := io.ReadFull(reader, fileNameBuf); err != nil {
-				log.Printf("Error reading filename: %v", err)
+			fileName, err := readString(reader)
+			if err != nil {
+				s.log.Error("Error reading filename", "error", err)
 				return
 			}
-			fileName := string(fileNameBuf)
 
 			// Read file size
 			var fileSize int64
 			if err := binary.Read(reader, binary.LittleEndian, &fileSize); err != nil {
-				log.Printf("Error reading file size: %v", err)
+				s.log.Error("Error reading file size", "error", err)
 				return
 			}
 
-			if err := handleFileUpload(conn, filepath.Join(clientDir, fileName), fileSize, username); err != nil {
-				log.Printf("Error handling file upload: %v", err)
+			if err := handleFileUpload(conn, fileName, fileSize, username); err != nil {
+				s.log.Error("Error handling file upload", "error", err)
 				return
 			}
 			reader.Reset(conn)
 
 		case 2: // File download
-			if err := handleFileDownload(conn, username); err != nil {
-				log.Printf("Error handling file download for %s: %v", username, err)
+			if err := handleFileDownload(reader, conn, username); err != nil {
+				s.log.Error("Error handling file download", "error", err)
 				return
 			}
 
 		case 3: //View files
-			var fileNameLen int32
-			if err := binary.Read(reader, binary.LittleEndian, &fileNameLen); err != nil {
-				log.Printf("Error reading filename length: %v", err)
+			req, err := readViewRequest(reader)
+			if err != nil {
+				s.log.Error("Error reading view request", "error", err)
 				return
 			}
 
-			fileNameBuf := make([]byte, fileNameLen)
-			if _, err := io.ReadFull(reader, fileNameBuf); err != nil {
-				log.Printf("Error reading filename: %v", err)
-				return
-			}
-			fileName := string(fileNameBuf)
-
-			if err := handleViewFile(conn, filepath.Join(clientDir, fileName), username); err != nil {
-				log.Printf("Error handling file view: %v", err)
+			if err := handleViewFile(conn, req, username); err != nil {
+				s.log.Error("Error handling file view", "error", err)
 				return
 			}
 			reader.Reset(conn)
 
 		case 4: // Delete file(s)
 			if err := handleFileDeletion(reader, conn, username); err != nil {
-				log.Printf("Error handling file deletion for %s: %v", username, err)
+				s.log.Error("Error handling file deletion", "error", err)
 				return
 			}
 			reader.Reset(conn)
 
 		case 5: // List files
-			if err := handleListFiles(conn, clientDir); err != nil {
-				log.Printf("Error handling list files for %s: %v", username, err)
+			if err := handleListFiles(conn, username); err != nil {
+				s.log.Error("Error handling list files", "error", err)
 				return
 			}
 			reader.Reset(conn) // Reset reader after operation
 
+		case 6: // Content search
+			if err := handleContentSearch(reader, conn, username); err != nil {
+				s.log.Error("Error handling content search", "error", err)
+				return
+			}
+
+		case 7: // Follow file
+			if err := handleFollowFile(reader, conn, username); err != nil {
+				s.log.Error("Error handling follow", "error", err)
+				return
+			}
+
+		case 8: // Preview file
+			if err := handlePreviewFile(reader, conn, username); err != nil {
+				s.log.Error("Error handling preview", "error", err)
+				return
+			}
+
+		case 9: // Quota and usage
+			if err := handleQuotaQuery(conn, username); err != nil {
+				s.log.Error("Error handling quota query", "error", err)
+				return
+			}
+
+		case 10: // Server status
+			if err := handleServerStatus(conn); err != nil {
+				s.log.Error("Error handling status query", "error", err)
+				return
+			}
+
+		case 11: // List file versions
+			if err := handleListVersions(reader, conn, username); err != nil {
+				s.log.Error("Error handling version list", "error", err)
+				return
+			}
+
+		case 12: // Download file version
+			if err := handleDownloadVersion(reader, conn, username); err != nil {
+				s.log.Error("Error handling version download", "error", err)
+				return
+			}
+
+		case 13: // Restore file version
+			if err := handleRestoreVersion(reader, conn, username); err != nil {
+				s.log.Error("Error handling version restore", "error", err)
+				return
+			}
+
+		case 14: // List trash
+			if err := handleListTrash(conn, username); err != nil {
+				s.log.Error("Error handling trash list", "error", err)
+				return
+			}
+
+		case 15: // Restore from trash
+			if err := handleRestoreTrash(reader, conn, username); err != nil {
+				s.log.Error("Error handling trash restore", "error", err)
+				return
+			}
+
+		case 16: // Empty trash
+			if err := handleEmptyTrash(conn, username); err != nil {
+				s.log.Error("Error handling empty trash", "error", err)
+				return
+			}
+
+		case 17: // Deduplicated upload
+			if err := handleDedupUpload(reader, conn, username); err != nil {
+				s.log.Error("Error handling deduplicated upload", "error", err)
+				return
+			}
+
+		case 18: // Delta upload
+			if err := handleDeltaUpload(reader, conn, username, caps); err != nil {
+				s.log.Error("Error handling delta upload", "error", err)
+				return
+			}
+
+		case 19: // Capability handshake
+			if caps, err = handleCapabilities(reader, conn, username); err != nil {
+				s.log.Error("Error handling capability handshake", "error", err)
+				return
+			}
+
+		case 20: // Compressed upload
+			if err := handleCompressedUpload(reader, conn, username, caps); err != nil {
+				s.log.Error("Error handling compressed upload", "error", err)
+				return
+			}
+
+		case 21: // Compressed download
+			if err := handleCompressedDownload(reader, conn, username, caps); err != nil {
+				s.log.Error("Error handling compressed download", "error", err)
+				return
+			}
+
+		case 22: // File details
+			if err := handleFileStat(reader, conn, username); err != nil {
+				s.log.Error("Error handling file details", "error", err)
+				return
+			}
+
+		case 23: // Begin ranged upload
+			if err := handleBeginRangedUpload(reader, conn, username); err != nil {
+				s.log.Error("Error handling ranged upload", "error", err)
+				return
+			}
+
+		case 24: // Ranged upload part
+			if err := handleRangedUploadPart(reader, conn, username); err != nil {
+				s.log.Error("Error handling ranged upload part", "error", err)
+				return
+			}
+
+		case 25: // Finish ranged upload
+			if err := handleFinishRangedUpload(reader, conn, username); err != nil {
+				s.log.Error("Error finishing ranged upload", "error", err)
+				return
+			}
+
+		case 26: // Ranged download
+			if err := handleRangedDownload(reader, conn, username); err != nil {
+				s.log.Error("Error handling ranged download", "error", err)
+				return
+			}
+
+		case opPing: // Heartbeat
+			if err := handlePing(conn, s); err != nil {
+				s.log.Error("Error answering ping", "error", err)
+				return
+			}
+
+		case opListSessions: // List sessions (admin)
+			if err := handleListSessions(conn, username); err != nil {
+				s.log.Error("Error handling session list", "error", err)
+				return
+			}
+
+		case opCloseSessions: // Close sessions (admin)
+			if err := handleCloseSessions(reader, conn, s); err != nil {
+				s.log.Error("Error handling session close", "error", err)
+				return
+			}
+
 		default:
-			log.Printf("Unknown operation type %d from %s", opType, username)
+			s.log.Warn("Unknown operation type", "opcode", opType)
 			return
 		}
+		s.finishAudit(false)
 	}
 }
 
-func handleFileUpload(conn net.Conn, filePath string, fileSize int64, username string) error {
-	file, err := os.Create(filePath)
+func handleFileUpload(conn net.Conn, fileName string, fileSize int64, username string) error {
+	return receiveUpload(bufio.NewReader(conn), conn, fileName, fileSize, username, "")
+}
+
+// receiveUpload accepts a file of fileSize bytes, sent raw or, if codec is
+// set, compressed in frames.
+func receiveUpload(reader *bufio.Reader, conn net.Conn, fileName string, fileSize int64, username string, codecName string) error {
+	audit := auditFor(conn)
+	audit.setPath(fileName)
+	if !validFileName(fileName) || fileSize < 0 {
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize)
+		return sendStatus(conn, statusError, "Invalid file name or size")
+	}
+
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "an upload")
+	}
+	defer worker()
+
+	// Check free space and the quota before accepting any data
+	if status, msg := checkUploadSpace(fileSize); status != statusOK {
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "reason", msg)
+		return sendStatus(conn, status, msg)
+	}
+	release, err := reserveUpload(username, fileName, fileSize)
 	if err != nil {
-		conn.Write([]byte("Error: Failed to create file\n"))
+		logFor(conn).Warn("Rejected upload", "file", fileName, "bytes", fileSize, "error", err)
+		if _, ok := err.(*errQuotaExceeded); ok {
+			return sendStatus(conn, statusQuotaExceeded, err.Error())
+		}
+		return sendStatus(conn, statusError, err.Error())
+	}
+	defer release()
+
+	// Receive into a staging file so a failed upload never replaces the
+	// current copy, which is kept as a version when the upload commits
+	file, stagingName, err := createStagingFile(username, fileName)
+	if err != nil {
+		sendStatus(conn, statusError, "Error: Failed to create file")
 		return err
 	}
-	defer file.Close()
+	defer file.Abort()
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending upload status: %v", err)
+	}
 
 	// Read file content with a buffered reader
-	reader := bufio.NewReader(conn)
+	wire := &countingReader{r: reader}
+	var content io.Reader = wire
+	var frames *frameReader
+	if codecName != "" {
+		frames = &frameReader{r: wire}
+		decoder, err := findCodec(codecName).newReader(frames)
+		if err != nil {
+			return err
+		}
+		defer decoder.Close()
+		content = decoder
+	}
 	bytesReceived := int64(0)
-	buf := make([]byte, 1024)
+	hasher := sha256.New()
+	buf := getTransferBuffer()
+	defer putTransferBuffer(buf)
 
 	for bytesReceived < fileSize {
-		n, err := reader.Read(buf)
+		// Never read past the declared size, so the quota reservation holds
+		chunk := *buf
+		if remaining := fileSize - bytesReceived; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		// Large uploads may take longer than the idle timeout, so it
+		// applies to each read
+		extendReadDeadline(conn)
+		n, err := content.Read(chunk)
 		if err != nil && err != io.EOF {
 			conn.Write([]byte("Error: Failed to receive file\n"))
-			os.Remove(filePath)
 			return err
 		}
 
 		if n > 0 {
-			if _, err := file.Write(buf[:n]); err != nil {
+			if _, err := file.Write(chunk[:n]); err != nil {
 				conn.Write([]byte("Error: Failed to write file\n"))
-				os.Remove(filePath)
 				return err
 			}
+			hasher.Write(chunk[:n])
 			bytesReceived += int64(n)
 		}
 
@@ -286,7 +576,36 @@ func handleFileUpload(conn net.Conn, filePath string, fileSize int64, username s
 		}
 	}
 
-	log.Printf("File %s received from %s (%d bytes)", filepath.Base(filePath), username, bytesReceived)
+	// Compressed content must end where the declared size does
+	if frames != nil {
+		if bytesReceived < fileSize || frames.finish(content) != nil {
+			conn.Write([]byte("Error: Failed to receive file\n"))
+			return fmt.Errorf("compressed content of %s does not match its size", fileName)
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		conn.Write([]byte("Error: Failed to write file\n"))
+		return err
+	}
+	if err := storeStagedContent(stagingName); err != nil {
+		conn.Write([]byte("Error: Failed to store file\n"))
+		store.Remove(stagingName)
+		return err
+	}
+	if err := commitFile(username, fileName, stagingName); err != nil {
+		conn.Write([]byte("Error: Failed to store file\n"))
+		store.Remove(stagingName)
+		return err
+	}
+
+	if codecName != "" {
+		logFor(conn).Info("File received", "file", fileName, "bytes", bytesReceived, "compression", codecName, "received", wire.n)
+	} else {
+		logFor(conn).Info("File received", "file", fileName, "bytes", bytesReceived)
+	}
+	audit.setChecksum(hasher.Sum(nil))
+	go indexUploadedFile(username, fileName)
 
 	// Send acknowledgment with newline
 	if _, err := conn.Write([]byte("Done\n")); err != nil {
@@ -296,20 +615,35 @@ func handleFileUpload(conn net.Conn, filePath string, fileSize int64, username s
 	return nil
 }
 
-func handleFileDownload(conn net.Conn, username string) error {
-	var fileNameLen int32
-	if err := binary.Read(conn, binary.LittleEndian, &fileNameLen); err != nil {
-		return fmt.Errorf("error reading filename length: %v", err)
+func handleFileDownload(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
 	}
+	audit := auditFor(conn)
+	audit.setPath(fileName)
 
-	fileNameBytes := make([]byte, fileNameLen)
-	if _, err := io.ReadFull(conn, fileNameBytes); err != nil {
-		return fmt.Errorf("error reading filename: %v", err)
+	if !validFileName(fileName) {
+		audit.fail(statusError, "Invalid file name")
+		if err := binary.Write(conn, binary.LittleEndian, int64(0)); err != nil {
+			return fmt.Errorf("error sending error status: %v", err)
+		}
+		logFor(conn).Warn("Invalid filename in download request", "file", fileName)
+		return writeString(conn, "Invalid file name")
 	}
-	fileName := string(fileNameBytes)
 
-	filePath := filepath.Join("uploads", username, fileName)
-	file, err := os.Open(filePath)
+	worker, ok := acquireWorker()
+	if !ok {
+		logFor(conn).Warn("Server busy: turned away operation", "op", "a download")
+		audit.fail(statusBusy, busyMessage)
+		if err := binary.Write(conn, binary.LittleEndian, int64(0)); err != nil {
+			return fmt.Errorf("error sending error status: %v", err)
+		}
+		return writeString(conn, busyMessage)
+	}
+	defer worker()
+
+	file, err := openStoredFile(path.Join(username, fileName))
 	if err != nil {
 		// File doesn't exist or other error
 		// Send error status (0) followed by error message
@@ -317,6 +651,7 @@ func handleFileDownload(conn net.Conn, username string) error {
 			return fmt.Errorf("error sending error status: %v", err)
 		}
 		errMsg := fmt.Sprintf("File %s does not exist", fileName)
+		audit.fail(statusError, errMsg)
 		errMsgLen := int32(len(errMsg))
 		if err := binary.Write(conn, binary.LittleEndian, errMsgLen); err != nil {
 			return fmt.Errorf("error sending error message length: %v", err)
@@ -324,7 +659,7 @@ func handleFileDownload(conn net.Conn, username string) error {
 		if _, err := conn.Write([]byte(errMsg)); err != nil {
 			return fmt.Errorf("error sending error message: %v", err)
 		}
-		fmt.Printf("Client requested non-existent file: %s\n", fileName)
+		logFor(conn).Warn("Requested non-existent file", "file", fileName)
 		return nil
 	}
 	defer file.Close()
@@ -340,31 +675,19 @@ func handleFileDownload(conn net.Conn, username string) error {
 		return fmt.Errorf("error sending file size: %v", err)
 	}
 
-	buf := make([]byte, 1024)
-	bytesSent := int64(0)
-	for {
-		n, err := file.Read(buf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error reading file: %v", err)
-		}
-
-		if _, err := conn.Write(buf[:n]); err != nil {
-			return fmt.Errorf("error sending file content: %v", err)
-		}
-		bytesSent += int64(n)
+	bytesSent, err := sendContent(conn, file, 0, fileSize)
+	if err != nil {
+		return fmt.Errorf("error sending file content: %v", err)
 	}
 
-	log.Printf("File '%s' successfully downloaded by user '%s' (%d bytes)\n", fileName, username, bytesSent)
+	logFor(conn).Info("File downloaded", "file", fileName, "bytes", bytesSent)
 	return nil
 }
 
-func handleListFiles(conn net.Conn, clientDir string) error {
-	files, err := os.ReadDir(clientDir)
+func handleListFiles(conn net.Conn, username string) error {
+	files, err := store.List(username)
 	if err != nil {
-		log.Printf("Error reading directory: %v", err)
+		logFor(conn).Error("Error reading directory", "error", err)
 		return err
 	}
 
@@ -376,7 +699,7 @@ func handleListFiles(conn net.Conn, clientDir string) error {
 
 	// Send file information
 	for _, file := range files {
-		info, err := file.Info()
+		info, err := statStoredFile(path.Join(username, file.Name()))
 		if err != nil {
 			continue
 		}
@@ -411,88 +734,113 @@ func handleListFiles(conn net.Conn, clientDir string) error {
 	return nil
 }
 
-func handleViewFile(conn net.Conn, filePath string, username string) error {
-	fileInfo, err := os.Stat(filePath)
+func handleViewFile(conn net.Conn, req viewRequest, username string) error {
+	auditFor(conn).setPath(req.fileName)
+	if !validFileName(req.fileName) {
+		logFor(conn).Warn("Invalid filename in view request", "file", req.fileName)
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+	filePath := path.Join(username, req.fileName)
+
+	fileInfo, err := statStoredFile(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if _, err := conn.Write([]byte{0}); err != nil {
-				return fmt.Errorf("error sending not found status: %v", err)
-			}
-			log.Printf("User %s attempted to view non-existent file: %s", username, filepath.Base(filePath))
-			return nil
+			logFor(conn).Warn("View of non-existent file", "file", req.fileName)
+			return sendStatus(conn, statusError, fmt.Sprintf("File %s does not exist", req.fileName))
 		}
-		conn.Write([]byte{0})
-		log.Printf("Error checking file for user %s: %s - %v", username, filepath.Base(filePath), err)
+		sendStatus(conn, statusError, "Error checking file")
+		logFor(conn).Error("Error checking file", "file", req.fileName, "error", err)
 		return fmt.Errorf("error checking file: %v", err)
 	}
 
-	log.Printf("User %s is viewing file: %s (size %d bytes)", username, filepath.Base(filePath), fileInfo.Size())
+	logFor(conn).Debug("Viewing file", "file", req.fileName, "bytes", fileInfo.Size(), "mode", req.mode)
+
+	// Read file
+	file, err := openStoredFile(filePath)
+	if err != nil {
+		sendStatus(conn, statusError, "Error opening file")
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	data, start, err := readViewRange(file, fileInfo.Size(), req)
+	if err != nil {
+		logFor(conn).Warn("Error reading view range", "file", req.fileName, "error", err)
+		return sendStatus(conn, statusError, err.Error())
+	}
+	encoding, bomLen := fileEncoding(file)
+	content, encoding := decodeForView(data, start, encoding, bomLen, req.mode)
 
-	if _, err := conn.Write([]byte{1}); err != nil {
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
 		return fmt.Errorf("error sending status: %v", err)
 	}
 
-	// Send file size
+	// Send file size and where the returned range starts
 	if err := binary.Write(conn, binary.LittleEndian, fileInfo.Size()); err != nil {
 		return fmt.Errorf("error sending file size: %v", err)
 	}
-
-	// Read file
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+	if err := binary.Write(conn, binary.LittleEndian, start); err != nil {
+		return fmt.Errorf("error sending range offset: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int64(len(data))); err != nil {
+		return fmt.Errorf("error sending range length: %v", err)
+	}
+	if err := writeString(conn, encoding); err != nil {
+		return fmt.Errorf("error sending encoding: %v", err)
 	}
-	defer file.Close()
 
 	// Send file content
-	buf := make([]byte, 1024)
-	n, err := file.Read(buf)
-	if err != nil {
-		return fmt.Errorf("error reading file: %v", err)
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(content))); err != nil {
+		return fmt.Errorf("error sending content length: %v", err)
 	}
-
-	if _, err := conn.Write(buf[:n]); err != nil {
+	if _, err := conn.Write(content); err != nil {
 		return fmt.Errorf("error sending file content: %v", err)
 	}
 
-	log.Printf("Successfully viewing file %s to user %s", filepath.Base(filePath), username)
+	logFor(conn).Info("Viewed file", "file", req.fileName)
 	return nil
 }
 
 func handleFileDeletion(reader *bufio.Reader, conn net.Conn, username string) error {
-    // Read filename length
-    var fileNameLen int32
-    if err := binary.Read(reader, binary.LittleEndian, &fileNameLen); err != nil {
-        return fmt.Errorf("error reading filename length: %v", err)
-    }
-
     // Read filename
-    fileNameBytes := make([]byte, fileNameLen)
-    if _, err := io.ReadFull(reader, fileNameBytes); err != nil {
+    fileName, err := readString(reader)
+    if err != nil {
         return fmt.Errorf("error reading filename: %v", err)
     }
-    fileName := string(fileNameBytes)
+	audit := auditFor(conn)
+	audit.setPath(fileName)
 
-	// Check for invalid filename
-	if strings.Contains(fileName, "..") {
+	// Check for invalid filename. An empty name or "." would be the
+	// user's own directory.
+	if !validFileName(fileName) {
+		audit.fail(statusError, "Invalid file name")
 		if _, err := conn.Write([]byte{0}); err != nil {
 			return fmt.Errorf("error sending invalid filename status: %v", err)
 		}
-		log.Printf("Invalid filename '%s' attempted by user '%s'", fileName, username)
+		logFor(conn).Warn("Invalid filename in delete request", "file", fileName)
 		return fmt.Errorf("invalid filename: %s", fileName)
 	}
 
-    // Build file path
-    filePath := filepath.Join(baseDir, username, fileName)
+	// Moving a file to the trash writes to the store. The reply has no
+	// message, so the status alone says why.
+	if readOnly() {
+		audit.fail(statusReadOnly, "Server is read-only: disk space is critically low")
+		if _, err := conn.Write([]byte{statusReadOnly}); err != nil {
+			return fmt.Errorf("error sending read-only status: %v", err)
+		}
+		logFor(conn).Warn("Refused delete: server is read-only", "file", fileName)
+		return nil
+	}
 
-    // Lock before deleting
-    mu.Lock()
-    defer mu.Unlock()
+    // Build file path
+    filePath := path.Join(username, fileName)
 
     // Attempt to delete the file
-    if _, err := os.Stat(filePath); err == nil {
-        // File exists, proceed to delete
-        if err := os.Remove(filePath); err != nil {
+    if _, err := store.Stat(filePath); err == nil {
+        // File exists, move it to the user's trash. moveToTrash takes the
+        // store lock itself, so sessions are not held up while it runs.
+        if err := moveToTrash(username, fileName); err != nil {
+            audit.fail(statusError, "Error moving file to trash")
             // Send failure response
             if _, err := conn.Write([]byte{0}); err != nil {
                 return fmt.Errorf("error sending failure status: %v", err)
@@ -503,32 +851,16 @@ func handleFileDeletion(reader *bufio.Reader, conn net.Conn, username string) er
         if _, err := conn.Write([]byte{1}); err != nil {
             return fmt.Errorf("error sending success status: %v", err)
         }
-        log.Printf("File '%s' deleted by user '%s'", fileName, username)
+        removeFromIndex(username, fileName)
+        logFor(conn).Info("File moved to trash", "file", fileName)
     } else {
         // File does not exist
+        audit.fail(statusError, fmt.Sprintf("File %s does not exist", fileName))
         if _, err := conn.Write([]byte{0}); err != nil {
             return fmt.Errorf("error sending failure status: %v", err)
         }
-        log.Printf("File '%s' not found for user '%s'", fileName, username)
+        logFor(conn).Warn("File to delete not found", "file", fileName)
     }
 
     return nil
 }
-
-
-func handleShutdown(signalChannel chan os.Signal, wg *sync.WaitGroup) {
-	<-signalChannel
-	fmt.Print("\r")
-	log.Println("Ctrl+C encountered. Shutting down server...")
-	listener.Close()
-
-	mu.Lock()
-	for _, conn := range authenticatedSessions {
-		conn.Close()
-	}
-	mu.Unlock()
-
-	wg.Wait()
-	log.Println("Server shutdown complete")
-	os.Exit(0)
-}
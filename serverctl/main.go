@@ -0,0 +1,66 @@
+// serverctl sends a command to a running server over its control socket and
+// prints the reply. Run it as the user the server runs as, from the server's
+// directory or with -socket.
+//
+//	serverctl [-socket path] <command> [arguments]
+//
+// "serverctl help" lists the commands.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	socket := flag.String("socket", "control.sock", "path of the server's control socket (control_socket in server.conf)")
+	timeout := flag.Duration("timeout", time.Minute, "how long to wait for the reply")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <command> [arguments]\n\nRun \"%s help\" for the commands.\n\nFlags:\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to the server: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(*timeout))
+
+	if _, err := fmt.Fprintln(conn, strings.Join(flag.Args(), " ")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error sending command: %v\n", err)
+		os.Exit(1)
+	}
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading reply: %v\n", err)
+		os.Exit(1)
+	}
+	status = strings.TrimSpace(status)
+	if msg, failed := strings.CutPrefix(status, "ERROR "); failed {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+		os.Exit(1)
+	}
+	if status != "OK" {
+		fmt.Fprintf(os.Stderr, "Unexpected reply: %s\n", status)
+		os.Exit(1)
+	}
+	if _, err := io.Copy(os.Stdout, reader); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading reply: %v\n", err)
+		os.Exit(1)
+	}
+}
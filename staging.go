@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"sync"
+	"time"
+)
+
+const stagingDirName = ".staging"
+
+// storeMu serialises replacing files in user directories, so archiving the
+// current copy and moving the new one into place happen as one step.
+var storeMu sync.Mutex
+
+// createStagingFile returns a writer for content meant for fileName and the
+// uniquely named staging file it is stored as once closed. Staging lives
+// outside the user's directory so partial files never show up in listings,
+// quotas or searches.
+func createStagingFile(username, fileName string) (storageWriter, string, error) {
+	name := path.Join(stagingDirName, username, fmt.Sprintf("%s.%d", fileName, time.Now().UnixNano()))
+	w, err := store.Create(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return w, name, nil
+}
+
+// commitFile moves a complete staging file into the user's directory as
+// fileName. The copy it replaces is kept as a version.
+func commitFile(username, fileName, stagingName string) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	name := path.Join(username, fileName)
+	if err := archiveCurrentVersion(username, fileName); err != nil {
+		return fmt.Errorf("error archiving previous version: %v", err)
+	}
+	// With versioning off the current copy is replaced outright, so its
+	// chunks are released once the new file is in place
+	replaced, _ := loadManifest(name)
+	if err := store.Rename(stagingName, name); err != nil {
+		return err
+	}
+	if replaced != nil {
+		releaseChunks(replaced.hashes())
+	}
+	pruneVersions(username, fileName)
+	return nil
+}
+
+// cleanStaging removes staging files left behind by a previous run.
+func cleanStaging() {
+	if err := store.RemoveAll(stagingDirName); err != nil {
+		slog.Error("Error cleaning staging directory", "error", err)
+	}
+}
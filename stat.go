@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path"
+)
+
+// Flags in a file stat reply describing how a file is stored.
+const (
+	statCompressed   byte = 1 << 0
+	statEncrypted    byte = 1 << 1
+	statDeduplicated byte = 1 << 2
+)
+
+// handleFileStat sends the logical size of a file, the size it takes in
+// the store, its modification time and how it is stored.
+func handleFileStat(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	auditFor(conn).setPath(fileName)
+	if !validFileName(fileName) {
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+	name := path.Join(username, fileName)
+	info, err := statStoredFile(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return sendStatus(conn, statusError, fmt.Sprintf("File %s does not exist", fileName))
+	}
+
+	backend := backendOf(store)
+	stored, err := backend.Stat(name)
+	if err != nil {
+		return sendStatus(conn, statusError, "Error checking file")
+	}
+	var flags byte
+	if layer, ok := store.(*compressedStorage); ok && layer.isCompressed(name) {
+		flags |= statCompressed
+	}
+	if raw, err := backend.Open(name); err == nil {
+		if isEncrypted(readHeader(raw)) {
+			flags |= statEncrypted
+		}
+		raw.Close()
+	}
+	if m, err := loadManifest(name); err == nil && m != nil {
+		flags |= statDeduplicated
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return err
+	}
+	for _, v := range []int64{info.Size(), stored.Size(), info.ModTime().Unix()} {
+		if err := binary.Write(conn, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("error sending file details: %v", err)
+		}
+	}
+	if _, err := conn.Write([]byte{flags}); err != nil {
+		return fmt.Errorf("error sending file details: %v", err)
+	}
+	logFor(conn).Debug("Checked file details", "file", fileName)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+var serverStart = time.Now()
+
+// serverStatus returns the server's health and metrics as ordered
+// name/value pairs.
+func serverStatus() [][2]string {
+	mu.Lock()
+	sessions := len(authenticatedSessions)
+	mu.Unlock()
+
+	status := [][2]string{
+		{"uptime", time.Since(serverStart).Round(time.Second).String()},
+		{"active_sessions", strconv.Itoa(sessions)},
+		{"uploads_in_progress_bytes", strconv.FormatInt(totalInFlight(), 10)},
+		{"workers_busy", fmt.Sprintf("%d of %d", len(workerSlots), cap(workerSlots))},
+		{"requests_queued", strconv.FormatInt(queuedWork.Load(), 10)},
+		{"connections_refused", strconv.FormatInt(refusedConnections.Load(), 10)},
+	}
+
+	cfg := currentConfig()
+	if diskMonitored.Load() {
+		status = append(status,
+			[2]string{"disk_state", diskStateName(diskState.Load())},
+			[2]string{"disk_free_bytes", strconv.FormatUint(diskFreeBytes.Load(), 10)},
+			[2]string{"disk_total_bytes", strconv.FormatUint(diskTotal.Load(), 10)},
+			[2]string{"disk_low_watermark", cfg.DiskLowWatermark.String()},
+			[2]string{"disk_critical_watermark", cfg.DiskCriticalWatermark.String()},
+		)
+	} else {
+		status = append(status, [2]string{"disk_state", "not monitored"})
+	}
+	status = append(status, [2]string{"read_only", strconv.FormatBool(readOnly())})
+	return status
+}
+
+// handleServerStatus sends the status pairs as a count (int32) followed by
+// each name and value (int32 length + text).
+func handleServerStatus(conn net.Conn) error {
+	status := serverStatus()
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(status))); err != nil {
+		return fmt.Errorf("error sending status count: %v", err)
+	}
+	for _, pair := range status {
+		if err := writeString(conn, pair[0]); err != nil {
+			return fmt.Errorf("error sending status name: %v", err)
+		}
+		if err := writeString(conn, pair[1]); err != nil {
+			return fmt.Errorf("error sending status value: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// Storage is where the server keeps file content and its own metadata.
+// Names are slash-separated paths relative to the root of the store, such
+// as "alice/report.csv" or ".versions/alice/report.csv/1700000000000000000".
+// Directories exist only as prefixes of names: they never need creating and
+// a missing one lists as empty.
+type Storage interface {
+	// Open opens name for reading.
+	Open(name string) (storedFile, error)
+	// Create returns a writer for name. What is written replaces name only
+	// when the writer is closed; Abort discards it.
+	Create(name string) (storageWriter, error)
+	Stat(name string) (os.FileInfo, error)
+	// List returns the entries directly under dir, sorted by name.
+	List(dir string) ([]os.FileInfo, error)
+	Remove(name string) error
+	// RemoveAll removes dir and everything under it.
+	RemoveAll(dir string) error
+	Rename(oldName, newName string) error
+}
+
+// storageWriter receives the content of a new object.
+type storageWriter interface {
+	io.Writer
+	// Close makes the content visible under the writer's name.
+	Close() error
+	// Abort discards the content. It is a no-op after Close.
+	Abort()
+}
+
+// store is the storage backend selected in server.conf.
+var store Storage
+
+// newStorage opens the configured backend, wrapped to encrypt and decrypt
+// content when master keys are configured and, above that, to compress it.
+// Compression has to come first: encrypted content does not compress.
+func newStorage(cfg *serverConfig) (Storage, error) {
+	s, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadKeyRing(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		s = &encryptedStorage{Storage: s, keys: keys, encrypt: cfg.EncryptionEnabled}
+	} else if cfg.EncryptionEnabled {
+		return nil, fmt.Errorf("encryption_enabled needs encryption_key or encryption_key_file")
+	}
+	// The layer stays in place when compression is off, so files stored
+	// compressed earlier remain readable
+	return &compressedStorage{Storage: s, level: cfg.StorageCompressionLevel, compress: cfg.StorageCompression}, nil
+}
+
+func newBackend(cfg *serverConfig) (Storage, error) {
+	switch cfg.StorageBackend {
+	case "local":
+		return newLocalStorage(baseDir)
+	case "memory":
+		return newMemoryStorage(), nil
+	case "s3":
+		return newS3Storage(cfg)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+}
+
+// storeSpace returns the free and total bytes where the store keeps its
+// data, for backends that can tell.
+func storeSpace() (free, total uint64, err error) {
+	if s, ok := backendOf(store).(*localStorage); ok {
+		return diskSpace(s.root)
+	}
+	return 0, 0, fmt.Errorf("%s storage does not report free space", currentConfig().StorageBackend)
+}
+
+// backendOf returns the backend beneath the encryption and compression
+// layers of s.
+func backendOf(s Storage) Storage {
+	for {
+		switch layer := s.(type) {
+		case *compressedStorage:
+			s = layer.Storage
+		case *encryptedStorage:
+			s = layer.Storage
+		default:
+			return s
+		}
+	}
+}
+
+// encryptionLayer returns the encryption layer of the store, or nil if no
+// master key is configured.
+func encryptionLayer() *encryptedStorage {
+	s := store
+	if layer, ok := s.(*compressedStorage); ok {
+		s = layer.Storage
+	}
+	layer, _ := s.(*encryptedStorage)
+	return layer
+}
+
+// readObject returns the whole content of name.
+func readObject(name string) ([]byte, error) {
+	file, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// writeObject stores data as name, replacing it in one step.
+func writeObject(name string, data []byte) error {
+	w, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// walkStore calls fn for every entry under dir, parents before their
+// contents. Returning fs.SkipDir for a directory skips what it contains.
+func walkStore(dir string, fn func(name string, info os.FileInfo) error) error {
+	entries, err := store.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range entries {
+		name := path.Join(dir, info.Name())
+		err := fn(name, info)
+		if err == fs.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := walkStore(name, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// objectInfo describes an object in a store that has no os.FileInfo of its
+// own. version changes whenever the object is replaced.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	version string
+}
+
+func (i *objectInfo) Name() string       { return i.name }
+func (i *objectInfo) Size() int64        { return i.size }
+func (i *objectInfo) ModTime() time.Time { return i.modTime }
+func (i *objectInfo) IsDir() bool        { return i.dir }
+func (i *objectInfo) Sys() any           { return nil }
+
+func (i *objectInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// sizedInfo describes a stored object by the size of its content, which
+// differs from what is stored for manifests and encrypted files.
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i sizedInfo) Size() int64 { return i.size }
+
+// unsizedInfo returns the info of what is stored behind info.
+func unsizedInfo(info os.FileInfo) os.FileInfo {
+	for {
+		sized, ok := info.(sizedInfo)
+		if !ok {
+			return info
+		}
+		info = sized.FileInfo
+	}
+}
+
+// sameObject reports whether two infos from the store describe the same
+// object, so a replaced file can be told from one that changed in place.
+func sameObject(a, b os.FileInfo) bool {
+	a, b = unsizedInfo(a), unsizedInfo(b)
+	if oa, ok := a.(*objectInfo); ok {
+		ob, ok := b.(*objectInfo)
+		return ok && oa.version == ob.version
+	}
+	return os.SameFile(a, b)
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Compressed objects are split into frames of compressedFrameSize bytes of
+// content, each compressed on its own so a ranged read only inflates the
+// frames it touches. A header names the codec and frame size; an index of
+// the frames' compressed lengths and a trailer follow the frames.
+//
+//	header:  magic, codec (1 byte), frame size (uint32)
+//	frames:  compressed frames, one after another
+//	index:   compressed length of each frame (uint32); the top bit marks
+//	         frames stored as they are because they did not compress
+//	trailer: content size (uint64), frame count (uint32), index magic
+const (
+	compressedMagic      = "DFTPCMP1"
+	compressedIndexMagic = "DFTPCIX1"
+	compressedHeaderSize = len(compressedMagic) + 1 + 4
+	compressedTailSize   = 8 + 4 + len(compressedIndexMagic)
+	compressedFrameSize  = 256 << 10
+	frameStored          = 1 << 31
+
+	codecDeflate byte = 1
+)
+
+// compressedStorage compresses what is written to the store beneath it and
+// decompresses what is read. Objects without the header, such as those
+// stored before compression was turned on, are read as they are.
+type compressedStorage struct {
+	Storage
+	level int
+	// compress is false when compression is off; existing compressed
+	// files are still read
+	compress bool
+}
+
+func (s *compressedStorage) Open(name string) (storedFile, error) {
+	raw, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openCompressed(raw)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("error opening %s: %v", name, err)
+	}
+	if file == nil {
+		return raw, nil
+	}
+	return file, nil
+}
+
+// Create compresses name unless compression is off or its extension marks
+// it as compressed already. Content stored as it is that happens to start
+// with the magic is compressed anyway, so it can never pass for a
+// compressed object.
+func (s *compressedStorage) Create(name string) (storageWriter, error) {
+	w, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if !s.compress || compressedExtensions[strings.ToLower(filepath.Ext(name))] {
+		return &plainWriter{w: w, level: s.level}, nil
+	}
+	return newCompressedWriter(w, s.level)
+}
+
+// newCompressedWriter writes the header to w and returns a writer that
+// compresses what follows.
+func newCompressedWriter(w storageWriter, level int) (*compressedWriter, error) {
+	fw, err := flate.NewWriter(nil, level)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	header[len(compressedMagic)] = codecDeflate
+	binary.LittleEndian.PutUint32(header[len(compressedMagic)+1:], compressedFrameSize)
+	if _, err := w.Write(header); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &compressedWriter{w: w, flate: fw, buf: make([]byte, 0, compressedFrameSize)}, nil
+}
+
+// plainWriter stores content as it is, unless it starts with the magic.
+// It holds back the first bytes until it knows which.
+type plainWriter struct {
+	w     storageWriter
+	level int
+	head  []byte
+	out   storageWriter
+}
+
+func (w *plainWriter) Write(p []byte) (int, error) {
+	if w.out == nil {
+		n := min(len(p), len(compressedMagic)-len(w.head))
+		w.head = append(w.head, p[:n]...)
+		if len(w.head) < len(compressedMagic) {
+			return len(p), nil
+		}
+		if err := w.choose(); err != nil {
+			return 0, err
+		}
+		if _, err := w.out.Write(w.head); err != nil {
+			return 0, err
+		}
+		p = p[n:]
+		if _, err := w.out.Write(p); err != nil {
+			return 0, err
+		}
+		return n + len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+// choose picks where the content goes once its start is known.
+func (w *plainWriter) choose() error {
+	if string(w.head) != compressedMagic {
+		w.out = w.w
+		return nil
+	}
+	cw, err := newCompressedWriter(w.w, w.level)
+	if err != nil {
+		return err
+	}
+	w.out = cw
+	return nil
+}
+
+func (w *plainWriter) Close() error {
+	if w.out == nil {
+		// Shorter than the magic, so it cannot be mistaken for it
+		if _, err := w.w.Write(w.head); err != nil {
+			w.w.Abort()
+			return err
+		}
+		return w.w.Close()
+	}
+	return w.out.Close()
+}
+
+func (w *plainWriter) Abort() {
+	w.w.Abort()
+}
+
+// Stat reports the content size of compressed objects.
+func (s *compressedStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := s.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.contentInfo(name, info), nil
+}
+
+// List reports the content size of compressed objects. It reads the
+// trailer of every file listed.
+func (s *compressedStorage) List(dir string) ([]os.FileInfo, error) {
+	infos, err := s.Storage.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		infos[i] = s.contentInfo(path.Join(dir, info.Name()), info)
+	}
+	return infos, nil
+}
+
+func (s *compressedStorage) contentInfo(name string, info os.FileInfo) os.FileInfo {
+	if info.IsDir() || info.Size() < int64(compressedHeaderSize+compressedTailSize) {
+		return info
+	}
+	raw, err := s.Storage.Open(name)
+	if err != nil {
+		return info
+	}
+	defer raw.Close()
+	file, err := openCompressed(raw)
+	if err != nil || file == nil {
+		return info
+	}
+	return sizedInfo{info, file.size}
+}
+
+// isCompressed reports whether name is stored compressed.
+func (s *compressedStorage) isCompressed(name string) bool {
+	raw, err := s.Storage.Open(name)
+	if err != nil {
+		return false
+	}
+	defer raw.Close()
+	header := make([]byte, len(compressedMagic))
+	n, _ := raw.ReadAt(header, 0)
+	return n == len(header) && string(header) == compressedMagic
+}
+
+// compressedWriter compresses content frame by frame.
+type compressedWriter struct {
+	w     storageWriter
+	flate *flate.Writer
+	buf   []byte
+	out   bytes.Buffer
+	index []uint32
+	size  int64
+}
+
+func (w *compressedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):compressedFrameSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == compressedFrameSize {
+			if err := w.writeFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *compressedWriter) writeFrame() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	w.out.Reset()
+	w.flate.Reset(&w.out)
+	w.flate.Write(w.buf)
+	if err := w.flate.Close(); err != nil {
+		return err
+	}
+	frame, length := w.out.Bytes(), uint32(w.out.Len())
+	if len(frame) >= len(w.buf) {
+		frame, length = w.buf, uint32(len(w.buf))|frameStored
+	}
+	if _, err := w.w.Write(frame); err != nil {
+		return err
+	}
+	w.index = append(w.index, length)
+	w.size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *compressedWriter) Close() error {
+	if err := w.writeFrame(); err != nil {
+		w.w.Abort()
+		return err
+	}
+	tail := make([]byte, 4*len(w.index)+compressedTailSize)
+	for i, length := range w.index {
+		binary.LittleEndian.PutUint32(tail[4*i:], length)
+	}
+	trailer := tail[4*len(w.index):]
+	binary.LittleEndian.PutUint64(trailer, uint64(w.size))
+	binary.LittleEndian.PutUint32(trailer[8:], uint32(len(w.index)))
+	copy(trailer[12:], compressedIndexMagic)
+	if _, err := w.w.Write(tail); err != nil {
+		w.w.Abort()
+		return err
+	}
+	return w.w.Close()
+}
+
+func (w *compressedWriter) Abort() {
+	w.w.Abort()
+}
+
+// compressedFile reads a compressed object, inflating the frames a read
+// needs and keeping the most recently used one.
+type compressedFile struct {
+	raw     storedFile
+	size    int64
+	offsets []int64 // of each frame, plus the end of the last
+	stored  []bool
+	pos     int64
+
+	mu    sync.Mutex
+	frame int
+	plain []byte
+}
+
+// openCompressed reads the index of a compressed object. It returns nil if
+// raw is not compressed.
+func openCompressed(raw storedFile) (*compressedFile, error) {
+	header := make([]byte, compressedHeaderSize)
+	if n, _ := raw.ReadAt(header, 0); n < len(header) || string(header[:len(compressedMagic)]) != compressedMagic {
+		return nil, nil
+	}
+	if codec := header[len(compressedMagic)]; codec != codecDeflate {
+		return nil, fmt.Errorf("unknown compression codec %d", codec)
+	}
+	if frameSize := binary.LittleEndian.Uint32(header[len(compressedMagic)+1:]); frameSize != compressedFrameSize {
+		return nil, fmt.Errorf("unsupported frame size %d", frameSize)
+	}
+
+	info, err := raw.Stat()
+	if err != nil {
+		return nil, err
+	}
+	storedSize := info.Size()
+	trailer := make([]byte, compressedTailSize)
+	if _, err := raw.ReadAt(trailer, storedSize-int64(compressedTailSize)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(trailer[12:]) != compressedIndexMagic {
+		return nil, fmt.Errorf("compressed file is truncated")
+	}
+	size := int64(binary.LittleEndian.Uint64(trailer))
+	count := int64(binary.LittleEndian.Uint32(trailer[8:]))
+	// The index has to fit between the header and the trailer, and every
+	// frame but the last holds a full frame of content
+	if count > (storedSize-int64(compressedHeaderSize+compressedTailSize))/4 ||
+		size < 0 || size > count*compressedFrameSize || size <= (count-1)*compressedFrameSize {
+		return nil, fmt.Errorf("compressed file has a damaged index")
+	}
+	indexStart := storedSize - int64(compressedTailSize) - 4*count
+	index := make([]byte, 4*count)
+	if _, err := raw.ReadAt(index, indexStart); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	f := &compressedFile{raw: raw, size: size, frame: -1}
+	offset := int64(compressedHeaderSize)
+	for i := int64(0); i < count; i++ {
+		length := binary.LittleEndian.Uint32(index[4*i:])
+		if length&^frameStored > compressedFrameSize {
+			return nil, fmt.Errorf("compressed file has a damaged index")
+		}
+		f.offsets = append(f.offsets, offset)
+		f.stored = append(f.stored, length&frameStored != 0)
+		offset += int64(length &^ frameStored)
+	}
+	f.offsets = append(f.offsets, offset)
+	if offset != indexStart {
+		return nil, fmt.Errorf("compressed file has a damaged index")
+	}
+	return f, nil
+}
+
+func (f *compressedFile) Stat() (os.FileInfo, error) {
+	info, err := f.raw.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sizedInfo{info, f.size}, nil
+}
+
+// loadFrame makes frame i the cached one.
+func (f *compressedFile) loadFrame(i int) error {
+	if f.frame == i {
+		return nil
+	}
+	f.frame = -1
+	data := make([]byte, f.offsets[i+1]-f.offsets[i])
+	if _, err := f.raw.ReadAt(data, f.offsets[i]); err != nil && err != io.EOF {
+		return err
+	}
+	if f.stored[i] {
+		f.plain = data
+	} else {
+		inflater := flate.NewReader(bytes.NewReader(data))
+		var out bytes.Buffer
+		out.Grow(compressedFrameSize)
+		_, err := io.Copy(&out, io.LimitReader(inflater, compressedFrameSize+1))
+		inflater.Close()
+		if err == nil && out.Len() > compressedFrameSize {
+			err = fmt.Errorf("frame inflates past %d bytes", compressedFrameSize)
+		}
+		if err != nil {
+			return fmt.Errorf("compressed frame %d is damaged: %v", i, err)
+		}
+		f.plain = out.Bytes()
+	}
+	f.frame = i
+	return nil
+}
+
+func (f *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= f.size {
+			return read, io.EOF
+		}
+		i := int(pos / compressedFrameSize)
+		if err := f.loadFrame(i); err != nil {
+			return read, err
+		}
+		start := pos - int64(i)*compressedFrameSize
+		if start >= int64(len(f.plain)) {
+			return read, fmt.Errorf("compressed frame %d is shorter than expected", i)
+		}
+		read += copy(p[read:], f.plain[start:])
+	}
+	return read, nil
+}
+
+func (f *compressedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative seek position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *compressedFile) Close() error {
+	return f.raw.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		testStorage(t, &compressedStorage{Storage: newMemoryStorage(), level: 6, compress: compress})
+	}
+}
+
+// forgedCompressed returns content laid out like a compressed object that
+// claims size bytes of content in count frames of the given length.
+func forgedCompressed(size uint64, count, length uint32, body int) []byte {
+	data := []byte(compressedMagic)
+	data = append(data, codecDeflate)
+	data = binary.LittleEndian.AppendUint32(data, compressedFrameSize)
+	data = append(data, make([]byte, body)...)
+	for i := uint32(0); i < count && i < 4; i++ {
+		data = binary.LittleEndian.AppendUint32(data, length)
+	}
+	data = binary.LittleEndian.AppendUint64(data, size)
+	data = binary.LittleEndian.AppendUint32(data, count)
+	return append(data, compressedIndexMagic...)
+}
+
+func TestCompressedStorageStoresForgedHeaders(t *testing.T) {
+	forged := forgedCompressed(1, 1, uint32(10<<20)|frameStored, 10<<20)
+	for _, tc := range []struct {
+		name     string
+		compress bool
+	}{
+		{"alice/forged.bin", false},
+		{"alice/forged.zip", true},
+		{"alice/forged.bin", true},
+	} {
+		s := &compressedStorage{Storage: newMemoryStorage(), level: 6, compress: tc.compress}
+		w, err := s.Create(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Written in small pieces, so the magic arrives split
+		for rest := forged; len(rest) > 0; {
+			n := min(len(rest), 3)
+			if _, err := w.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := s.Stat(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(forged)) {
+			t.Errorf("%s (compress %v): size %d, want %d", tc.name, tc.compress, info.Size(), len(forged))
+		}
+		if got := readStored(t, s, tc.name); !bytes.Equal(got, forged) {
+			t.Errorf("%s (compress %v): content read back differs", tc.name, tc.compress)
+		}
+	}
+
+	// Short content is stored as it is
+	s := &compressedStorage{Storage: newMemoryStorage(), compress: false}
+	if err := writeObjectTo(s, "alice/short", []byte("DFTP")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStored(t, s.Storage, "alice/short"); string(got) != "DFTP" {
+		t.Errorf("short content stored as %q", got)
+	}
+}
+
+func TestOpenCompressedRejectsDamagedIndexes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"count past the object", forgedCompressed(1, 1<<30, 1, 0)},
+		{"size past the frames", forgedCompressed(compressedFrameSize+1, 1, 1, 1)},
+		{"negative size", forgedCompressed(1<<63, 1, 1, 1)},
+		{"frame too long", forgedCompressed(1, 1, compressedFrameSize+1, compressedFrameSize+1)},
+	} {
+		memory := newMemoryStorage()
+		if err := writeObjectTo(memory, "damaged", tc.data); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := memory.Open("damaged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openCompressed(raw); err == nil {
+			t.Errorf("%s: opened without error", tc.name)
+		}
+		raw.Close()
+	}
+}
+
+func writeObjectTo(s Storage, name string, data []byte) error {
+	w, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// localStorage keeps the store in a directory on the local filesystem, one
+// file per name.
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) (*localStorage, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &localStorage{root: root}, nil
+}
+
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *localStorage) Open(name string) (storedFile, error) {
+	file, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Create writes to a temporary file next to name and renames it into place
+// on Close.
+func (s *localStorage) Create(name string) (storageWriter, error) {
+	finalPath := s.path(name)
+	dir := filepath.Dir(finalPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "."+filepath.Base(finalPath)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp makes the file private; give it the permissions uploads
+	// have always had
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &localWriter{File: file, finalPath: finalPath}, nil
+}
+
+func (s *localStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+func (s *localStorage) List(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(s.path(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Remove deletes name. Removing an empty directory drops it, so callers can
+// tidy up after the last file in it is gone.
+func (s *localStorage) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *localStorage) RemoveAll(dir string) error {
+	return os.RemoveAll(s.path(dir))
+}
+
+func (s *localStorage) Rename(oldName, newName string) error {
+	newPath := s.path(newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(s.path(oldName), newPath)
+}
+
+// rewriteHeader overwrites the start of name in place.
+func (s *localStorage) rewriteHeader(name string, header []byte) error {
+	file, err := os.OpenFile(s.path(name), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(header, 0); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+type localWriter struct {
+	*os.File
+	finalPath string
+	closed    bool
+}
+
+func (w *localWriter) Close() error {
+	w.closed = true
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := os.Rename(w.Name(), w.finalPath); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.File.Close()
+	os.Remove(w.Name())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStorage keeps the store in memory. Nothing survives a restart, which
+// makes it useful for tests and throwaway servers.
+type memoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+	serial  int64
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+	version int64
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string]*memoryObject)}
+}
+
+func (s *memoryStorage) info(name string, obj *memoryObject) *objectInfo {
+	return &objectInfo{
+		name:    path.Base(name),
+		size:    int64(len(obj.data)),
+		modTime: obj.modTime,
+		version: strconv.FormatInt(obj.version, 10),
+	}
+}
+
+// Open returns a reader over the object's current content. Objects are
+// never modified in place, so the reader is unaffected by later writes.
+func (s *memoryStorage) Open(name string) (storedFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return &memoryFile{Reader: bytes.NewReader(obj.data), info: s.info(name, obj)}, nil
+}
+
+func (s *memoryStorage) Create(name string) (storageWriter, error) {
+	return &memoryWriter{storage: s, name: name}, nil
+}
+
+func (s *memoryStorage) Stat(name string) (os.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, notExist("stat", name)
+	}
+	return s.info(name, obj), nil
+}
+
+func (s *memoryStorage) List(dir string) ([]os.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	dirs := make(map[string]*objectInfo)
+	var infos []os.FileInfo
+	for name, obj := range s.objects {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		if sub, _, nested := strings.Cut(rest, "/"); nested {
+			if d := dirs[sub]; d == nil {
+				dirs[sub] = &objectInfo{name: sub, dir: true, modTime: obj.modTime}
+				infos = append(infos, dirs[sub])
+			} else if obj.modTime.After(d.modTime) {
+				d.modTime = obj.modTime
+			}
+			continue
+		}
+		infos = append(infos, s.info(name, obj))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return notExist("remove", name)
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryStorage) RemoveAll(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.objects {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			delete(s.objects, name)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) Rename(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[oldName]
+	if !ok {
+		return notExist("rename", oldName)
+	}
+	delete(s.objects, oldName)
+	s.objects[newName] = obj
+	return nil
+}
+
+type memoryFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *memoryFile) Stat() (os.FileInfo, error) { return f.info, nil }
+func (f *memoryFile) Close() error               { return nil }
+
+type memoryWriter struct {
+	storage *memoryStorage
+	name    string
+	buf     bytes.Buffer
+	closed  bool
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	s := w.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serial++
+	s.objects[w.name] = &memoryObject{data: w.buf.Bytes(), modTime: time.Now(), version: s.serial}
+	return nil
+}
+
+func (w *memoryWriter) Abort() {
+	w.closed = true
+	w.buf = bytes.Buffer{}
+}
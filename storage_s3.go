@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// s3PartSize is how much of a new object is buffered before it is sent
+	// as one part of a multipart upload.
+	s3PartSize = 16 << 20
+	// s3MaxCopySize is the largest object S3 copies in a single request.
+	s3MaxCopySize = 5 << 30
+
+	// Limits on reaching the object store and on how long it may take to
+	// start answering. Nothing limits how long a body takes: reading a
+	// large object streams one response for as long as the client
+	// downloading it keeps up.
+	s3DialTimeout           = 30 * time.Second
+	s3TLSHandshakeTimeout   = 10 * time.Second
+	s3ResponseHeaderTimeout = 2 * time.Minute
+)
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// s3Storage keeps the store in a bucket of an S3-compatible object store,
+// one object per name, using path-style requests signed with AWS
+// Signature Version 4.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+}
+
+func newS3Storage(cfg *serverConfig) (*s3Storage, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("s3 storage needs s3_endpoint and s3_bucket")
+	}
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3_endpoint %q", cfg.S3Endpoint)
+	}
+	prefix := strings.Trim(cfg.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &s3Storage{
+		endpoint:  endpoint,
+		bucket:    cfg.S3Bucket,
+		region:    cfg.S3Region,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		prefix:    prefix,
+		client:    &http.Client{Transport: newS3Transport()},
+	}
+	// Fail at startup rather than on the first upload if the bucket cannot
+	// be reached
+	if _, err := s.List(""); err != nil {
+		return nil, fmt.Errorf("error reaching bucket %s: %v", s.bucket, err)
+	}
+	return s, nil
+}
+
+func newS3Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = s3TLSHandshakeTimeout
+	t.ResponseHeaderTimeout = s3ResponseHeaderTimeout
+	return t
+}
+
+// s3Error is the error document S3 returns for a failed request.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// request sends a signed request for the object key (relative to the
+// prefix) and returns the response if it succeeded. A missing object is
+// reported as an os.ErrNotExist error.
+func (s *s3Storage) request(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	u.RawPath = "/" + s3Escape(s.bucket, false)
+	if key != "" {
+		u.Path += "/" + s.prefix + key
+		u.RawPath += "/" + s3Escape(s.prefix+key, false)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, u.EscapedPath(), u.RawQuery, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, notExist(strings.ToLower(method), key)
+	}
+	target := strings.TrimPrefix(u.Path, "/")
+	var e s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, target, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", method, target, resp.Status)
+}
+
+// sign adds AWS Signature Version 4 headers to req. Only the host and the
+// x-amz-* headers are signed.
+func (s *s3Storage) sign(req *http.Request, canonicalURI, canonicalQuery, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, canonicalURI, canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless escapeSlash is set, as Signature Version 4 requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *s3Storage) Open(name string) (storedFile, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{storage: s, key: name, info: info.(*objectInfo)}, nil
+}
+
+func (s *s3Storage) Create(name string) (storageWriter, error) {
+	return &s3Writer{storage: s, key: name}, nil
+}
+
+func (s *s3Storage) Stat(name string) (os.FileInfo, error) {
+	resp, err := s.request(http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &objectInfo{
+		name:    path.Base(name),
+		size:    resp.ContentLength,
+		modTime: modTime,
+		version: resp.Header.Get("ETag"),
+	}, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects lists the objects under dir, only those directly under it if
+// delimited is set, calling fn for every page of results.
+func (s *s3Storage) listObjects(dir string, delimited bool, fn func(prefix string, page *s3ListResult) error) error {
+	prefix := s.prefix
+	if dir != "" {
+		prefix += dir + "/"
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimited {
+		query.Set("delimiter", "/")
+	}
+	for {
+		resp, err := s.request(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error decoding object list: %v", err)
+		}
+		if err := fn(prefix, &page); err != nil {
+			return err
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (s *s3Storage) List(dir string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	err := s.listObjects(dir, true, func(prefix string, page *s3ListResult) error {
+		for _, c := range page.Contents {
+			if name := strings.TrimPrefix(c.Key, prefix); name != "" {
+				infos = append(infos, &objectInfo{name: name, size: c.Size, modTime: c.LastModified, version: c.ETag})
+			}
+		}
+		for _, p := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			infos = append(infos, &objectInfo{name: name, dir: true})
+		}
+		return nil
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, err
+}
+
+func (s *s3Storage) Remove(name string) error {
+	resp, err := s.request(http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) RemoveAll(dir string) error {
+	var keys []string
+	err := s.listObjects(dir, false, func(_ string, page *s3ListResult) error {
+		for _, c := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename copies the object on the server side and deletes the original.
+// Objects too large for a single copy request are streamed through.
+func (s *s3Storage) Rename(oldName, newName string) error {
+	info, err := s.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if info.Size() > s3MaxCopySize {
+		if err := s.copyThrough(oldName, newName); err != nil {
+			return err
+		}
+		return s.Remove(oldName)
+	}
+
+	header := http.Header{"X-Amz-Copy-Source": {s3Escape("/"+s.bucket+"/"+s.prefix+oldName, false)}}
+	resp, err := s.request(http.MethodPut, newName, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	// A copy can fail after the 200 status has been sent
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	var e s3Error
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 copy %s: %s: %s", oldName, e.Code, e.Message)
+	}
+	return s.Remove(oldName)
+}
+
+func (s *s3Storage) copyThrough(oldName, newName string) error {
+	src, err := s.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	w, err := s.Create(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// s3File reads an object with ranged GET requests. Reads that continue
+// where the previous one stopped share one response body, so sequential
+// reading costs a single request.
+type s3File struct {
+	storage *s3Storage
+	key     string
+	info    *objectInfo
+	pos     int64
+
+	mu      sync.Mutex
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	want := p
+	if remaining := f.info.size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+	if f.body == nil || f.bodyPos != off {
+		f.closeBody()
+		// If-Match keeps every range reading the object that was opened
+		header := http.Header{
+			"Range":    {fmt.Sprintf("bytes=%d-", off)},
+			"If-Match": {f.info.version},
+		}
+		resp, err := f.storage.request(http.MethodGet, f.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		f.body, f.bodyPos = resp.Body, off
+	}
+	n, err := io.ReadFull(f.body, want)
+	f.bodyPos += int64(n)
+	if err != nil {
+		f.closeBody()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative seek position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *s3File) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+}
+
+func (f *s3File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeBody()
+	return nil
+}
+
+// s3Writer buffers a new object. Small objects are sent with one PUT on
+// Close; larger ones go up part by part as a multipart upload.
+type s3Writer struct {
+	storage  *s3Storage
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	closed   bool
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= s3PartSize {
+		if err := w.uploadPart(w.buf[:s3PartSize]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[s3PartSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(data []byte) error {
+	s := w.storage
+	if w.uploadID == "" {
+		resp, err := s.request(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || result.UploadID == "" {
+			return fmt.Errorf("error starting multipart upload of %s: %v", w.key, err)
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	resp, err := s.request(http.MethodPut, w.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{Number: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	s := w.storage
+
+	if w.uploadID == "" {
+		resp, err := s.request(http.MethodPut, w.key, nil, nil, w.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(w.buf); err != nil {
+			w.abortUpload()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		w.abortUpload()
+		return err
+	}
+	resp, err := s.request(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		w.abortUpload()
+		return err
+	}
+	// Like a copy, completing an upload can fail after the 200 status
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var e s3Error
+	if err == nil && xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		err = fmt.Errorf("s3 complete %s: %s: %s", w.key, e.Code, e.Message)
+	}
+	if err != nil {
+		w.abortUpload()
+	}
+	return err
+}
+
+func (w *s3Writer) abortUpload() {
+	resp, err := w.storage.request(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (w *s3Writer) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.buf = nil
+	if w.uploadID != "" {
+		w.abortUpload()
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	activeConfig.Store(defaultConfig())
+	os.Exit(m.Run())
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, newMemoryStorage())
+}
+
+func TestLocalStorage(t *testing.T) {
+	s, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+}
+
+func TestS3Storage(t *testing.T) {
+	s, _ := newTestS3Storage(t)
+	testStorage(t, s)
+}
+
+func TestS3StorageMultipart(t *testing.T) {
+	s, fake := newTestS3Storage(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), s3PartSize/16+100)
+
+	w, err := s.Create("alice/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStored(t, s, "alice/big.bin"); !bytes.Equal(got, data) {
+		t.Fatalf("multipart object has %d bytes, want %d", len(got), len(data))
+	}
+
+	w, err = s.Create("alice/aborted.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Abort()
+	if _, err := s.Stat("alice/aborted.bin"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat of aborted object: got %v, want not exist", err)
+	}
+	if n := fake.pendingUploads(); n != 0 {
+		t.Fatalf("%d multipart uploads left after Abort", n)
+	}
+}
+
+// testStorage checks the behaviour every backend shares.
+func testStorage(t *testing.T, s Storage) {
+	// Content becomes visible on Close
+	w, err := s.Create("alice/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("alice/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat before Close: got %v, want not exist", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat("alice/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "a.txt" || info.Size() != 11 || info.IsDir() {
+		t.Fatalf("Stat: got %s, %d bytes, dir %v", info.Name(), info.Size(), info.IsDir())
+	}
+
+	// Aborted content never appears, and leaves nothing behind
+	w, err = s.Create("alice/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("discarded"))
+	w.Abort()
+	w.Abort()
+	if _, err := s.Stat("alice/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat of aborted object: got %v, want not exist", err)
+	}
+
+	// ReadAt reads anywhere, with io.EOF for a read that reaches the end
+	file, err := s.Open("alice/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 5)
+	if n, err := file.ReadAt(p, 6); n != 5 || string(p) != "world" || (err != nil && err != io.EOF) {
+		t.Fatalf("ReadAt(6): got %d %q %v", n, p[:n], err)
+	}
+	if n, err := file.ReadAt(p, 0); n != 5 || string(p) != "hello" || err != nil {
+		t.Fatalf("ReadAt(0): got %d %q %v", n, p[:n], err)
+	}
+	if n, err := file.ReadAt(p, 8); n != 3 || string(p[:n]) != "rld" || err != io.EOF {
+		t.Fatalf("ReadAt(8): got %d %q %v", n, p[:n], err)
+	}
+	if n, err := file.ReadAt(p, 11); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt(11): got %d %v", n, err)
+	}
+	file.Close()
+
+	// Replacing an object changes its content and version
+	w, err = s.Create("alice/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("replaced"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStored(t, s, "alice/a.txt"); string(got) != "replaced" {
+		t.Fatalf("replaced content: got %q", got)
+	}
+	replaced, err := s.Stat("alice/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sameObject(info, replaced) {
+		t.Fatal("replaced object reported as the same object")
+	}
+
+	// List shows entries directly under a directory, sorted, with
+	// subdirectories as directories
+	for _, name := range []string{"alice/x/y.txt", "alice/c.txt", "bob/d.txt"} {
+		w, err := s.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := listNames(t, s, "alice"); got != "a.txt c.txt x/" {
+		t.Fatalf("List(alice): got %q", got)
+	}
+	if got := listNames(t, s, ""); got != "alice/ bob/" {
+		t.Fatalf("List(root): got %q", got)
+	}
+	if got := listNames(t, s, "nobody"); got != "" {
+		t.Fatalf("List(nobody): got %q", got)
+	}
+
+	// Rename moves content to a new name, creating its directory
+	if err := s.Rename("alice/c.txt", "carol/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("alice/c.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat of renamed object: got %v, want not exist", err)
+	}
+	if got := readStored(t, s, "carol/c.txt"); string(got) != "alice/c.txt" {
+		t.Fatalf("renamed content: got %q", got)
+	}
+	if err := s.Rename("alice/missing.txt", "alice/other.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Rename of missing object: got %v, want not exist", err)
+	}
+
+	// Remove and RemoveAll
+	if err := s.Remove("bob/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("bob/d.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat of removed object: got %v, want not exist", err)
+	}
+	if err := s.RemoveAll("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listNames(t, s, "alice"); got != "" {
+		t.Fatalf("List after RemoveAll: got %q", got)
+	}
+	if _, err := s.Open("alice/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open after RemoveAll: got %v, want not exist", err)
+	}
+}
+
+func readStored(t *testing.T, s Storage, name string) []byte {
+	t.Helper()
+	file, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// listNames lists dir as space-separated names, directories with a
+// trailing slash.
+func listNames(t *testing.T, s Storage, dir string) string {
+	t.Helper()
+	infos, err := s.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+		if info.IsDir() {
+			names[i] += "/"
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func newTestS3Storage(t *testing.T) (*s3Storage, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{bucket: "files", objects: map[string]*fakeObject{}, uploads: map[string]map[int][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	cfg := defaultConfig()
+	cfg.S3Endpoint = server.URL
+	cfg.S3Bucket = "files"
+	cfg.S3Region = "us-east-1"
+	cfg.S3AccessKey = "test"
+	cfg.S3SecretKey = "secret"
+	cfg.S3Prefix = "store"
+	s, err := newS3Storage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+// fakeS3 is a stand-in for an S3-compatible object store: one bucket,
+// path-style requests, listings in pages of two, ranged and conditional
+// GETs, server-side copies and multipart uploads. Signatures are not
+// checked, only required.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]*fakeObject
+	uploads map[string]map[int][]byte
+	serial  int
+}
+
+type fakeObject struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+func (f *fakeS3) pendingUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+func (f *fakeS3) put(key string, data []byte) *fakeObject {
+	f.serial++
+	obj := &fakeObject{data: data, etag: fmt.Sprintf(`"%d"`, f.serial), modTime: time.Now().UTC().Truncate(time.Second)}
+	f.objects[key] = obj
+	return obj
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		s3Fail(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket)
+	if !ok {
+		s3Fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		obj := f.objects[key]
+		if obj == nil {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != obj.etag {
+			s3Fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modTime.Format(http.TimeFormat))
+		data, status := obj.data, http.StatusOK
+		if start, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(start, "-"))
+			data, status = data[offset:], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		if parts == nil {
+			s3Fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"+f.bucket+"/")
+		src := f.objects[source]
+		if src == nil {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		obj := f.put(key, src.data)
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", obj.etag)
+
+	case r.Method == http.MethodPut:
+		f.put(key, body)
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.serial++
+		id := fmt.Sprintf("upload-%d", f.serial)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		var complete struct {
+			Parts []s3Part `xml:"Part"`
+		}
+		if parts == nil || xml.Unmarshal(body, &complete) != nil {
+			s3Fail(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, parts[part.Number]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		obj := f.put(key, data)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", obj.etag)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s3Fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list answers a ListObjectsV2 request, two keys or prefixes per page.
+func (f *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	prefix, delimiter := first(query["prefix"]), first(query["delimiter"])
+	var entries []string
+	seen := map[string]bool{}
+	for key := range f.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if delimiter != "" {
+			if sub, _, nested := strings.Cut(rest, delimiter); nested {
+				key = prefix + sub + delimiter
+			}
+		}
+		if !seen[key] {
+			seen[key] = true
+			entries = append(entries, key)
+		}
+	}
+	sort.Strings(entries)
+
+	start, _ := strconv.Atoi(first(query["continuation-token"]))
+	end := min(start+2, len(entries))
+	var b strings.Builder
+	b.WriteString("<ListBucketResult>")
+	for _, key := range entries[start:end] {
+		if strings.HasSuffix(key, "/") && delimiter != "" {
+			fmt.Fprintf(&b, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", key)
+			continue
+		}
+		obj := f.objects[key]
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified><ETag>%s</ETag></Contents>",
+			key, len(obj.data), obj.modTime.Format(time.RFC3339), obj.etag)
+	}
+	if end < len(entries) {
+		fmt.Fprintf(&b, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	}
+	b.WriteString("</ListBucketResult>")
+	io.WriteString(w, b.String())
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func s3Fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
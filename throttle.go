@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transfers are throttled by token buckets for the whole server, for each
+// user and for each session. Every byte a session sends or receives is
+// taken from all three, so the tightest limit applies. Rates are in bytes
+// per second and are read from the current config on every transfer, so
+// zero in all three leaves a session unthrottled.
+const (
+	// A throttled transfer moves at most a twentieth of a second's worth
+	// of data between waits, so it stays smooth
+	throttleSlices   = 20
+	minThrottlePiece = 4 << 10
+	maxThrottlePiece = 256 << 10
+)
+
+// tokenBucket holds up to one second's worth of tokens at its rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n tokens at rate and returns how long to wait before using
+// them. The bucket may be overdrawn; the wait pays the debt back.
+func (b *tokenBucket) reserve(n int, rate int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	}
+	b.last = now
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+var (
+	serverBucket tokenBucket
+	userBuckets  = make(map[string]*tokenBucket)
+	userBucketMu sync.Mutex
+)
+
+func userBucket(username string) *tokenBucket {
+	userBucketMu.Lock()
+	defer userBucketMu.Unlock()
+	b := userBuckets[username]
+	if b == nil {
+		b = &tokenBucket{}
+		userBuckets[username] = b
+	}
+	return b
+}
+
+// userRateLimit returns the user's own rate limit, or the default.
+func userRateLimit(username string) int64 {
+	if value := lookupAccount(username).option("rate_limit"); value != "" {
+		if n, err := parseLimit(value, parseSize); err == nil {
+			return n
+		} else {
+			slog.Warn("Ignoring invalid rate_limit", "user", username, "value", value, "error", err)
+		}
+	}
+	return currentConfig().RateLimitUser
+}
+
+// throttledConn is a session's connection, throttled to the limits that
+// apply to it. It counts the bytes moved in the session's totals.
+type throttledConn struct {
+	net.Conn
+	s        *session
+	username string
+	user     *tokenBucket
+	session  tokenBucket
+}
+
+func throttleConnection(conn net.Conn, s *session) *throttledConn {
+	return &throttledConn{Conn: conn, s: s, username: s.username, user: userBucket(s.username)}
+}
+
+// limits returns the server, user and session rates, and how much to move
+// between waits. All three are zero when the session is not throttled.
+func (c *throttledConn) limits() (server, user, session int64, piece int) {
+	cfg := currentConfig()
+	server, user, session = cfg.RateLimit, userRateLimit(c.username), cfg.RateLimitSession
+	lowest := int64(0)
+	for _, rate := range []int64{server, user, session} {
+		if rate > 0 && (lowest == 0 || rate < lowest) {
+			lowest = rate
+		}
+	}
+	piece = int(lowest / throttleSlices)
+	if piece < minThrottlePiece {
+		piece = minThrottlePiece
+	}
+	if piece > maxThrottlePiece {
+		piece = maxThrottlePiece
+	}
+	return server, user, session, piece
+}
+
+// wait blocks until n bytes fit within every limit.
+func (c *throttledConn) wait(n int, server, user, session int64) {
+	var delay time.Duration
+	for _, limit := range []struct {
+		bucket *tokenBucket
+		rate   int64
+	}{{&serverBucket, server}, {c.user, user}, {&c.session, session}} {
+		if limit.rate > 0 {
+			if d := limit.bucket.reserve(n, limit.rate); d > delay {
+				delay = d
+			}
+		}
+	}
+	time.Sleep(delay)
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	server, user, session, piece := c.limits()
+	if server == 0 && user == 0 && session == 0 {
+		n, err := c.Conn.Read(p)
+		c.s.bytesIn.Add(int64(n))
+		return n, err
+	}
+	if len(p) > piece {
+		p = p[:piece]
+	}
+	n, err := c.Conn.Read(p)
+	c.s.bytesIn.Add(int64(n))
+	c.wait(n, server, user, session)
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		server, user, session, piece := c.limits()
+		if server == 0 && user == 0 && session == 0 {
+			n, err := c.Conn.Write(p)
+			c.s.bytesOut.Add(int64(n))
+			return written + n, err
+		}
+		if piece > len(p) {
+			piece = len(p)
+		}
+		c.wait(piece, server, user, session)
+		n, err := c.Conn.Write(p[:piece])
+		c.s.bytesOut.Add(int64(n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[piece:]
+	}
+	return written, nil
+}
+
+// ReadFrom lets the kernel send files (sendfile on Linux) when the session
+// is not throttled.
+func (c *throttledConn) ReadFrom(r io.Reader) (int64, error) {
+	if server, user, session, _ := c.limits(); server == 0 && user == 0 && session == 0 {
+		if rf, ok := c.Conn.(io.ReaderFrom); ok {
+			n, err := rf.ReadFrom(r)
+			c.s.bytesOut.Add(n)
+			return n, err
+		}
+	}
+	buf := getTransferBuffer()
+	defer putTransferBuffer(buf)
+	return io.CopyBuffer(writerOnly{c}, r, *buf)
+}
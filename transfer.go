@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+)
+
+// transferBuffers holds the buffers uploads and downloads copy through, so
+// busy servers do not allocate one per transfer. Buffers of a size that
+// no longer matches the config are dropped.
+var transferBuffers sync.Pool
+
+func getTransferBuffer() *[]byte {
+	size := int(currentConfig().TransferBufferSize)
+	if buf, ok := transferBuffers.Get().(*[]byte); ok && len(*buf) == size {
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+func putTransferBuffer(buf *[]byte) {
+	transferBuffers.Put(buf)
+}
+
+// writerOnly hides the ReadFrom method of a connection, so io.CopyBuffer
+// uses the buffer it is given instead of one of its own.
+type writerOnly struct {
+	io.Writer
+}
+
+// deadlineWriter extends the write deadline of conn before each write, so
+// a download keeps going as long as the client keeps reading, and a client
+// that stops reading does not hold a worker forever.
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	extendWriteDeadline(w.conn)
+	return w.conn.Write(p)
+}
+
+// sendContent sends size bytes of file starting at offset to conn. Plain
+// files on local disk are handed to the kernel, which sends them without
+// copying them through the server (sendfile on Linux), one transfer buffer
+// size at a time so the write deadline can be extended in between;
+// decrypted, decompressed or remote content goes through a transfer buffer.
+func sendContent(conn net.Conn, file storedFile, offset, size int64) (int64, error) {
+	if f, ok := file.(*os.File); ok {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		piece := currentConfig().TransferBufferSize
+		var sent int64
+		for sent < size {
+			extendWriteDeadline(conn)
+			n, err := io.Copy(conn, io.LimitReader(f, min(piece, size-sent)))
+			sent += n
+			if err != nil {
+				return sent, err
+			}
+			if n == 0 {
+				break
+			}
+		}
+		return sent, nil
+	}
+	buf := getTransferBuffer()
+	defer putTransferBuffer(buf)
+	return io.CopyBuffer(deadlineWriter{conn}, io.NewSectionReader(file, offset, size), *buf)
+}
+
+// receiveContent writes size bytes read from a client to w, extending the
+// read deadline for each read so large transfers are not cut off by the
+// idle timeout.
+func receiveContent(conn net.Conn, w io.Writer, r io.Reader, size int64) (int64, error) {
+	buf := getTransferBuffer()
+	defer putTransferBuffer(buf)
+	var received int64
+	for received < size {
+		chunk := *buf
+		if left := size - received; left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+		extendReadDeadline(conn)
+		n, err := io.ReadFull(r, chunk)
+		received += int64(n)
+		if err != nil {
+			return received, err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return received, err
+		}
+	}
+	return received, nil
+}
+
+// tuneConnection applies the configured socket buffer sizes to conn.
+func tuneConnection(conn net.Conn) {
+	size := int(currentConfig().SocketBufferSize)
+	tcp, ok := conn.(*net.TCPConn)
+	if size == 0 || !ok {
+		return
+	}
+	if err := tcp.SetReadBuffer(size); err != nil {
+		slog.Warn("Error setting socket receive buffer", "error", err)
+	}
+	if err := tcp.SetWriteBuffer(size); err != nil {
+		slog.Warn("Error setting socket send buffer", "error", err)
+	}
+}
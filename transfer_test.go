@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchTransferSize is how much one benchmark operation moves.
+const benchTransferSize = 16 << 20
+
+// BenchmarkSendContent measures download throughput over loopback TCP, for
+// plain files the kernel sends and for content copied through a transfer
+// buffer.
+func BenchmarkSendContent(b *testing.B) {
+	data := benchData()
+	path := filepath.Join(b.TempDir(), "content")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("sendfile", func(b *testing.B) {
+		file, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer file.Close()
+		benchmarkSend(b, file)
+	})
+	b.Run("buffered", func(b *testing.B) {
+		memory := newMemoryStorage()
+		if w, err := memory.Create("content"); err != nil {
+			b.Fatal(err)
+		} else {
+			w.Write(data)
+			w.Close()
+		}
+		file, err := memory.Open("content")
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkSend(b, file)
+	})
+}
+
+func benchmarkSend(b *testing.B, file storedFile) {
+	server, client := loopbackPair(b)
+	go io.Copy(io.Discard, client)
+
+	b.SetBytes(benchTransferSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sendContent(server, file, 0, benchTransferSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReceiveContent measures upload throughput over loopback TCP,
+// into a file and into memory.
+func BenchmarkReceiveContent(b *testing.B) {
+	b.Run("file", func(b *testing.B) {
+		file, err := os.Create(filepath.Join(b.TempDir(), "upload"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer file.Close()
+		benchmarkReceive(b, func() io.Writer {
+			file.Seek(0, io.SeekStart)
+			return file
+		})
+	})
+	b.Run("discard", func(b *testing.B) {
+		benchmarkReceive(b, func() io.Writer { return io.Discard })
+	})
+}
+
+func benchmarkReceive(b *testing.B, target func() io.Writer) {
+	data := benchData()
+	server, client := loopbackPair(b)
+	go func() {
+		for {
+			if _, err := client.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(benchTransferSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := receiveContent(server, target(), server, benchTransferSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchData() []byte {
+	data := make([]byte, benchTransferSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// loopbackPair returns both ends of a TCP connection over loopback, tuned
+// like client connections.
+func loopbackPair(b *testing.B) (server, client net.Conn) {
+	b.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		b.Fatal("error accepting loopback connection")
+	}
+	tuneConnection(server)
+	b.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
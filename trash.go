@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const trashDirName = ".trash"
+
+// trashEntry describes a deleted file. The content is stored next to the
+// metadata as <id>, the metadata as <id>.json.
+type trashEntry struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size"`
+}
+
+func trashDir(username string) string {
+	return path.Join(trashDirName, username)
+}
+
+func trashContentPath(username string, id int64) string {
+	return path.Join(trashDir(username), strconv.FormatInt(id, 10))
+}
+
+// trashRetention returns how long deleted files are kept. A per-user
+// setting overrides the server-wide default; zero keeps them until the
+// trash is emptied.
+func trashRetention(username string) time.Duration {
+	retention := currentConfig().TrashRetention
+	if value := lookupAccount(username).option("trash_retention"); value != "" {
+		if d, err := parseAge(value); err == nil {
+			retention = d
+		} else {
+			slog.Warn("Ignoring invalid trash_retention", "user", username, "value", value, "error", err)
+		}
+	}
+	return retention
+}
+
+// moveToTrash moves fileName from the user's directory into their trash.
+// Only files can be trashed, never directories.
+func moveToTrash(username, fileName string) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	filePath := path.Join(username, fileName)
+	info, err := statStoredFile(filePath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", fileName)
+	}
+
+	entry := trashEntry{
+		ID:      time.Now().UnixNano(),
+		Name:    fileName,
+		Path:    filePath,
+		Deleted: time.Now(),
+		Size:    info.Size(),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	contentPath := trashContentPath(username, entry.ID)
+	if err := store.Rename(filePath, contentPath); err != nil {
+		return err
+	}
+	if err := writeObject(contentPath+".json", data); err != nil {
+		// Without metadata the file could not be listed or restored
+		store.Rename(contentPath, filePath)
+		return err
+	}
+	return nil
+}
+
+// listTrash returns the user's trash, most recently deleted first.
+func listTrash(username string) ([]trashEntry, error) {
+	files, err := store.List(trashDir(username))
+	if err != nil {
+		return nil, err
+	}
+	var entries []trashEntry
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := readObject(path.Join(trashDir(username), file.Name()))
+		if err != nil {
+			continue
+		}
+		var entry trashEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			slog.Warn("Ignoring unreadable trash entry", "user", username, "file", file.Name(), "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+	return entries, nil
+}
+
+// removeTrashEntry permanently deletes a trashed file and its metadata.
+func removeTrashEntry(username string, id int64) error {
+	contentPath := trashContentPath(username, id)
+	if err := removeStoredFile(contentPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return store.Remove(contentPath + ".json")
+}
+
+// purgeTrash permanently deletes trashed files older than their owner's
+// retention period. It runs once an hour.
+func purgeTrash() {
+	for {
+		purgeExpiredTrash()
+		time.Sleep(time.Hour)
+	}
+}
+
+// purgeExpiredTrash deletes every trashed file past its retention period
+// and returns how many it deleted.
+func purgeExpiredTrash() int {
+	purged := 0
+	users, _ := store.List(trashDirName)
+	for _, user := range users {
+		username := user.Name()
+		retention := trashRetention(username)
+		if retention == 0 {
+			continue
+		}
+		storeMu.Lock()
+		entries, err := listTrash(username)
+		if err != nil {
+			slog.Error("Error reading trash", "user", username, "error", err)
+		}
+		for _, entry := range entries {
+			if time.Since(entry.Deleted) <= retention {
+				continue
+			}
+			if err := removeTrashEntry(username, entry.ID); err != nil {
+				slog.Error("Error purging file from trash", "user", username, "file", entry.Name, "error", err)
+				continue
+			}
+			slog.Info("Purged file from trash", "user", username, "file", entry.Name)
+			purged++
+		}
+		storeMu.Unlock()
+	}
+	return purged
+}
+
+// handleListTrash sends status, the entry count (int32) and for each entry
+// its id (int64), name (string), deletion time (int64) and size (int64).
+func handleListTrash(conn net.Conn, username string) error {
+	entries, err := listTrash(username)
+	if err != nil {
+		sendStatus(conn, statusError, "Error reading trash")
+		return fmt.Errorf("error listing trash: %v", err)
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(entries))); err != nil {
+		return fmt.Errorf("error sending entry count: %v", err)
+	}
+	for _, entry := range entries {
+		if err := binary.Write(conn, binary.LittleEndian, entry.ID); err != nil {
+			return fmt.Errorf("error sending entry: %v", err)
+		}
+		if err := writeString(conn, entry.Name); err != nil {
+			return fmt.Errorf("error sending entry: %v", err)
+		}
+		for _, v := range []int64{entry.Deleted.Unix(), entry.Size} {
+			if err := binary.Write(conn, binary.LittleEndian, v); err != nil {
+				return fmt.Errorf("error sending entry: %v", err)
+			}
+		}
+	}
+	logFor(conn).Debug("Listed trash", "files", len(entries))
+	return nil
+}
+
+// handleRestoreTrash moves a trashed file back to the user's directory,
+// under its original name unless the client gives a new one. It will not
+// overwrite an existing file.
+func handleRestoreTrash(reader *bufio.Reader, conn net.Conn, username string) error {
+	var id int64
+	if err := binary.Read(reader, binary.LittleEndian, &id); err != nil {
+		return fmt.Errorf("error reading trash id: %v", err)
+	}
+	newName, err := readString(reader)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %v", err)
+	}
+	if readOnly() {
+		return sendStatus(conn, statusReadOnly, "Server is read-only: disk space is critically low")
+	}
+
+	data, err := readObject(trashContentPath(username, id) + ".json")
+	if err != nil {
+		return sendStatus(conn, statusError, fmt.Sprintf("Trash entry %d does not exist", id))
+	}
+	var entry trashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		sendStatus(conn, statusError, "Error reading trash entry")
+		return fmt.Errorf("error reading trash entry %d: %v", id, err)
+	}
+	fileName := entry.Name
+	if newName != "" {
+		fileName = newName
+	}
+	auditFor(conn).setPath(fileName)
+	if !validFileName(fileName) {
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+
+	// The content already counts towards the quota from the trash
+	release, err := reserveUpload(username, fileName, 0)
+	if err != nil {
+		if _, ok := err.(*errQuotaExceeded); ok {
+			return sendStatus(conn, statusQuotaExceeded, err.Error())
+		}
+		return sendStatus(conn, statusError, err.Error())
+	}
+	defer release()
+
+	storeMu.Lock()
+	filePath := path.Join(username, fileName)
+	if _, err := store.Stat(filePath); err == nil {
+		storeMu.Unlock()
+		return sendStatus(conn, statusError, fmt.Sprintf("File %s already exists; restore it under another name", fileName))
+	}
+	err = store.Rename(trashContentPath(username, id), filePath)
+	if err == nil {
+		store.Remove(trashContentPath(username, id) + ".json")
+	}
+	storeMu.Unlock()
+	if err != nil {
+		sendStatus(conn, statusError, "Error restoring file")
+		return fmt.Errorf("error restoring %s from trash: %v", entry.Name, err)
+	}
+	go indexUploadedFile(username, fileName)
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	logFor(conn).Info("Restored file from trash", "file", entry.Name, "restored_as", fileName)
+	return nil
+}
+
+// handleEmptyTrash permanently deletes everything in the user's trash and
+// sends status and the number of files removed (int32).
+// It is allowed while the server is read-only, since it only frees space.
+func handleEmptyTrash(conn net.Conn, username string) error {
+	storeMu.Lock()
+	entries, err := listTrash(username)
+	removed := 0
+	for _, entry := range entries {
+		if err := removeTrashEntry(username, entry.ID); err != nil {
+			logFor(conn).Error("Error removing file from trash", "file", entry.Name, "error", err)
+			continue
+		}
+		removed++
+	}
+	storeMu.Unlock()
+	if err != nil {
+		sendStatus(conn, statusError, "Error reading trash")
+		return fmt.Errorf("error listing trash: %v", err)
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(removed)); err != nil {
+		return fmt.Errorf("error sending count: %v", err)
+	}
+	logFor(conn).Info("Emptied trash", "files", removed)
+	return nil
+}
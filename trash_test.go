@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestMoveToTrashRefusesDirectories(t *testing.T) {
+	s, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := store
+	store = s
+	defer func() { store = saved }()
+
+	if err := writeObject("alice/a.txt", []byte("keep me")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "."} {
+		if err := moveToTrash("alice", name); err == nil {
+			t.Errorf("moveToTrash(%q) succeeded", name)
+		}
+	}
+	if got := string(readStored(t, s, "alice/a.txt")); got != "keep me" {
+		t.Errorf("alice/a.txt = %q after refused moves", got)
+	}
+
+	if err := moveToTrash("alice", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := listTrash("alice")
+	if err != nil || len(entries) != 1 || entries[0].Name != "a.txt" {
+		t.Errorf("listTrash = %+v, %v; want a.txt", entries, err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// userAccount is one line of the credentials file:
+//
+//	username:password[:key=value,key=value...]
+//
+// The optional third field holds per-user settings such as quotas.
+type userAccount struct {
+	Password string
+	Options  map[string]string
+}
+
+var (
+	accountsMu sync.RWMutex
+	accounts   = make(map[string]*userAccount)
+)
+
+func setAccounts(m map[string]*userAccount) {
+	accountsMu.Lock()
+	accounts = m
+	accountsMu.Unlock()
+}
+
+// lookupAccount returns the account for username, or nil if there is none.
+func lookupAccount(username string) *userAccount {
+	accountsMu.RLock()
+	defer accountsMu.RUnlock()
+	return accounts[username]
+}
+
+// accountNames returns every username, sorted.
+func accountNames() []string {
+	accountsMu.RLock()
+	defer accountsMu.RUnlock()
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reloadUsers reads the credentials file again and closes the sessions of
+// users no longer in it. It returns how many users it loaded and how many
+// sessions it closed.
+func reloadUsers() (int, int, error) {
+	m, err := readCredentials(credentials)
+	if err != nil {
+		return 0, 0, err
+	}
+	setAccounts(m)
+	slog.Info("Reloaded users", "users", len(m), "file", credentials)
+
+	removed := make(map[string]bool)
+	mu.Lock()
+	for _, s := range authenticatedSessions {
+		if m[s.username] == nil {
+			removed[s.username] = true
+		}
+	}
+	mu.Unlock()
+	closed := 0
+	for username := range removed {
+		closed += closeSessions(closeByUser, username, nil, "Account removed")
+	}
+	return len(m), closed, nil
+}
+
+func parseAccountOptions(field string) map[string]string {
+	options := make(map[string]string)
+	for _, pair := range strings.Split(field, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		options[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return options
+}
+
+// option returns a per-user setting, or "" if the user has none.
+func (a *userAccount) option(key string) string {
+	if a == nil {
+		return ""
+	}
+	return a.Options[key]
+}
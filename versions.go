@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const versionsDirName = ".versions"
+
+// fileVersion is a previous copy of a file. Its id is the time it was
+// replaced, in Unix nanoseconds, and doubles as its name in the store.
+type fileVersion struct {
+	id      int64
+	size    int64
+	modTime time.Time
+}
+
+func versionDir(username, fileName string) string {
+	return path.Join(versionsDirName, username, fileName)
+}
+
+func versionPath(username, fileName string, id int64) string {
+	return path.Join(versionDir(username, fileName), strconv.FormatInt(id, 10))
+}
+
+// versionPolicy returns how many versions to keep and for how long. Per-user
+// settings from the credentials file override the server-wide defaults. A
+// keep count of zero turns versioning off; a zero age keeps versions until
+// the count limit pushes them out.
+func versionPolicy(username string) (int, time.Duration) {
+	cfg := currentConfig()
+	keep, maxAge := cfg.VersionsKeep, cfg.VersionsMaxAge
+	account := lookupAccount(username)
+
+	if value := account.option("versions_keep"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			keep = n
+		} else {
+			slog.Warn("Ignoring invalid versions_keep", "user", username, "value", value)
+		}
+	}
+	if value := account.option("versions_max_age"); value != "" {
+		if d, err := parseAge(value); err == nil {
+			maxAge = d
+		} else {
+			slog.Warn("Ignoring invalid versions_max_age", "user", username, "value", value, "error", err)
+		}
+	}
+	return keep, maxAge
+}
+
+// archiveCurrentVersion moves the current copy of fileName, if any, into the
+// version history. Callers must hold storeMu.
+func archiveCurrentVersion(username, fileName string) error {
+	if keep, _ := versionPolicy(username); keep == 0 {
+		return nil
+	}
+	filePath := path.Join(username, fileName)
+	if _, err := store.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+	id := time.Now().UnixNano()
+	if err := store.Rename(filePath, versionPath(username, fileName, id)); err != nil {
+		return err
+	}
+	slog.Info("Archived previous version", "user", username, "file", fileName, "version", id)
+	return nil
+}
+
+// listVersions returns the versions of fileName, newest first.
+func listVersions(username, fileName string) ([]fileVersion, error) {
+	entries, err := store.List(versionDir(username, fileName))
+	if err != nil {
+		return nil, err
+	}
+	var versions []fileVersion
+	for _, entry := range entries {
+		id, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := statStoredFile(versionPath(username, fileName, id))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, fileVersion{id: id, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].id > versions[j].id })
+	return versions, nil
+}
+
+// pruneVersions applies the user's retention policy to fileName's history.
+// Callers must hold storeMu.
+func pruneVersions(username, fileName string) {
+	versions, err := listVersions(username, fileName)
+	if err != nil {
+		slog.Error("Error listing versions", "user", username, "file", fileName, "error", err)
+		return
+	}
+	keep, maxAge := versionPolicy(username)
+	for i, version := range versions {
+		expired := maxAge > 0 && time.Since(time.Unix(0, version.id)) > maxAge
+		if i < keep && !expired {
+			continue
+		}
+		if err := removeStoredFile(versionPath(username, fileName, version.id)); err != nil {
+			slog.Error("Error removing version", "user", username, "file", fileName, "version", version.id, "error", err)
+			continue
+		}
+		slog.Info("Pruned version", "user", username, "file", fileName, "version", version.id)
+	}
+	// Drop the history directory once it is empty
+	store.Remove(versionDir(username, fileName))
+}
+
+// expireVersions applies retention policies to every history once an hour,
+// so age limits hold for files that are no longer being written.
+func expireVersions() {
+	for {
+		expireAllVersions()
+		time.Sleep(time.Hour)
+	}
+}
+
+// expireAllVersions applies retention policies to every history.
+func expireAllVersions() {
+	users, _ := store.List(versionsDirName)
+	for _, user := range users {
+		files, _ := store.List(path.Join(versionsDirName, user.Name()))
+		for _, file := range files {
+			storeMu.Lock()
+			pruneVersions(user.Name(), file.Name())
+			storeMu.Unlock()
+		}
+	}
+}
+
+// readVersionRequest reads a filename and, if withID is set, a version id.
+func readVersionRequest(r io.Reader, withID bool) (string, int64, error) {
+	fileName, err := readString(r)
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading filename: %v", err)
+	}
+	var id int64
+	if withID {
+		if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return "", 0, fmt.Errorf("error reading version id: %v", err)
+		}
+	}
+	return fileName, id, nil
+}
+
+// handleListVersions sends status, the version count (int32) and for each
+// version its id, size and modification time (int64 each), newest first.
+func handleListVersions(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, _, err := readVersionRequest(reader, false)
+	if err != nil {
+		return err
+	}
+	auditFor(conn).setPath(fileName)
+	if !validFileName(fileName) {
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+
+	versions, err := listVersions(username, fileName)
+	if err != nil {
+		sendStatus(conn, statusError, "Error reading version history")
+		return fmt.Errorf("error listing versions: %v", err)
+	}
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(versions))); err != nil {
+		return fmt.Errorf("error sending version count: %v", err)
+	}
+	for _, version := range versions {
+		for _, v := range []int64{version.id, version.size, version.modTime.Unix()} {
+			if err := binary.Write(conn, binary.LittleEndian, v); err != nil {
+				return fmt.Errorf("error sending version: %v", err)
+			}
+		}
+	}
+	logFor(conn).Debug("Listed versions", "file", fileName, "versions", len(versions))
+	return nil
+}
+
+// handleDownloadVersion sends status, then the version's size (int64) and
+// content.
+func handleDownloadVersion(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, id, err := readVersionRequest(reader, true)
+	if err != nil {
+		return err
+	}
+	auditFor(conn).setPath(fileName)
+	if !validFileName(fileName) {
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+
+	worker, ok := acquireWorker()
+	if !ok {
+		return sendBusy(conn, username, "a download")
+	}
+	defer worker()
+
+	file, err := openStoredFile(versionPath(username, fileName, id))
+	if err != nil {
+		logFor(conn).Warn("Requested missing version", "file", fileName, "version", id)
+		return sendStatus(conn, statusError, fmt.Sprintf("Version %d of %s does not exist", id, fileName))
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		sendStatus(conn, statusError, "Error reading version")
+		return fmt.Errorf("error getting version info: %v", err)
+	}
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, info.Size()); err != nil {
+		return fmt.Errorf("error sending file size: %v", err)
+	}
+	bytesSent, err := sendContent(conn, file, 0, info.Size())
+	if err != nil {
+		return fmt.Errorf("error sending file content: %v", err)
+	}
+
+	logFor(conn).Info("Version downloaded", "file", fileName, "version", id, "bytes", bytesSent)
+	return nil
+}
+
+// handleRestoreVersion makes a copy of a version the current file. The copy
+// being replaced goes into the history like any overwritten file.
+func handleRestoreVersion(reader *bufio.Reader, conn net.Conn, username string) error {
+	fileName, id, err := readVersionRequest(reader, true)
+	if err != nil {
+		return err
+	}
+	auditFor(conn).setPath(fileName)
+	if !validFileName(fileName) {
+		return sendStatus(conn, statusError, "Invalid file name")
+	}
+	if readOnly() {
+		return sendStatus(conn, statusReadOnly, "Server is read-only: disk space is critically low")
+	}
+
+	info, err := statStoredFile(versionPath(username, fileName, id))
+	if err != nil {
+		return sendStatus(conn, statusError, fmt.Sprintf("Version %d of %s does not exist", id, fileName))
+	}
+
+	if status, msg := checkUploadSpace(info.Size()); status != statusOK {
+		return sendStatus(conn, status, msg)
+	}
+	release, err := reserveUpload(username, fileName, info.Size())
+	if err != nil {
+		if _, ok := err.(*errQuotaExceeded); ok {
+			return sendStatus(conn, statusQuotaExceeded, err.Error())
+		}
+		return sendStatus(conn, statusError, err.Error())
+	}
+	defer release()
+
+	if err := restoreVersion(username, fileName, id); err != nil {
+		sendStatus(conn, statusError, "Error restoring version")
+		return fmt.Errorf("error restoring version %d of %s: %v", id, fileName, err)
+	}
+	go indexUploadedFile(username, fileName)
+
+	if _, err := conn.Write([]byte{statusOK}); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+	logFor(conn).Info("Restored version", "file", fileName, "version", id)
+	return nil
+}
+
+func restoreVersion(username, fileName string, id int64) error {
+	staging, stagingName, err := createStagingFile(username, fileName)
+	if err != nil {
+		return err
+	}
+	if err := copyStoredFile(staging, versionPath(username, fileName, id)); err != nil {
+		staging.Abort()
+		return err
+	}
+	if err := staging.Close(); err != nil {
+		return err
+	}
+	if err := commitFile(username, fileName, stagingName); err != nil {
+		store.Remove(stagingName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// View modes sent by the client after the filename.
+const (
+	viewHead  byte = 0 // bytes from offset
+	viewTail  byte = 1 // last length bytes
+	viewLines byte = 2 // length lines starting at line offset (1-based)
+	viewHex   byte = 3 // hex dump of bytes from offset
+)
+
+type viewRequest struct {
+	fileName string
+	mode     byte
+	offset   int64
+	length   int64
+}
+
+// readViewRequest reads the filename, mode, offset and length of a view
+// request.
+func readViewRequest(r io.Reader) (viewRequest, error) {
+	var req viewRequest
+	var err error
+	if req.fileName, err = readString(r); err != nil {
+		return req, fmt.Errorf("error reading filename: %v", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &req.mode); err != nil {
+		return req, fmt.Errorf("error reading view mode: %v", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &req.offset); err != nil {
+		return req, fmt.Errorf("error reading view offset: %v", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &req.length); err != nil {
+		return req, fmt.Errorf("error reading view length: %v", err)
+	}
+	return req, nil
+}
+
+// readViewRange reads the part of file selected by req. It returns the data
+// and the byte offset in the file where it starts.
+func readViewRange(file io.ReadSeeker, fileSize int64, req viewRequest) ([]byte, int64, error) {
+	cfg := currentConfig()
+	length := req.length
+	if req.mode != viewLines {
+		if length <= 0 {
+			length = cfg.ViewDefaultBytes
+		}
+		if length > cfg.ViewMaxBytes {
+			length = cfg.ViewMaxBytes
+		}
+	}
+
+	switch req.mode {
+	case viewHead, viewHex:
+		if req.offset < 0 || req.offset > fileSize {
+			return nil, 0, fmt.Errorf("offset %d is outside the file (size %d)", req.offset, fileSize)
+		}
+		return readAt(file, req.offset, length)
+
+	case viewTail:
+		start := fileSize - length
+		if start < 0 {
+			start = 0
+		}
+		data, start, err := readAt(file, start, fileSize-start)
+		if err != nil || start == 0 {
+			return data, start, err
+		}
+		// Start at a line boundary so the first line shown is not cut off
+		if i := bytes.IndexByte(data, '\n'); i >= 0 && i < len(data)-1 {
+			return data[i+1:], start + int64(i+1), nil
+		}
+		return data, start, nil
+
+	case viewLines:
+		return readLines(file, req.offset, length, cfg)
+
+	default:
+		return nil, 0, fmt.Errorf("unknown view mode %d", req.mode)
+	}
+}
+
+func readAt(file io.ReadSeeker, offset, length int64) ([]byte, int64, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(io.LimitReader(file, length))
+	return data, offset, err
+}
+
+// readLines returns count lines starting at the 1-based line first, stopping
+// early if the byte cap is reached.
+func readLines(file io.ReadSeeker, first, count int64, cfg *serverConfig) ([]byte, int64, error) {
+	if first < 1 {
+		first = 1
+	}
+	if count <= 0 {
+		count = int64(cfg.ViewDefaultLines)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for line := int64(1); line < first; line++ {
+		skipped, err := reader.ReadSlice('\n')
+		offset += int64(len(skipped))
+		for err == bufio.ErrBufferFull {
+			skipped, err = reader.ReadSlice('\n')
+			offset += int64(len(skipped))
+		}
+		if err == io.EOF {
+			return nil, offset, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var out bytes.Buffer
+	for line := int64(0); line < count && int64(out.Len()) < cfg.ViewMaxBytes; line++ {
+		text, err := reader.ReadBytes('\n')
+		out.Write(text)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	data := out.Bytes()
+	if int64(len(data)) > cfg.ViewMaxBytes {
+		data = data[:cfg.ViewMaxBytes]
+	}
+	return data, offset, nil
+}
+
+// fileEncoding guesses the text encoding of a file from its first bytes,
+// returning the encoding name and the length of any byte order mark.
+func fileEncoding(file io.ReaderAt) (string, int) {
+	head := make([]byte, 4)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8", 3
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return "utf-16le", 2
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return "utf-16be", 2
+	}
+	return "", 0
+}
+
+// decodeForView converts data to UTF-8 text for display. encoding is the
+// encoding detected from the file's byte order mark, if any. Data that does
+// not look like text is rendered as a hex dump and reported as "binary".
+func decodeForView(data []byte, start int64, encoding string, bomLen int, mode byte) ([]byte, string) {
+	if mode == viewHex {
+		return []byte(hexDump(data, start)), "hex"
+	}
+	if start < int64(bomLen) {
+		skip := int64(bomLen) - start
+		if skip > int64(len(data)) {
+			skip = int64(len(data))
+		}
+		data = data[skip:]
+	}
+
+	switch encoding {
+	case "utf-16le", "utf-16be":
+		// Code units start at even offsets
+		if start%2 != 0 && len(data) > 0 {
+			data = data[1:]
+		}
+		return decodeUTF16(data, encoding == "utf-16be"), encoding
+	}
+
+	if looksBinary(data) {
+		return []byte(hexDump(data, start)), "binary"
+	}
+	if text := trimPartialRunes(data); utf8.Valid(text) {
+		return text, "utf-8"
+	}
+	// Fall back to Latin-1, which maps every byte to a code point
+	var sb strings.Builder
+	for _, b := range data {
+		sb.WriteRune(rune(b))
+	}
+	return []byte(sb.String()), "latin-1"
+}
+
+// trimPartialRunes drops UTF-8 sequences cut in half at either end of data,
+// which happens whenever a range starts or ends mid-character.
+func trimPartialRunes(data []byte) []byte {
+	for i := 0; i < utf8.UTFMax-1 && len(data) > 0 && !utf8.RuneStart(data[0]); i++ {
+		data = data[1:]
+	}
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				data = data[:len(data)-i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// looksBinary reports whether data contains NUL bytes or a high share of
+// control characters other than common whitespace and escapes.
+func looksBinary(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	control := 0
+	for _, b := range data {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' && b != '\b' && b != 0x1B {
+			control++
+		}
+	}
+	return control*10 > len(data)
+}
+
+func decodeUTF16(data []byte, bigEndian bool) []byte {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, binary.BigEndian.Uint16(data[i:]))
+		} else {
+			units = append(units, binary.LittleEndian.Uint16(data[i:]))
+		}
+	}
+	return []byte(string(utf16.Decode(units)))
+}
+
+// hexDump formats data like hexdump -C, with offsets relative to the file.
+func hexDump(data []byte, start int64) string {
+	var sb strings.Builder
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		line := hex.Dump(data[i:end])
+		// hex.Dump numbers lines from zero; replace with the file offset
+		fmt.Fprintf(&sb, "%08x%s", start+int64(i), line[8:])
+	}
+	return sb.String()
+}
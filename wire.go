@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// maxStringLen bounds length-prefixed strings read from clients so a bogus
+// length cannot make the server allocate arbitrary amounts of memory.
+const maxStringLen = 64 * 1024
+
+// Status codes sent in reply to a request. Anything but statusOK is followed
+// by an error message. Uploads are answered with a status before the client
+// sends any file content.
+const (
+	statusError         byte = 0
+	statusOK            byte = 1
+	statusQuotaExceeded byte = 2
+	statusDiskFull      byte = 3
+	statusReadOnly      byte = 4
+	statusUnsupported   byte = 5
+	statusBusy          byte = 6
+)
+
+// readString reads an int32 length followed by that many bytes.
+func readString(r io.Reader) (string, error) {
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	if n < 0 || n > maxStringLen {
+		return "", fmt.Errorf("invalid string length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeString writes s as an int32 length followed by its bytes.
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(len(s))); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+// validFileName reports whether name refers to a file directly inside the
+// user's directory.
+func validFileName(name string) bool {
+	if name == "" || name == "." || strings.Contains(name, "..") {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`)
+}
+
+// sendStatus writes a status byte followed by msg, the reply used for
+// rejected requests. On a session's connection, the status is noted in the
+// operation's audit record.
+func sendStatus(w io.Writer, status byte, msg string) error {
+	if conn, ok := w.(net.Conn); ok {
+		auditFor(conn).fail(status, msg)
+	}
+	if _, err := w.Write([]byte{status}); err != nil {
+		return err
+	}
+	return writeString(w, msg)
+}